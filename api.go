@@ -16,6 +16,16 @@ const (
 	superProperties = "eyJvcyI6IldpbmRvd3MiLCJicm93c2VyIjoiQ2hyb21lIiwiZGV2aWNlIjoiIiwic3lzdGVtX2xvY2FsZSI6ImVuLVVTIiwiYnJvd3Nlcl91c2VyX2FnZW50IjoiTW96aWxsYS81LjAgKFdpbmRvd3MgTlQgMTAuMDsgV2luNjQ7IHg2NCkgQXBwbGVXZWJLaXQvNTM3LjM2IChLSFRNTCwgbGlrZSBHZWNrbykgQ2hyb21lLzEyNS4wLjAuMCBTYWZhcmkvNTM3LjM2IiwiYnJvd3Nlcl92ZXJzaW9uIjoiMTI1LjAuMC4wIiwib3NfdmVyc2lvbiI6IjEwIiwicmVmZXJyZXIiOiJodHRwczovL3d3dy5nb29nbGUuY29tLyIsInJlZmVycmluZ19kb21haW4iOiJ3d3cuZ29vZ2xlLmNvbSIsInNlYXJjaF9lbmdpbmUiOiJnb29nbGUiLCJyZWZlcnJlcl9jdXJyZW50IjoiIiwicmVmZXJyaW5nX2RvbWFpbl9jdXJyZW50IjoiIiwicmVsZWFzZV9jaGFubmVsIjoic3RhYmxlIiwiY2xpZW50X2J1aWxkX251bWJlciI6MzAxOTIwLCJjbGllbnRfZXZlbnRfc291cmNlIjpudWxsLCJkZXNpZ25faWQiOjB9"
 )
 
+// soundboardAPI is what the server needs from Discord's REST API. It's a
+// DiscordRestClient except in tests.
+type soundboardAPI interface {
+	userFetcher
+	GetUserId() string
+	SendSoundboardSound(guildId, channelId, soundId string) error
+	DeleteSoundboardSound(guildId, soundId string) error
+	CreateSoundboardSound(guildId, name, mimeType string, volume float64, data []byte) (CreateSoundboardSoundResponse, error)
+}
+
 type DiscordRestClient struct {
 	token   string
 	discord *discordgo.Session
@@ -45,6 +55,14 @@ func (c *DiscordRestClient) GetUserId() string {
 	return c.userID
 }
 
+func (c *DiscordRestClient) GetUser(userID string) (UserInfo, error) {
+	u, err := c.discord.User(userID)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return UserInfo{UserID: u.ID, Username: u.Username, Avatar: u.Avatar}, nil
+}
+
 type SendSoundboardSoundRequest struct {
 	SoundID       string  `json:"sound_id"`
 	EmojiID       *string `json:"emoji_id"`
@@ -71,10 +89,31 @@ func (c *DiscordRestClient) DeleteSoundboardSound(guildId, soundId string) error
 	return err
 }
 
+type SoundboardSoundItem struct {
+	Name    string `json:"name"`
+	SoundID string `json:"sound_id"`
+	UserID  string `json:"user_id"`
+}
+
+// ListSoundboardSounds returns the guild's soundboard sounds in board order.
+func (c *DiscordRestClient) ListSoundboardSounds(guildId string) ([]SoundboardSoundItem, error) {
+	resp, err := c.discord.Request(http.MethodGet, baseURL+"/api/v9/guilds/"+guildId+"/soundboard-sounds", nil, func(cfg *discordgo.RequestConfig) {
+		cfg.Request.Header.Set("X-Super-Properties", superProperties)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []SoundboardSoundItem `json:"items"`
+	}
+	err = json.Unmarshal(resp, &list)
+	return list.Items, err
+}
+
 type CreateSoundboardSoundRequest struct {
-	Name   string `json:"name"`
-	Sound  string `json:"sound"`
-	Volume int    `json:"volume"`
+	Name   string  `json:"name"`
+	Sound  string  `json:"sound"`
+	Volume float64 `json:"volume"`
 }
 
 type CreateSoundboardSoundResponse struct {
@@ -85,14 +124,16 @@ type CreateSoundboardSoundResponse struct {
 	// There are more, but I'm too lazy to add them.
 }
 
-func (c *DiscordRestClient) CreateSoundboardSound(guildId, name, mimeType string, data []byte) (CreateSoundboardSoundResponse, error) {
+// CreateSoundboardSound uploads data as a new soundboard sound. volume goes from
+// 0 to 1.
+func (c *DiscordRestClient) CreateSoundboardSound(guildId, name, mimeType string, volume float64, data []byte) (CreateSoundboardSoundResponse, error) {
 	var soundBuf bytes.Buffer
 	soundBuf.WriteString("data:" + mimeType + ";base64,")
 	soundBuf.WriteString(base64.StdEncoding.EncodeToString(data))
 	request := CreateSoundboardSoundRequest{
 		Name:   name,
 		Sound:  soundBuf.String(),
-		Volume: 1,
+		Volume: volume,
 	}
 
 	start := time.Now()
@@ -0,0 +1,132 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// The /api/v1 endpoints are the scriptable side of the board: they do what
+// the HTMX endpoints do but take and return JSON. openapi.json describes them
+// and is served at /api/v1/openapi.json, so keep the two in step.
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const maxAPIBodySize = 1 << 20
+
+// error codes, so scripts don't have to match on messages.
+const (
+	apiErrorBadRequest       = "bad_request"
+	apiErrorNotFound         = "not_found"
+	apiErrorMethodNotAllowed = "method_not_allowed"
+	apiErrorConflict         = "conflict"
+	apiErrorUpstream         = "upstream_error"
+	apiErrorInternal         = "internal_error"
+)
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiBoardSound struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	UserID      string `json:"userID"`
+	Uploader    string `json:"uploader,omitempty"`
+	AvatarURL   string `json:"avatarURL"`
+	AudioURL    string `json:"audioURL"`
+	LibraryName string `json:"libraryName,omitempty"` // the stored sound it's a copy of
+	Removable   bool   `json:"removable"`
+}
+
+type apiBoardSlot struct {
+	Slot  int            `json:"slot"`
+	Sound *apiBoardSound `json:"sound"` // null when the slot is free
+}
+
+type apiBoard struct {
+	Slots            []apiBoardSlot `json:"slots"`
+	UserInChannel    bool           `json:"userInChannel"`
+	GatewayConnected bool           `json:"gatewayConnected"`
+}
+
+type apiLibrarySound struct {
+	Name        string     `json:"name"`
+	Location    string     `json:"location"`
+	Folder      string     `json:"folder,omitempty"`
+	Format      string     `json:"format"`
+	Duration    float64    `json:"durationSeconds,omitempty"`
+	Size        int        `json:"size"`
+	OnBoard     bool       `json:"onBoard"`
+	Warning     string     `json:"warning,omitempty"`
+	DuplicateOf string     `json:"duplicateOf,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Uploader    string     `json:"uploader,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	SavedAt     *time.Time `json:"savedAt,omitempty"`
+	AudioURL    string     `json:"audioURL"`
+	WaveformURL string     `json:"waveformURL"`
+}
+
+type apiLibrary struct {
+	Sounds []apiLibrarySound `json:"sounds"`
+}
+
+type apiAddSoundRequest struct {
+	Location string `json:"location"`
+}
+
+type apiSwapRequest struct {
+	Remove string `json:"remove"` // board sound ID
+	Add    string `json:"add"`    // library location
+}
+
+type apiSaveSoundRequest struct {
+	Name string `json:"name,omitempty"` // defaults to the board sound's name
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError answers with an error object. err's message loses the
+// "[error] " prefix the rest of the code uses for logs.
+func writeAPIError(w http.ResponseWriter, status int, code string, err error) {
+	message := strings.TrimPrefix(err.Error(), "[error] ")
+	writeAPIJSON(w, status, apiErrorResponse{Error: apiError{Code: code, Message: message}})
+}
+
+// decodeAPIBody reads a JSON request body into v, refusing unknown fields so
+// typos don't go unnoticed.
+func decodeAPIBody(r *http.Request, v any) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("[error] invalid request body: %v", err)
+	}
+	return nil
+}
+
+// allowMethod answers 405 with an Allow header unless r uses one of methods.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, apiErrorMethodNotAllowed, fmt.Errorf("[error] %s %s is not allowed", r.Method, r.URL.Path))
+	return false
+}
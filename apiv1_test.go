@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// openAPISpec is what the tests check responses against in openapi.json.
+type openAPISpec struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	// path, then method (or "parameters", which is skipped)
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Responses map[string]openAPIResponse `json:"responses"`
+		Schemas   map[string]openAPISchema   `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema openAPISchema `json:"schema"`
+	} `json:"content"`
+}
+
+type openAPISchema struct {
+	Ref        string                   `json:"$ref"`
+	Type       string                   `json:"type"`
+	Required   []string                 `json:"required"`
+	Properties map[string]openAPISchema `json:"properties"`
+	Items      *openAPISchema           `json:"items"`
+	Enum       []string                 `json:"enum"`
+	AllOf      []openAPISchema          `json:"allOf"`
+}
+
+func loadOpenAPISpec(t *testing.T) *openAPISpec {
+	var spec openAPISpec
+	if err := json.Unmarshal(openAPIDocument, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/api/v1" {
+		t.Fatalf("expected the spec to be served from /api/v1, got %+v", spec.Servers)
+	}
+	return &spec
+}
+
+func (spec *openAPISpec) schema(s openAPISchema) openAPISchema {
+	if s.Ref != "" {
+		return spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	if len(s.AllOf) == 1 {
+		return spec.schema(s.AllOf[0])
+	}
+	return s
+}
+
+// pathFor finds the documented path p falls under, e.g.
+// /board/sounds/{soundID} for /board/sounds/123.
+func (spec *openAPISpec) pathFor(p string) (string, bool) {
+	for documented := range spec.Paths {
+		pattern := regexp.MustCompile(`\\\{[^/]+\\\}`).ReplaceAllString(regexp.QuoteMeta(documented), `[^/]+`)
+		if regexp.MustCompile("^" + pattern + "$").MatchString(p) {
+			return documented, true
+		}
+	}
+	return "", false
+}
+
+// check fails t unless v, decoded JSON, has everything s requires all the way
+// down.
+func (spec *openAPISpec) check(t *testing.T, where string, s openAPISchema, v any) {
+	t.Helper()
+	s = spec.schema(s)
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				t.Errorf("%s: missing required %q", where, name)
+			}
+		}
+		for name, value := range v {
+			if property, ok := s.Properties[name]; ok && value != nil {
+				spec.check(t, where+"."+name, property, value)
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range v {
+				spec.check(t, where+"["+strconv.Itoa(i)+"]", *s.Items, item)
+			}
+		}
+	case string:
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, v) {
+			t.Errorf("%s: %q isn't one of %v", where, v, s.Enum)
+		}
+	}
+}
+
+// apiTest makes /api/v1 requests to a test server, checking each response
+// against the spec and noting which documented responses it's seen.
+type apiTest struct {
+	s      *testServer
+	spec   *openAPISpec
+	covers map[string]bool // "POST /board/sounds 409"
+}
+
+// call makes the request and checks it got status, with code if it's an
+// error. It returns the body.
+func (a *apiTest) call(t *testing.T, method, p, body string, status int, code string) []byte {
+	t.Helper()
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, a.s.URL+"/api/v1"+p, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := a.s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where := method + " " + p
+	if resp.StatusCode != status {
+		t.Fatalf("%s: expected %d, got %d %s", where, status, resp.StatusCode, data)
+	}
+
+	if status >= 400 {
+		var errResp apiErrorResponse
+		if err := json.Unmarshal(data, &errResp); err != nil || errResp.Error.Code != code || errResp.Error.Message == "" || strings.HasPrefix(errResp.Error.Message, "[error]") {
+			t.Errorf("%s: expected a %s error, got %s", where, code, data)
+		}
+	}
+	if status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") == "" {
+		t.Errorf("%s: expected an Allow header", where)
+	}
+
+	documented, ok := a.spec.pathFor(strings.SplitN(p, "?", 2)[0])
+	if !ok {
+		// there's nothing there, it has to say so like everything else.
+		a.spec.check(t, where, a.spec.Components.Responses["Error"].Content["application/json"].Schema, decodeAny(t, data))
+		return data
+	}
+	rawOperation, ok := a.spec.Paths[documented][strings.ToLower(method)]
+	if !ok {
+		if status != http.StatusMethodNotAllowed {
+			t.Errorf("%s: %s isn't documented, expected 405", where, method)
+		}
+		return data
+	}
+	var operation openAPIOperation
+	if err := json.Unmarshal(rawOperation, &operation); err != nil {
+		t.Fatal(err)
+	}
+	response, ok := operation.Responses[strconv.Itoa(status)]
+	if !ok {
+		t.Errorf("%s: %d isn't one of the documented responses", where, status)
+		return data
+	}
+	a.covers[method+" "+documented+" "+strconv.Itoa(status)] = true
+	if response.Ref != "" {
+		response = a.spec.Components.Responses[strings.TrimPrefix(response.Ref, "#/components/responses/")]
+	}
+	content, ok := response.Content["application/json"]
+	if !ok {
+		if len(data) != 0 {
+			t.Errorf("%s: expected no body, got %s", where, data)
+		}
+		return data
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: expected JSON, got %q", where, ct)
+	}
+	a.spec.check(t, where, content.Schema, decodeAny(t, data))
+	return data
+}
+
+func decodeAny(t *testing.T, data []byte) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("expected JSON, got %s: %v", data, err)
+	}
+	return v
+}
+
+func TestAPIV1(t *testing.T) {
+	s := newTestServer(t)
+	a := &apiTest{s: s, spec: loadOpenAPISpec(t), covers: make(map[string]bool)}
+	noone, bruh := s.boardSound(t, "NoOneHeard"), s.boardSound(t, "bruh")
+	// a library sound that can't be read.
+	if err := os.Mkdir(filepath.Join(soundsDir, "broken.ogg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reads", func(t *testing.T) {
+		var board apiBoard
+		json.Unmarshal(a.call(t, "GET", "/board", "", 200, ""), &board)
+		if len(board.Slots) != soundboardSoundCount || board.Slots[0].Sound == nil || board.Slots[0].Sound.ID != noone || board.Slots[2].Sound != nil {
+			t.Errorf("board = %+v", board)
+		}
+		var sound apiBoardSound
+		json.Unmarshal(a.call(t, "GET", "/board/sounds/"+bruh, "", 200, ""), &sound)
+		if sound.Name != "bruh" || sound.Removable || sound.LibraryName != "bruh" {
+			t.Errorf("bruh = %+v", sound)
+		}
+		a.call(t, "GET", "/board/sounds/999", "", 404, apiErrorNotFound)
+
+		var library apiLibrary
+		json.Unmarshal(a.call(t, "GET", "/library", "", 200, ""), &library)
+		if len(library.Sounds) != 3 {
+			t.Errorf("library = %+v", library)
+		}
+		json.Unmarshal(a.call(t, "GET", "/library?q=air", "", 200, ""), &library)
+		if len(library.Sounds) != 1 || library.Sounds[0].Location != "airhorn.ogg" || library.Sounds[0].OnBoard {
+			t.Errorf("library?q=air = %+v", library)
+		}
+		a.call(t, "GET", "/clients", "", 200, "")
+
+		// the spec itself isn't in the spec.
+		resp, err := s.Client().Get(s.URL + "/api/v1/openapi.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !bytes.Equal(data, openAPIDocument) {
+			t.Errorf("expected openapi.json to be served as is, got %d", resp.StatusCode)
+		}
+		a.call(t, "GET", "/nothing", "", 404, apiErrorNotFound)
+		a.call(t, "GET", "/board/sounds/"+noone+"/nothing", "", 404, apiErrorNotFound)
+	})
+
+	t.Run("methods", func(t *testing.T) {
+		a.call(t, "PUT", "/board", "", 405, apiErrorMethodNotAllowed)
+		a.call(t, "GET", "/board/sounds", "", 405, apiErrorMethodNotAllowed)
+		a.call(t, "GET", "/board/sounds/"+noone+"/play", "", 405, apiErrorMethodNotAllowed)
+		a.call(t, "GET", "/board/sounds/"+noone+"/save", "", 405, apiErrorMethodNotAllowed)
+		a.call(t, "GET", "/board/swap", "", 405, apiErrorMethodNotAllowed)
+		a.call(t, "POST", "/library", "", 405, apiErrorMethodNotAllowed)
+		a.call(t, "DELETE", "/clients", "", 405, apiErrorMethodNotAllowed)
+
+		req, _ := http.NewRequest("PATCH", s.URL+"/api/v1/board/sounds/"+noone, nil)
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if allow := resp.Header.Get("Allow"); resp.StatusCode != 405 || allow != "GET, DELETE" {
+			t.Errorf("PATCH a board sound: expected 405 allowing GET and DELETE, got %d allowing %q", resp.StatusCode, allow)
+		}
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		for _, body := range []string{"", "not json", `{"location":"airhorn.ogg","slot":3}`, `{"location":"../airhorn.ogg"}`, `{"location":"/airhorn.ogg"}`} {
+			a.call(t, "POST", "/board/sounds", body, 400, apiErrorBadRequest)
+		}
+		a.call(t, "POST", "/board/sounds", `{"location":"missing.ogg"}`, 404, apiErrorNotFound)
+		a.call(t, "POST", "/board/sounds", `{"location":"broken.ogg"}`, 500, apiErrorInternal)
+
+		a.call(t, "POST", "/board/swap", `{"remove":"`+bruh+`"}`, 400, apiErrorBadRequest)
+		a.call(t, "POST", "/board/swap", `{"remove":"`+bruh+`","add":"../airhorn.ogg"}`, 400, apiErrorBadRequest)
+		a.call(t, "POST", "/board/swap", `{"remove":"999","add":"airhorn.ogg"}`, 404, apiErrorNotFound)
+		a.call(t, "POST", "/board/swap", `{"remove":"`+bruh+`","add":"missing.ogg"}`, 404, apiErrorNotFound)
+		a.call(t, "POST", "/board/swap", `{"remove":"`+bruh+`","add":"broken.ogg"}`, 500, apiErrorInternal)
+
+		a.call(t, "POST", "/board/sounds/999/play", "", 404, apiErrorNotFound)
+		a.call(t, "DELETE", "/board/sounds/999", "", 404, apiErrorNotFound)
+		a.call(t, "POST", "/board/sounds/999/save", "", 404, apiErrorNotFound)
+		a.call(t, "POST", "/board/sounds/"+bruh+"/save", `{"name":"a/b"}`, 400, apiErrorBadRequest)
+		a.call(t, "POST", "/board/sounds/"+bruh+"/save", `{"nmae":"typo"}`, 400, apiErrorBadRequest)
+
+		// nothing was taken off the board for any of it.
+		if s.boardSound(t, "bruh") != bruh || len(s.discord.sounds) != 2 {
+			t.Errorf("expected the board to be left as it was, got %+v", s.discord.sounds)
+		}
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		a.call(t, "POST", "/board/sounds/"+bruh+"/play", "", 204, "")
+		if len(s.discord.played) != 1 || s.discord.played[0] != bruh {
+			t.Errorf("played %v, want bruh", s.discord.played)
+		}
+
+		// NoOneHeard is saved already, so that's what comes back, whatever
+		// it's asked to be saved as.
+		for _, body := range []string{"", `{"name":"Something Else"}`} {
+			var saved apiLibrarySound
+			json.Unmarshal(a.call(t, "POST", "/board/sounds/"+noone+"/save", body, 201, ""), &saved)
+			if saved.Location != "memes/NoOneHeard.ogg" || !saved.OnBoard {
+				t.Errorf("saved %s as %+v", body, saved)
+			}
+		}
+
+		var added apiBoardSound
+		json.Unmarshal(a.call(t, "POST", "/board/sounds", `{"location":"airhorn.ogg"}`, 201, ""), &added)
+		if added.Name != "airhorn" || added.ID != s.boardSound(t, "airhorn") || !added.Removable {
+			t.Errorf("added %+v", added)
+		}
+		var swapped apiBoardSound
+		json.Unmarshal(a.call(t, "POST", "/board/swap", `{"remove":"`+added.ID+`","add":"airhorn.ogg"}`, 201, ""), &swapped)
+		if swapped.ID == added.ID || swapped.ID != s.boardSound(t, "airhorn") {
+			t.Errorf("swapped in %+v", swapped)
+		}
+		a.call(t, "DELETE", "/board/sounds/"+swapped.ID, "", 204, "")
+		if len(s.discord.sounds) != 2 {
+			t.Errorf("expected airhorn to be gone, got %+v", s.discord.sounds)
+		}
+		s.settle(t)
+	})
+
+	t.Run("discord down", func(t *testing.T) {
+		s.discord.fail(errors.New("HTTP 503 Service Unavailable"))
+		// a sound the server hasn't fetched yet can't be saved either.
+		s.discord.mu.Lock()
+		yeah := s.discord.add("yeah", testOtherUserID, testVorbisLasting(4*time.Second))
+		s.discord.mu.Unlock()
+		s.discord.sendSounds()
+
+		a.call(t, "POST", "/board/sounds", `{"location":"airhorn.ogg"}`, 502, apiErrorUpstream)
+		a.call(t, "POST", "/board/swap", `{"remove":"`+bruh+`","add":"airhorn.ogg"}`, 502, apiErrorUpstream)
+		a.call(t, "DELETE", "/board/sounds/"+noone, "", 502, apiErrorUpstream)
+		a.call(t, "POST", "/board/sounds/"+noone+"/play", "", 502, apiErrorUpstream)
+		a.call(t, "POST", "/board/sounds/"+yeah+"/save", "", 502, apiErrorUpstream)
+
+		s.discord.fail(nil)
+		var saved apiLibrarySound
+		json.Unmarshal(a.call(t, "POST", "/board/sounds/"+yeah+"/save", "", 201, ""), &saved)
+		if saved.Location != "yeah.ogg" || saved.Source != "discord" {
+			t.Errorf("saved yeah as %+v", saved)
+		}
+		s.settle(t)
+	})
+
+	t.Run("full board", func(t *testing.T) {
+		s.discord.mu.Lock()
+		for len(s.discord.sounds) < soundboardSoundCount {
+			s.discord.add("airhorn", testUserID, testLibrary["airhorn.ogg"])
+		}
+		s.discord.mu.Unlock()
+		s.discord.sendSounds()
+		s.settle(t)
+		a.call(t, "POST", "/board/sounds", `{"location":"airhorn.ogg"}`, 409, apiErrorConflict)
+	})
+
+	// every response the spec documents has come up.
+	for p, operations := range a.spec.Paths {
+		for method, rawOperation := range operations {
+			if method == "parameters" {
+				continue
+			}
+			var operation openAPIOperation
+			if err := json.Unmarshal(rawOperation, &operation); err != nil {
+				t.Fatal(err)
+			}
+			for status := range operation.Responses {
+				if key := strings.ToUpper(method) + " " + p + " " + status; !a.covers[key] {
+					t.Errorf("%s is documented but never came up", key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cdnCacheDir = ".cdn-cache" // under soundsDir, hidden so it isn't listed as sounds
+
+var (
+	// cdnBaseURL is where soundboard audio is fetched from, overridable to
+	// point at a stand-in.
+	cdnBaseURL   = "https://cdn.discordapp.com"
+	cdnCacheSize = int64(100 << 20)
+	cdnClient    = &http.Client{Timeout: 30 * time.Second}
+)
+
+type cdnCacheEntry struct {
+	soundID string
+	size    int64
+}
+
+// soundboardCDNCache keeps soundboard sounds fetched from the CDN on disk,
+// dropping the least recently used once they add up to more than maxSize. A
+// sound ID's audio never changes, so entries never go stale.
+type soundboardCDNCache struct {
+	dir     string
+	baseURL string
+	client  *http.Client
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+// newSoundboardCDNCache loads whatever is already cached in dir, oldest
+// modification time first, since file modification times double as last use.
+func newSoundboardCDNCache(dir, baseURL string, client *http.Client, maxSize int64) (*soundboardCDNCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("[error] creating cdn cache: %v", err)
+	}
+	c := &soundboardCDNCache{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("[error] reading cdn cache: %v", err)
+	}
+	infos := make([]os.FileInfo, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !validSnowflake(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	c.mu.Lock()
+	for _, info := range infos {
+		c.entries[info.Name()] = c.order.PushFront(&cdnCacheEntry{soundID: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// validSnowflake checks id is a Discord snowflake, so it's safe as a file name
+// and in a url.
+func validSnowflake(id string) bool {
+	if id == "" || len(id) > 20 {
+		return false
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the sound's audio, from disk if we have it and from the CDN
+// otherwise.
+func (c *soundboardCDNCache) Get(soundID string) ([]byte, error) {
+	if !validSnowflake(soundID) {
+		return nil, fmt.Errorf("[error] invalid sound id %q", soundID)
+	}
+	p := filepath.Join(c.dir, soundID)
+
+	c.mu.Lock()
+	el, ok := c.entries[soundID]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if ok {
+		data, err := os.ReadFile(p)
+		if err == nil {
+			now := time.Now()
+			os.Chtimes(p, now, now)
+			return data, nil
+		}
+		// someone cleared the cache under us, fall through and refetch.
+		c.remove(soundID)
+	}
+
+	data, err := c.fetch(soundID)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.store(soundID, data); err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] couldn't cache sound %s: %v\n", soundID, err)
+	}
+	return data, nil
+}
+
+func (c *soundboardCDNCache) fetch(soundID string) ([]byte, error) {
+	resp, err := c.client.Get(c.baseURL + "/soundboard-sounds/" + soundID)
+	if err != nil {
+		return nil, fmt.Errorf("[error] fetching sound %s: %v", soundID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[error] fetching sound %s: invalid status code %v", soundID, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUploadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("[error] reading sound %s: %v", soundID, err)
+	}
+	if len(data) > maxUploadSize {
+		return nil, fmt.Errorf("[error] sound %s is bigger than %d bytes", soundID, maxUploadSize)
+	}
+	return data, nil
+}
+
+func (c *soundboardCDNCache) store(soundID string, data []byte) error {
+	p := filepath.Join(c.dir, soundID)
+	tmp, err := os.CreateTemp(c.dir, ".tmp-"+soundID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[soundID]; ok {
+		// fetched twice at once, keep the one entry.
+		c.size -= el.Value.(*cdnCacheEntry).size
+		c.order.Remove(el)
+	}
+	c.entries[soundID] = c.order.PushFront(&cdnCacheEntry{soundID: soundID, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+func (c *soundboardCDNCache) remove(soundID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[soundID]; ok {
+		c.size -= el.Value.(*cdnCacheEntry).size
+		c.order.Remove(el)
+		delete(c.entries, soundID)
+	}
+}
+
+// evict drops least recently used entries until the cache fits, always
+// keeping the newest one. c.mu must be held.
+func (c *soundboardCDNCache) evict() {
+	for c.size > c.maxSize && c.order.Len() > 1 {
+		el := c.order.Back()
+		entry := el.Value.(*cdnCacheEntry)
+		if err := os.Remove(filepath.Join(c.dir, entry.soundID)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[warn] evicting cached sound %s: %v\n", entry.soundID, err)
+		}
+		c.size -= entry.size
+		c.order.Remove(el)
+		delete(c.entries, entry.soundID)
+	}
+}
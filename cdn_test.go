@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCDN serves every sound as 10 bytes of its ID's first digit, counting
+// fetches by sound ID.
+type fakeCDN struct {
+	*httptest.Server
+	fetches map[string]int
+}
+
+func newFakeCDN(t *testing.T) *fakeCDN {
+	cdn := &fakeCDN{fetches: make(map[string]int)}
+	cdn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		soundID := strings.TrimPrefix(r.URL.Path, "/soundboard-sounds/")
+		if soundID == "404" {
+			http.NotFound(w, r)
+			return
+		}
+		cdn.fetches[soundID]++
+		w.Write(cdnTestSound(soundID))
+	}))
+	t.Cleanup(cdn.Close)
+	return cdn
+}
+
+func cdnTestSound(soundID string) []byte {
+	return bytes.Repeat([]byte{soundID[0]}, 10)
+}
+
+func TestSoundboardCDNCache(t *testing.T) {
+	cdn := newFakeCDN(t)
+	dir := t.TempDir()
+	// room for two sounds.
+	c, err := newSoundboardCDNCache(dir, cdn.URL, cdn.Client(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(soundID string) {
+		t.Helper()
+		data, err := c.Get(soundID)
+		if err != nil || !bytes.Equal(data, cdnTestSound(soundID)) {
+			t.Fatalf("expected %s's audio, got %q, %v", soundID, data, err)
+		}
+	}
+	expectFetches := func(soundID string, want int) {
+		t.Helper()
+		if cdn.fetches[soundID] != want {
+			t.Errorf("expected %s to be fetched %d times, got %d", soundID, want, cdn.fetches[soundID])
+		}
+	}
+	expectOnDisk := func(soundID string, want bool) {
+		t.Helper()
+		_, err := os.Stat(filepath.Join(dir, soundID))
+		if onDisk := err == nil; onDisk != want {
+			t.Errorf("expected %s on disk to be %v, got %v", soundID, want, onDisk)
+		}
+	}
+
+	// a miss is fetched and stored.
+	get("1")
+	expectFetches("1", 1)
+	expectOnDisk("1", true)
+
+	// a hit comes from disk.
+	get("1")
+	expectFetches("1", 1)
+
+	// the third sound doesn't fit, the least recently used goes.
+	get("2")
+	get("1")
+	get("3")
+	expectOnDisk("1", true)
+	expectOnDisk("2", false)
+	expectOnDisk("3", true)
+	if c.size != 20 || c.order.Len() != 2 {
+		t.Errorf("expected two sounds in 20 bytes, got %d in %d", c.order.Len(), c.size)
+	}
+	get("2")
+	expectFetches("2", 2)
+
+	if _, err := c.Get("404"); err == nil {
+		t.Errorf("expected a sound the CDN hasn't got to fail")
+	}
+	if _, err := c.Get("../1"); err == nil {
+		t.Errorf("expected an invalid sound ID to be refused")
+	}
+}
+
+func TestSoundboardCDNCacheReload(t *testing.T) {
+	cdn := newFakeCDN(t)
+	dir := t.TempDir()
+	// already cached by an earlier run, 1 used longest ago.
+	for i, soundID := range []string{"1", "2", "3"} {
+		p := filepath.Join(dir, soundID)
+		if err := os.WriteFile(p, cdnTestSound(soundID), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(p, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newSoundboardCDNCache(dir, cdn.URL, cdn.Client(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1")); !os.IsNotExist(err) {
+		t.Errorf("expected the least recently used sound to be evicted on load, got %v", err)
+	}
+	for _, soundID := range []string{"2", "3"} {
+		if _, err := c.Get(soundID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cdn.fetches) != 0 {
+		t.Errorf("expected cached sounds to come from disk, got fetches %v", cdn.fetches)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lgordon2/discord-soundboard/client"
+	"github.com/segmentio/encoding/json"
+)
+
+// cliCommands are the subcommands that run as a one-off client instead of
+// starting the server.
+var cliCommands = map[string]bool{
+	"play":    true,
+	"board":   true,
+	"library": true,
+	"swap":    true,
+	"save":    true,
+	"preset":  true,
+	"tui":     true,
+}
+
+const cliUsage = `usage: discord-soundboard <command> [flags] [args]
+
+commands:
+  play <name|slot>             play a board sound
+  board                        show the board
+  library ls                   list the library
+  library search <query>       search the library
+  swap <name|slot> <sound>     replace a board sound with a library sound
+  save <name|slot> [as]        save a board sound to the library
+  preset ls                    list presets
+  preset apply <name>          put a preset's sounds on the board
+  tui                          full-screen board in the terminal
+
+flags:
+`
+
+// boardBackend is what the CLI drives, either a running server through its
+// API or Discord itself.
+type boardBackend interface {
+	Board(ctx context.Context) (client.Board, error)
+	Library(ctx context.Context, query string) ([]client.LibrarySound, error)
+	Play(ctx context.Context, soundID string) error
+	Add(ctx context.Context, location string) (client.BoardSound, error)
+	Remove(ctx context.Context, soundID string) error
+	Swap(ctx context.Context, removeID, location string) (client.BoardSound, error)
+	Save(ctx context.Context, soundID, name string) (client.LibrarySound, error)
+}
+
+// runCLI runs the subcommand in args[0], with its flags and arguments after it.
+func runCLI(args []string, stdout io.Writer) error {
+	command := args[0]
+	flags := flag.NewFlagSet("discord-soundboard "+command, flag.ContinueOnError)
+	defaultServer := os.Getenv("SOUNDBOARD_URL")
+	if defaultServer == "" {
+		defaultServer = "http://localhost:3000"
+	}
+	server := flags.String("server", defaultServer, "soundboard server to talk to, defaults to $SOUNDBOARD_URL")
+	direct := flags.Bool("direct", false, "talk to Discord directly with AUTH_TOKEN and SOUNDS_DIR instead of a server")
+	presetsFile := flags.String("presets", filepath.Join(soundsDir, presetsFileName), "presets file")
+	timeout := flags.Duration("timeout", 30*time.Second, "give up after this long")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), cliUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	if command == "tui" {
+		// the tui needs the server's websocket to stay live.
+		if *direct || len(args) != 0 {
+			flags.Usage()
+			return fmt.Errorf("[error] tui takes no arguments and can't be used with -direct")
+		}
+		c, err := client.New(*server)
+		if err != nil {
+			return err
+		}
+		return runTUI(c)
+	}
+
+	var backend boardBackend
+	if *direct {
+		backend = &discordBackend{discord: NewDiscordRestClient(authToken, "")}
+	} else {
+		c, err := client.New(*server)
+		if err != nil {
+			return err
+		}
+		backend = c
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch {
+	case command == "board" && len(args) == 0:
+		board, err := backend.Board(ctx)
+		if err != nil {
+			return err
+		}
+		printBoard(stdout, board)
+	case command == "play" && len(args) == 1:
+		sound, err := resolveBoardSound(ctx, backend, args[0])
+		if err != nil {
+			return err
+		}
+		return backend.Play(ctx, sound.ID)
+	case command == "library" && len(args) == 1 && args[0] == "ls",
+		command == "library" && len(args) == 2 && args[0] == "search":
+		query := ""
+		if len(args) == 2 {
+			query = args[1]
+		}
+		sounds, err := backend.Library(ctx, query)
+		if err != nil {
+			return err
+		}
+		printLibrary(stdout, sounds)
+	case command == "swap" && len(args) == 2:
+		old, err := resolveBoardSound(ctx, backend, args[0])
+		if err != nil {
+			return err
+		}
+		location, err := resolveLibrarySound(ctx, backend, args[1])
+		if err != nil {
+			return err
+		}
+		added, err := backend.Swap(ctx, old.ID, location)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "swapped %s for %s\n", old.Name, added.Name)
+	case command == "save" && (len(args) == 1 || len(args) == 2):
+		sound, err := resolveBoardSound(ctx, backend, args[0])
+		if err != nil {
+			return err
+		}
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		saved, err := backend.Save(ctx, sound.ID, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "saved %s as %s\n", sound.Name, saved.Location)
+	case command == "preset" && len(args) == 1 && args[0] == "ls":
+		presets, err := loadPresets(*presetsFile)
+		if err != nil {
+			return err
+		}
+		for _, name := range presets.Names() {
+			fmt.Fprintf(stdout, "%s\t%s\n", name, strings.Join(presets[name], ", "))
+		}
+	case command == "preset" && len(args) == 2 && args[0] == "apply":
+		presets, err := loadPresets(*presetsFile)
+		if err != nil {
+			return err
+		}
+		preset, ok := presets[args[1]]
+		if !ok {
+			return fmt.Errorf("[error] no preset %q in %s", args[1], *presetsFile)
+		}
+		return applyPreset(ctx, backend, preset, stdout)
+	default:
+		flags.Usage()
+		return fmt.Errorf("[error] unknown command %q", strings.Join(append([]string{command}, args...), " "))
+	}
+	return nil
+}
+
+func printBoard(w io.Writer, board client.Board) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLOT\tNAME\tID\tUPLOADER\tLIBRARY")
+	for _, slot := range board.Slots {
+		if slot.Sound == nil {
+			fmt.Fprintf(tw, "%d\t(free)\t\t\t\n", slot.Slot)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", slot.Slot, slot.Sound.Name, slot.Sound.ID, slot.Sound.Uploader, slot.Sound.LibraryName)
+	}
+	tw.Flush()
+}
+
+func printLibrary(w io.Writer, sounds []client.LibrarySound) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOCATION\tDURATION\tBOARD\tWARNING")
+	for _, sound := range sounds {
+		onBoard := ""
+		if sound.OnBoard {
+			onBoard = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%.2fs\t%s\t%s\n", sound.Location, sound.Duration, onBoard, sound.Warning)
+	}
+	tw.Flush()
+}
+
+// resolveBoardSound finds a board sound by slot number or name.
+func resolveBoardSound(ctx context.Context, backend boardBackend, arg string) (client.BoardSound, error) {
+	board, err := backend.Board(ctx)
+	if err != nil {
+		return client.BoardSound{}, err
+	}
+	if slot, err := strconv.Atoi(arg); err == nil && slot >= 0 && slot < len(board.Slots) {
+		if board.Slots[slot].Sound == nil {
+			return client.BoardSound{}, fmt.Errorf("[error] slot %d is free", slot)
+		}
+		return *board.Slots[slot].Sound, nil
+	}
+	if sound, ok := board.Sound(arg); ok {
+		return sound, nil
+	}
+	return client.BoardSound{}, fmt.Errorf("[error] %q isn't on the board", arg)
+}
+
+// resolveLibrarySound finds a library sound by location or name and returns
+// its location.
+func resolveLibrarySound(ctx context.Context, backend boardBackend, arg string) (string, error) {
+	sounds, err := backend.Library(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	for _, sound := range sounds {
+		if sound.Location == arg {
+			return sound.Location, nil
+		}
+	}
+	for _, sound := range sounds {
+		if sound.Name == arg {
+			return sound.Location, nil
+		}
+	}
+
+	sounds, err = backend.Library(ctx, arg)
+	if err != nil {
+		return "", err
+	}
+	if len(sounds) == 0 {
+		return "", fmt.Errorf("[error] no library sound matches %q", arg)
+	}
+	suggestions := []string{}
+	for _, sound := range sounds[:min(3, len(sounds))] {
+		suggestions = append(suggestions, sound.Location)
+	}
+	return "", fmt.Errorf("[error] no library sound called %q, did you mean %s?", arg, strings.Join(suggestions, ", "))
+}
+
+const presetsFileName = ".presets.json"
+
+// presets map a name to the library locations that should be on the board,
+// e.g. {"movie night": ["memes/NoOneHeard.ogg", "Bruh.mp3"]}.
+type presets map[string][]string
+
+func loadPresets(file string) (presets, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("[error] reading presets: %v", err)
+	}
+	var p presets
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("[error] parsing presets %s: %v", file, err)
+	}
+	return p, nil
+}
+
+func (p presets) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset makes the board hold the preset's sounds, taking off whichever
+// of our sounds aren't in it. Sounds other people uploaded are left alone, so
+// a preset that doesn't fit around them is refused up front.
+func applyPreset(ctx context.Context, backend boardBackend, preset []string, stdout io.Writer) error {
+	board, err := backend.Board(ctx)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(preset))
+	for _, location := range preset {
+		wanted[path.Base(strings.TrimSuffix(location, path.Ext(location)))] = true
+	}
+
+	onBoard := make(map[string]bool)
+	toRemove := []client.BoardSound{}
+	free := 0
+	for _, slot := range board.Slots {
+		switch {
+		case slot.Sound == nil:
+			free++
+		case wanted[slot.Sound.Name]:
+			onBoard[slot.Sound.Name] = true
+		case slot.Sound.Removable:
+			toRemove = append(toRemove, *slot.Sound)
+		}
+	}
+	toAdd := []string{}
+	for _, location := range preset {
+		if !onBoard[path.Base(strings.TrimSuffix(location, path.Ext(location)))] {
+			toAdd = append(toAdd, location)
+		}
+	}
+	if len(toAdd) > free+len(toRemove) {
+		return fmt.Errorf("[error] the preset needs %d free slots but only %d can be freed", len(toAdd), free+len(toRemove))
+	}
+
+	for _, sound := range toRemove {
+		if err := backend.Remove(ctx, sound.ID); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "removed %s\n", sound.Name)
+	}
+	for _, location := range toAdd {
+		if _, err := backend.Add(ctx, location); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "added %s\n", location)
+	}
+	return nil
+}
+
+// discordBackend skips the server and works on Discord and SOUNDS_DIR
+// directly, for scripting without a server running.
+type discordBackend struct {
+	discord *DiscordRestClient
+}
+
+func (b *discordBackend) Board(ctx context.Context) (client.Board, error) {
+	items, err := b.discord.ListSoundboardSounds(guildID)
+	if err != nil {
+		return client.Board{}, err
+	}
+	board := client.Board{Slots: make([]client.BoardSlot, soundboardSoundCount)}
+	for i := range board.Slots {
+		board.Slots[i].Slot = i
+		if i < len(items) {
+			board.Slots[i].Sound = &client.BoardSound{
+				ID:        items[i].SoundID,
+				Name:      items[i].Name,
+				UserID:    items[i].UserID,
+				AudioURL:  cdnBaseURL + "/soundboard-sounds/" + items[i].SoundID,
+				Removable: items[i].UserID == b.discord.userID,
+			}
+		}
+	}
+	return board, nil
+}
+
+// requireSoundsDir is checked before -direct goes near the library, it has no
+// server to ask and nowhere to look without SOUNDS_DIR.
+func requireSoundsDir() error {
+	if soundsDir == "" {
+		return fmt.Errorf("[error] SOUNDS_DIR isn't set, -direct needs it for the library")
+	}
+	return nil
+}
+
+func (b *discordBackend) Library(ctx context.Context, query string) ([]client.LibrarySound, error) {
+	if err := requireSoundsDir(); err != nil {
+		return nil, err
+	}
+	storedSounds, storedSoundMap, err := fetchStoredSounds()
+	if err != nil {
+		return nil, err
+	}
+	if query != "" {
+		metadata, err := loadSoundMetadata(soundsDir)
+		if err != nil {
+			return nil, err
+		}
+		var index soundSearchIndex
+		index.Rebuild(storedSounds, metadata)
+		storedSounds = index.Search(query)
+	}
+	board, err := b.Board(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sounds := make([]client.LibrarySound, 0, len(storedSounds))
+	for _, location := range storedSounds {
+		ext := path.Ext(location)
+		name := path.Base(strings.TrimSuffix(location, ext))
+		_, onBoard := board.Sound(name)
+		sound := client.LibrarySound{
+			Name:     name,
+			Location: location,
+			Format:   strings.TrimPrefix(ext, "."),
+			Size:     len(storedSoundMap[name]),
+			OnBoard:  onBoard,
+		}
+		if probe, err := probeSound(storedSoundMap[name]); err == nil {
+			sound.Duration = probe.Duration.Seconds()
+			sound.Warning = probe.LimitWarning()
+		}
+		sounds = append(sounds, sound)
+	}
+	return sounds, nil
+}
+
+func (b *discordBackend) Play(ctx context.Context, soundID string) error {
+	return b.discord.SendSoundboardSound(guildID, channelID, soundID)
+}
+
+func (b *discordBackend) Add(ctx context.Context, location string) (client.BoardSound, error) {
+	sound, err := b.prepare(location)
+	if err != nil {
+		return client.BoardSound{}, err
+	}
+	return b.upload(sound)
+}
+
+func (b *discordBackend) Remove(ctx context.Context, soundID string) error {
+	return deleteSound(b.discord, guildID, deleteSoundInput{SoundID: soundID})
+}
+
+// Swap gets location ready before taking removeID off, like the server does,
+// so a sound Discord won't take doesn't cost the slot.
+func (b *discordBackend) Swap(ctx context.Context, removeID, location string) (client.BoardSound, error) {
+	sound, err := b.prepare(location)
+	if err != nil {
+		return client.BoardSound{}, err
+	}
+	if err := b.Remove(ctx, removeID); err != nil {
+		return client.BoardSound{}, err
+	}
+	return b.upload(sound)
+}
+
+func (b *discordBackend) prepare(location string) (preparedSound, error) {
+	if err := requireSoundsDir(); err != nil {
+		return preparedSound{}, err
+	}
+	_, storedSoundMap, err := fetchStoredSounds()
+	if err != nil {
+		return preparedSound{}, err
+	}
+	metadata, err := loadSoundMetadata(soundsDir)
+	if err != nil {
+		return preparedSound{}, err
+	}
+	return prepareSound(storedSoundMap, metadata, addSoundInput{SoundLocation: location})
+}
+
+func (b *discordBackend) upload(sound preparedSound) (client.BoardSound, error) {
+	created, err := uploadSound(b.discord, sound)
+	if err != nil {
+		return client.BoardSound{}, err
+	}
+	return client.BoardSound{ID: created.SoundID, Name: created.Name, UserID: b.discord.userID, Removable: true}, nil
+}
+
+// Save is a cut down saveSoundFunc: it stores the sound but leaves
+// fingerprinting and loudness for the server to catch up on.
+func (b *discordBackend) Save(ctx context.Context, soundID, name string) (client.LibrarySound, error) {
+	if err := requireSoundsDir(); err != nil {
+		return client.LibrarySound{}, err
+	}
+	board, err := b.Board(ctx)
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+	uploaderID := ""
+	for _, slot := range board.Slots {
+		if slot.Sound != nil && slot.Sound.ID == soundID {
+			uploaderID = slot.Sound.UserID
+			if name == "" {
+				name = slot.Sound.Name
+			}
+		}
+	}
+	if err := validateSoundName(name); err != nil {
+		return client.LibrarySound{}, err
+	}
+
+	cache, err := newSoundboardCDNCache(filepath.Join(soundsDir, cdnCacheDir), cdnBaseURL, cdnClient, cdnCacheSize)
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+	data, err := cache.Get(soundID)
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+	format, err := detectSoundFormat(data)
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+	sourceHash := soundHash(data)
+	ext := format.Ext
+	if transcoded, transcodedExt, err := transcoder.Transcode(data, ext); err == nil {
+		data, ext = transcoded, transcodedExt
+	}
+
+	_, storedSoundMap, err := fetchStoredSounds()
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+	metadata, err := loadSoundMetadata(soundsDir)
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+	location, err := saveUploadedSound(uploadInput{
+		Name:       name,
+		Slot:       -1,
+		Ext:        ext,
+		Data:       data,
+		SourceHash: sourceHash,
+	}, storedSoundMap, hashStoredSounds(storedSoundMap, metadata))
+	if err != nil {
+		return client.LibrarySound{}, err
+	}
+
+	savedName := path.Base(strings.TrimSuffix(location, ext))
+	md := metadata.Get(savedName)
+	md.Source = "discord"
+	md.SourceHash = sourceHash
+	md.UploaderID = uploaderID
+	md.SavedAt = time.Now()
+	if err := metadata.Set(savedName, md); err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] could not save metadata for %s: %v\n", savedName, err)
+	}
+	return client.LibrarySound{Name: savedName, Location: location, Format: strings.TrimPrefix(ext, "."), Size: len(data)}, nil
+}
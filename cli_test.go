@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiscordBackendWithoutSoundsDir(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = ""
+	defer func() { soundsDir = oldSoundsDir }()
+
+	// none of these should get as far as Discord.
+	b := &discordBackend{}
+	ctx := context.Background()
+	if _, err := b.Library(ctx, ""); err == nil {
+		t.Errorf("expected listing the library to fail")
+	}
+	if _, err := b.Add(ctx, "airhorn.ogg"); err == nil {
+		t.Errorf("expected adding a sound to fail")
+	}
+	if _, err := b.Swap(ctx, "1", "airhorn.ogg"); err == nil {
+		t.Errorf("expected swapping a sound to fail")
+	}
+	if _, err := b.Save(ctx, "1", "airhorn"); err == nil {
+		t.Errorf("expected saving a sound to fail")
+	}
+}
@@ -0,0 +1,251 @@
+// Package client talks to a soundboard server over its /api/v1 JSON API and
+// websocket, for bots and scripts that want to play or manage sounds.
+//
+//	c, err := client.New("http://localhost:3000")
+//	if err != nil {
+//		return err
+//	}
+//	err = c.PlayByName(ctx, "NoOneHeard")
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// Client is safe for concurrent use.
+type Client struct {
+	baseURL *url.URL
+	// HTTPClient makes the API requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, e.g. http://localhost:3000.
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid base url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: base url %q must be http or https", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Client{baseURL: u}, nil
+}
+
+type BoardSound struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	UserID      string `json:"userID"`
+	Uploader    string `json:"uploader,omitempty"`
+	AvatarURL   string `json:"avatarURL"`
+	AudioURL    string `json:"audioURL"`
+	LibraryName string `json:"libraryName,omitempty"`
+	Removable   bool   `json:"removable"`
+}
+
+type BoardSlot struct {
+	Slot  int         `json:"slot"`
+	Sound *BoardSound `json:"sound"` // nil when the slot is free
+}
+
+type Board struct {
+	Slots            []BoardSlot `json:"slots"`
+	UserInChannel    bool        `json:"userInChannel"`
+	GatewayConnected bool        `json:"gatewayConnected"`
+}
+
+// Sound returns the board sound called name, if there is one.
+func (b Board) Sound(name string) (BoardSound, bool) {
+	for _, slot := range b.Slots {
+		if slot.Sound != nil && slot.Sound.Name == name {
+			return *slot.Sound, true
+		}
+	}
+	return BoardSound{}, false
+}
+
+type LibrarySound struct {
+	Name        string     `json:"name"`
+	Location    string     `json:"location"`
+	Folder      string     `json:"folder,omitempty"`
+	Format      string     `json:"format"`
+	Duration    float64    `json:"durationSeconds,omitempty"`
+	Size        int        `json:"size"`
+	OnBoard     bool       `json:"onBoard"`
+	Warning     string     `json:"warning,omitempty"`
+	DuplicateOf string     `json:"duplicateOf,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Uploader    string     `json:"uploader,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	SavedAt     *time.Time `json:"savedAt,omitempty"`
+	AudioURL    string     `json:"audioURL"`
+	WaveformURL string     `json:"waveformURL"`
+}
+
+// Error is what the server answers with when a request fails. Code is one of
+// the codes in its OpenAPI document, e.g. "not_found".
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("soundboard: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// IsNotFound reports whether err is the server saying a sound doesn't exist.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == "not_found"
+}
+
+// ErrNotOnBoard is returned by PlayByName when no board sound has the name.
+var ErrNotOnBoard = errors.New("soundboard: no board sound with that name")
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) url(p string, query url.Values) string {
+	u := *c.baseURL
+	u.Path += "/api/v1" + p
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// do sends a request to the API and decodes the response into out, which may
+// be nil for responses without a body.
+func (c *Client) do(ctx context.Context, method, p string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(p, query), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var errResp struct {
+			Error *Error `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return &Error{StatusCode: resp.StatusCode, Code: "unknown", Message: resp.Status}
+		}
+		errResp.Error.StatusCode = resp.StatusCode
+		return errResp.Error
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("soundboard: decoding %s %s: %v", method, p, err)
+	}
+	return nil
+}
+
+// Board returns every slot on the board, free ones included.
+func (c *Client) Board(ctx context.Context) (Board, error) {
+	var board Board
+	err := c.do(ctx, http.MethodGet, "/board", nil, nil, &board)
+	return board, err
+}
+
+func (c *Client) BoardSound(ctx context.Context, soundID string) (BoardSound, error) {
+	var sound BoardSound
+	err := c.do(ctx, http.MethodGet, "/board/sounds/"+url.PathEscape(soundID), nil, nil, &sound)
+	return sound, err
+}
+
+// Library lists library sounds. A non-empty query fuzzy searches names, tags
+// and uploaders, best matches first.
+func (c *Client) Library(ctx context.Context, query string) ([]LibrarySound, error) {
+	var q url.Values
+	if query != "" {
+		q = url.Values{"q": {query}}
+	}
+	var library struct {
+		Sounds []LibrarySound `json:"sounds"`
+	}
+	err := c.do(ctx, http.MethodGet, "/library", q, nil, &library)
+	return library.Sounds, err
+}
+
+// Play plays a board sound in the voice channel.
+func (c *Client) Play(ctx context.Context, soundID string) error {
+	return c.do(ctx, http.MethodPost, "/board/sounds/"+url.PathEscape(soundID)+"/play", nil, nil, nil)
+}
+
+// PlayByName plays the board sound called name, returning ErrNotOnBoard if
+// there isn't one.
+func (c *Client) PlayByName(ctx context.Context, name string) error {
+	board, err := c.Board(ctx)
+	if err != nil {
+		return err
+	}
+	sound, ok := board.Sound(name)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNotOnBoard, name)
+	}
+	return c.Play(ctx, sound.ID)
+}
+
+// Add puts the library sound at location, e.g. "memes/NoOneHeard.ogg", on the
+// board.
+func (c *Client) Add(ctx context.Context, location string) (BoardSound, error) {
+	var sound BoardSound
+	err := c.do(ctx, http.MethodPost, "/board/sounds", nil, map[string]string{"location": location}, &sound)
+	return sound, err
+}
+
+// Remove takes a sound off the board.
+func (c *Client) Remove(ctx context.Context, soundID string) error {
+	return c.do(ctx, http.MethodDelete, "/board/sounds/"+url.PathEscape(soundID), nil, nil, nil)
+}
+
+// Swap replaces the board sound removeID with the library sound at location.
+func (c *Client) Swap(ctx context.Context, removeID, location string) (BoardSound, error) {
+	var sound BoardSound
+	err := c.do(ctx, http.MethodPost, "/board/swap", nil, map[string]string{"remove": removeID, "add": location}, &sound)
+	return sound, err
+}
+
+// Save saves a board sound to the library, as name if it's not empty. If the
+// library already has it the existing sound is returned.
+func (c *Client) Save(ctx context.Context, soundID, name string) (LibrarySound, error) {
+	var in any
+	if name != "" {
+		in = map[string]string{"name": name}
+	}
+	var sound LibrarySound
+	err := c.do(ctx, http.MethodPost, "/board/sounds/"+url.PathEscape(soundID)+"/save", nil, in, &sound)
+	return sound, err
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/encoding/json"
+)
+
+// Protocol is the websocket subprotocol Subscribe asks the server for, and
+// ProtocolVersion the event version it understands.
+const (
+	Protocol        = "soundboard.json.v1"
+	ProtocolVersion = 1
+)
+
+type EventType string
+
+const (
+	// EventBoard means the board changed. Slots holds the slots that changed
+	// and Board the whole board as it is now.
+	EventBoard EventType = "board_updated"
+	// EventPlay means someone played SoundID.
+	EventPlay EventType = "sound_played"
+	// EventLibrary means sounds were added to or removed from the library.
+	EventLibrary EventType = "library_changed"
+	// EventClients means someone opened or closed the page. Clients is how
+	// many are connected.
+	EventClients EventType = "user_count"
+	// EventGateway means the server connected to or lost Discord's gateway,
+	// or joined or left the voice channel.
+	EventGateway EventType = "gateway_status"
+)
+
+type Event struct {
+	Type    EventType
+	Version int
+	// StateVersion is the version of the board after the event.
+	StateVersion uint64
+	Board        *Board
+	Slots        []BoardSlot
+	SoundID      string
+	Clients      int
+	// GatewayConnected and UserInChannel are set for EventGateway.
+	GatewayConnected bool
+	UserInChannel    bool
+}
+
+// wireEvent is an event as the server sends it.
+type wireEvent struct {
+	Version      int             `json:"version"`
+	StateVersion uint64          `json:"stateVersion"`
+	Prev         uint64          `json:"prev"`
+	Type         EventType       `json:"type"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// eventSnapshot is the whole board, what the server starts every connection
+// with. It's sent on as an EventBoard.
+const eventSnapshot EventType = "snapshot"
+
+// Subscribe connects to the server's websocket and sends an event for every
+// change until ctx is done or the connection drops, then closes the channel.
+// The server starts with the whole board and sends what changes after, so
+// every EventBoard carries the board as it is now without asking the API.
+// If an update goes missing the server is asked for the whole board again.
+func (c *Client) Subscribe(ctx context.Context) (<-chan Event, error) {
+	u := *c.baseURL
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path += "/ws"
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{Protocol}
+	conn, resp, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != Protocol {
+		conn.Close()
+		return nil, fmt.Errorf("soundboard: server doesn't speak %s", Protocol)
+	}
+
+	events := make(chan Event, 16)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		defer close(events)
+		s := &subscription{}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			event, ok, inSequence := s.apply(msg)
+			if !inSequence && !s.awaitingSnapshot {
+				s.awaitingSnapshot = true
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"snapshot_request"}`)); err != nil {
+					return
+				}
+			}
+			if !ok {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// subscription is the board as a Subscribe call has been told it is.
+type subscription struct {
+	board            Board
+	version          uint64
+	awaitingSnapshot bool
+}
+
+// apply decodes one of the server's events and applies it to the board.
+// ok is false for events to skip, ones this client doesn't know or that came
+// while waiting for a snapshot. inSequence is false when the event didn't
+// follow on from the last one and the board needs starting over.
+func (s *subscription) apply(msg []byte) (event Event, ok, inSequence bool) {
+	var wire wireEvent
+	if err := json.Unmarshal(msg, &wire); err != nil || wire.Version > ProtocolVersion {
+		return Event{}, false, true
+	}
+	if wire.Prev != 0 && (s.awaitingSnapshot || wire.Prev != s.version) {
+		return Event{}, false, false
+	}
+	s.version = wire.StateVersion
+	s.awaitingSnapshot = false
+
+	event = Event{Type: wire.Type, Version: wire.Version, StateVersion: wire.StateVersion}
+	switch wire.Type {
+	case eventSnapshot:
+		var board Board
+		if err := json.Unmarshal(wire.Data, &board); err != nil {
+			return Event{}, false, true
+		}
+		s.board = board
+		event.Type, event.Slots = EventBoard, board.Slots
+	case EventBoard:
+		var data struct {
+			Slots []BoardSlot `json:"slots"`
+		}
+		if err := json.Unmarshal(wire.Data, &data); err != nil {
+			return Event{}, false, true
+		}
+		slots := append([]BoardSlot{}, s.board.Slots...)
+		for _, slot := range data.Slots {
+			if slot.Slot >= 0 && slot.Slot < len(slots) {
+				slots[slot.Slot] = slot
+			}
+		}
+		s.board.Slots = slots
+		event.Slots = data.Slots
+	case EventPlay:
+		var data struct {
+			SoundID string `json:"soundID"`
+		}
+		if err := json.Unmarshal(wire.Data, &data); err != nil {
+			return Event{}, false, true
+		}
+		event.SoundID = data.SoundID
+	case EventClients:
+		var data struct {
+			Count int `json:"count"`
+		}
+		if err := json.Unmarshal(wire.Data, &data); err != nil {
+			return Event{}, false, true
+		}
+		event.Clients = data.Count
+	case EventGateway:
+		var data struct {
+			GatewayConnected bool `json:"gatewayConnected"`
+			UserInChannel    bool `json:"userInChannel"`
+		}
+		if err := json.Unmarshal(wire.Data, &data); err != nil {
+			return Event{}, false, true
+		}
+		s.board.GatewayConnected, s.board.UserInChannel = data.GatewayConnected, data.UserInChannel
+		event.GatewayConnected, event.UserInChannel = data.GatewayConnected, data.UserInChannel
+	case EventLibrary:
+	default:
+		return Event{}, false, true
+	}
+	if event.Type == EventBoard {
+		board := s.board
+		event.Board = &board
+	}
+	return event, true, true
+}
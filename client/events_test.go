@@ -0,0 +1,67 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// The API and Subscribe are tested against the real server, in the server's
+// package. This is what the server can't be made to do, send a gap.
+
+func wsEvent(stateVersion, prev uint64, eventType EventType, data string) []byte {
+	msg, _ := json.Marshal(map[string]any{
+		"version":      ProtocolVersion,
+		"stateVersion": stateVersion,
+		"prev":         prev,
+		"type":         eventType,
+		"data":         json.RawMessage(data),
+	})
+	return msg
+}
+
+func TestSubscriptionApply(t *testing.T) {
+	s := &subscription{}
+	apply := func(msg []byte, wantOK, wantInSequence bool) Event {
+		t.Helper()
+		event, ok, inSequence := s.apply(msg)
+		if ok != wantOK || inSequence != wantInSequence {
+			t.Fatalf("apply(%s) = %v, %v, want %v, %v", msg, ok, inSequence, wantOK, wantInSequence)
+		}
+		return event
+	}
+
+	event := apply(wsEvent(1, 0, eventSnapshot, `{"slots":[{"slot":0,"sound":{"id":"100","name":"NoOneHeard"}},{"slot":1,"sound":null},{"slot":2,"sound":null}],"gatewayConnected":true}`), true, true)
+	if event.Type != EventBoard || event.StateVersion != 1 || event.Board == nil || event.Board.Slots[0].Sound.Name != "NoOneHeard" {
+		t.Fatalf("snapshot = %+v", event)
+	}
+
+	event = apply(wsEvent(2, 1, EventBoard, `{"slots":[{"slot":2,"sound":{"id":"102","name":"airhorn"}}]}`), true, true)
+	if len(event.Slots) != 1 || event.Board.Slots[2].Sound.Name != "airhorn" || event.Board.Slots[0].Sound.Name != "NoOneHeard" {
+		t.Fatalf("delta = %+v", event)
+	}
+
+	// 3 went missing, so the board is started over, and what comes before
+	// the snapshot is skipped.
+	apply(wsEvent(4, 3, EventBoard, `{"slots":[{"slot":0,"sound":null}]}`), false, false)
+	s.awaitingSnapshot = true // Subscribe asks for one
+	apply(wsEvent(5, 4, EventPlay, `{"soundID":"100"}`), false, false)
+
+	event = apply(wsEvent(5, 0, eventSnapshot, `{"slots":[{"slot":0,"sound":null},{"slot":1,"sound":null},{"slot":2,"sound":null}]}`), true, true)
+	if event.Type != EventBoard || event.StateVersion != 5 || event.Board.Slots[2].Sound != nil || event.Board.GatewayConnected {
+		t.Fatalf("snapshot after the gap = %+v", event)
+	}
+	if event = apply(wsEvent(6, 5, EventPlay, `{"soundID":"100"}`), true, true); event.Type != EventPlay || event.SoundID != "100" {
+		t.Fatalf("play after the snapshot = %+v", event)
+	}
+
+	// gateway status changes the board the next board event carries.
+	apply(wsEvent(6, 0, EventGateway, `{"gatewayConnected":true,"userInChannel":true}`), true, true)
+	if event = apply(wsEvent(7, 6, EventBoard, `{"slots":[]}`), true, true); !event.Board.UserInChannel || !event.Board.GatewayConnected {
+		t.Errorf("board after gateway_status = %+v", event.Board)
+	}
+
+	// newer versions and unknown events are skipped without a resync.
+	apply([]byte(`{"version":99,"type":"board_updated"}`), false, true)
+	apply(wsEvent(8, 7, "something_new", `{}`), false, true)
+}
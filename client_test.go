@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lgordon2/discord-soundboard/client"
+)
+
+// The client package's tests are here, against the real server, since it
+// can't import the server.
+
+func newTestClient(t *testing.T) (*testServer, *client.Client) {
+	s := newTestServer(t)
+	c, err := client.New(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func TestClientBoard(t *testing.T) {
+	s, c := newTestClient(t)
+	board, err := c.Board(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(board.Slots) != soundboardSoundCount || !board.GatewayConnected || board.UserInChannel {
+		t.Fatalf("board = %+v", board)
+	}
+	if board.Slots[2].Sound != nil {
+		t.Errorf("free slot has sound %+v", board.Slots[2].Sound)
+	}
+	ours, ok := board.Sound("NoOneHeard")
+	if !ok || ours.ID != s.boardSound(t, "NoOneHeard") || !ours.Removable || ours.LibraryName != "NoOneHeard" || ours.Uploader != "user"+testUserID {
+		t.Errorf("Sound(NoOneHeard) = %+v, %v", ours, ok)
+	}
+	theirs, ok := board.Sound("bruh")
+	if !ok || theirs.Removable || theirs.UserID != testOtherUserID {
+		t.Errorf("Sound(bruh) = %+v, %v", theirs, ok)
+	}
+
+	sound, err := c.BoardSound(context.Background(), ours.ID)
+	if err != nil || sound != ours {
+		t.Errorf("BoardSound(%s) = %+v, %v", ours.ID, sound, err)
+	}
+}
+
+func TestClientLibrary(t *testing.T) {
+	_, c := newTestClient(t)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"airhorn.ogg", "bruh.ogg", "memes/NoOneHeard.ogg"}},
+		{"air", []string{"airhorn.ogg"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		sounds, err := c.Library(context.Background(), tt.query)
+		if err != nil {
+			t.Fatalf("Library(%q): %v", tt.query, err)
+		}
+		var got []string
+		for _, sound := range sounds {
+			got = append(got, sound.Location)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Library(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	sounds, err := c.Library(context.Background(), "noone")
+	if err != nil || len(sounds) != 1 {
+		t.Fatalf("Library(noone) = %+v, %v", sounds, err)
+	}
+	if sound := sounds[0]; sound.Name != "NoOneHeard" || sound.Folder != "memes" || sound.Format != "ogg" || !sound.OnBoard || sound.Duration != 1 {
+		t.Errorf("NoOneHeard = %+v", sound)
+	}
+}
+
+func TestClientPlayByName(t *testing.T) {
+	s, c := newTestClient(t)
+	if err := c.PlayByName(context.Background(), "bruh"); err != nil {
+		t.Fatal(err)
+	}
+	if played := s.discord.played; len(played) != 1 || played[0] != s.boardSound(t, "bruh") {
+		t.Errorf("played %v, want bruh", played)
+	}
+
+	err := c.PlayByName(context.Background(), "airhorn")
+	if !errors.Is(err, client.ErrNotOnBoard) {
+		t.Errorf("PlayByName(airhorn) = %v, want ErrNotOnBoard", err)
+	}
+}
+
+func TestClientAddAndRemove(t *testing.T) {
+	s, c := newTestClient(t)
+	sound, err := c.Add(context.Background(), "airhorn.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sound.Name != "airhorn" || sound.ID != s.boardSound(t, "airhorn") || !sound.Removable {
+		t.Errorf("added %+v", sound)
+	}
+	if err := c.Remove(context.Background(), sound.ID); err != nil {
+		t.Fatal(err)
+	}
+	board, err := c.Board(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := board.Sound("airhorn"); ok {
+		t.Errorf("airhorn is still on the board after Remove")
+	}
+}
+
+func TestClientSwap(t *testing.T) {
+	s, c := newTestClient(t)
+	sound, err := c.Swap(context.Background(), s.boardSound(t, "bruh"), "airhorn.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	board, err := c.Board(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// it goes in the slot bruh left.
+	if sound.Name != "airhorn" || board.Slots[1].Sound == nil || board.Slots[1].Sound.ID != sound.ID {
+		t.Errorf("swapped in %+v, slot 1 is %+v", sound, board.Slots[1].Sound)
+	}
+
+	_, err = c.Swap(context.Background(), s.boardSound(t, "NoOneHeard"), "missing.ogg")
+	if !client.IsNotFound(err) {
+		t.Errorf("Swap to a missing sound = %v, want not found", err)
+	}
+}
+
+func TestClientSave(t *testing.T) {
+	s, c := newTestClient(t)
+	// someone puts up a sound we haven't got, which the server saves as
+	// soon as it sees it.
+	s.discord.mu.Lock()
+	s.discord.add("yeah", testOtherUserID, testVorbisLasting(4*time.Second))
+	s.discord.mu.Unlock()
+	s.discord.sendSounds()
+	s.settle(t)
+
+	for _, name := range []string{"", "Better Name"} {
+		// it's already saved, so that's what comes back.
+		sound, err := c.Save(context.Background(), s.boardSound(t, "yeah"), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sound.Name != "yeah" || sound.Location != "yeah.ogg" || sound.Source != "discord" || sound.Uploader != "user"+testOtherUserID || !sound.OnBoard {
+			t.Errorf("Save(yeah, %q) = %+v", name, sound)
+		}
+	}
+}
+
+func TestClientError(t *testing.T) {
+	s, c := newTestClient(t)
+	err := c.Play(context.Background(), "999")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Play(999) = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "not_found" || apiErr.Message != `no board sound "999"` {
+		t.Errorf("error = %+v", apiErr)
+	}
+	if !client.IsNotFound(err) {
+		t.Error("IsNotFound = false")
+	}
+
+	s.discord.fail(errors.New("HTTP 503 Service Unavailable"))
+	err = c.Play(context.Background(), s.boardSound(t, "bruh"))
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "upstream_error" || client.IsNotFound(err) {
+		t.Errorf("Play with Discord down = %v", err)
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	s, c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := c.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// next skips the events anything can set off, like someone else
+	// connecting.
+	next := func() client.Event {
+		t.Helper()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					t.Fatal("events closed")
+				}
+				if event.Type == client.EventClients || event.Type == client.EventGateway {
+					continue
+				}
+				return event
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for an event")
+			}
+		}
+	}
+
+	event := next()
+	if event.Type != client.EventBoard || event.Board == nil || len(event.Board.Slots) != soundboardSoundCount || event.Board.Slots[0].Sound.Name != "NoOneHeard" {
+		t.Fatalf("snapshot = %+v", event)
+	}
+	snapshotVersion := event.StateVersion
+
+	bruh := s.boardSound(t, "bruh")
+	if err := c.Play(ctx, bruh); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Type != client.EventPlay || event.SoundID != bruh {
+		t.Fatalf("play = %+v", event)
+	}
+
+	if err := c.Remove(ctx, s.boardSound(t, "NoOneHeard")); err != nil {
+		t.Fatal(err)
+	}
+	event = next()
+	if event.Type != client.EventBoard || event.StateVersion <= snapshotVersion {
+		t.Fatalf("delta = %+v", event)
+	}
+	if got := event.Board.Slots[0].Sound; got != nil {
+		t.Errorf("slot 0 after the delta = %+v", got)
+	}
+	if got := event.Board.Slots[1].Sound; got == nil || got.Name != "bruh" {
+		t.Errorf("slot 1 after the delta = %+v, the delta didn't touch it", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ClipEdit describes changes to a sound. A zero End keeps everything after
+// Start.
+type ClipEdit struct {
+	Start   time.Duration
+	End     time.Duration
+	FadeIn  time.Duration
+	FadeOut time.Duration
+	GainDB  float64
+}
+
+// ClipEditor applies a ClipEdit, returning the edited sound and its extension.
+type ClipEditor interface {
+	EditClip(data []byte, ext string, edit ClipEdit) ([]byte, string, error)
+}
+
+var clipEditor ClipEditor
+
+// parseClipEdit reads an edit from query parameters given in seconds, e.g.
+// ?start=0.25&end=3&fadeOut=0.5&gain=-3.
+func parseClipEdit(query url.Values) (ClipEdit, error) {
+	var edit ClipEdit
+	seconds := func(key string) (time.Duration, error) {
+		v := query.Get(key)
+		if v == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("[error] %s must be a positive number of seconds, got %q", key, v)
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	var err error
+	if edit.Start, err = seconds("start"); err != nil {
+		return ClipEdit{}, err
+	}
+	if edit.End, err = seconds("end"); err != nil {
+		return ClipEdit{}, err
+	}
+	if edit.FadeIn, err = seconds("fadeIn"); err != nil {
+		return ClipEdit{}, err
+	}
+	if edit.FadeOut, err = seconds("fadeOut"); err != nil {
+		return ClipEdit{}, err
+	}
+	if v := query.Get("gain"); v != "" {
+		if edit.GainDB, err = strconv.ParseFloat(v, 64); err != nil || math.IsNaN(edit.GainDB) || math.IsInf(edit.GainDB, 0) {
+			return ClipEdit{}, fmt.Errorf("[error] gain must be a number of dB, got %q", v)
+		}
+	}
+	if edit.End != 0 && edit.End <= edit.Start {
+		return ClipEdit{}, fmt.Errorf("[error] end (%v) must come after start (%v)", edit.End, edit.Start)
+	}
+	return edit, nil
+}
+
+func (t *ffmpegTranscoder) EditClip(data []byte, ext string, edit ClipEdit) ([]byte, string, error) {
+	probe, err := probeSound(data)
+	if err != nil {
+		return nil, "", err
+	}
+	end := probe.Duration
+	if edit.End != 0 && edit.End < end {
+		end = edit.End
+	}
+	length := end - edit.Start
+	if length <= 0 {
+		return nil, "", fmt.Errorf("[error] start %v is past the end of the sound (%v)", edit.Start, probe.Duration)
+	}
+
+	// filters run after -ss, so their timestamps start at 0.
+	filters := []string{}
+	if edit.FadeIn > 0 {
+		filters = append(filters, fmt.Sprintf("afade=t=in:st=0:d=%.3f", edit.FadeIn.Seconds()))
+	}
+	if edit.FadeOut > 0 {
+		fadeOut := min(edit.FadeOut, length)
+		filters = append(filters, fmt.Sprintf("afade=t=out:st=%.3f:d=%.3f", (length-fadeOut).Seconds(), fadeOut.Seconds()))
+	}
+	if edit.GainDB != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%.2fdB", edit.GainDB))
+	}
+
+	args := []string{"-ss", fmt.Sprintf("%.3f", edit.Start.Seconds()), "-t", fmt.Sprintf("%.3f", length.Seconds())}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	args = append(args, "-c:a", t.format.codec, "-b:a", t.bitrate)
+	return t.run(data, args...)
+}
+
+var versionSuffixRegexp = regexp.MustCompile(` \([0-9]+\)$`)
+
+// nextVersionName finds a free name for an edited copy of name, e.g.
+// "NoOneHeard (2)", keeping it short enough for Discord. Editing
+// "NoOneHeard (2)" again gives "NoOneHeard (3)" rather than
+// "NoOneHeard (2) (2)".
+func nextVersionName(name string, taken map[string][]byte) string {
+	name = versionSuffixRegexp.ReplaceAllString(name, "")
+	for i := 2; ; i++ {
+		suffix := " (" + strconv.Itoa(i) + ")"
+		base := name
+		for utf8.RuneCountInString(base)+len(suffix) > maxSoundNameLength {
+			_, size := utf8.DecodeLastRuneInString(base)
+			base = base[:len(base)-size]
+		}
+		candidate := strings.TrimSpace(base) + suffix
+		if _, ok := taken[candidate]; !ok {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseClipEdit(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		query string
+		edit  ClipEdit
+		ok    bool
+	}{
+		{"nothing", "", ClipEdit{}, true},
+		{"trim and fade", "start=0.5&end=2&fadeIn=0.25&fadeOut=1&gain=-3", ClipEdit{Start: 500 * time.Millisecond, End: 2 * time.Second, FadeIn: 250 * time.Millisecond, FadeOut: time.Second, GainDB: -3}, true},
+		{"negative start", "start=-1", ClipEdit{}, false},
+		{"nan start", "start=NaN", ClipEdit{}, false},
+		{"infinite end", "end=Inf", ClipEdit{}, false},
+		{"infinite fade", "fadeOut=+Inf", ClipEdit{}, false},
+		{"nan gain", "gain=NaN", ClipEdit{}, false},
+		{"infinite gain", "gain=-Inf", ClipEdit{}, false},
+		{"end before start", "start=2&end=1", ClipEdit{}, false},
+		{"not a number", "start=soon", ClipEdit{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edit, err := parseClipEdit(query)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", edit)
+				}
+				return
+			}
+			if err != nil || edit != tt.edit {
+				t.Errorf("expected %+v, got %+v, %v", tt.edit, edit, err)
+			}
+		})
+	}
+}
+
+func TestNextVersionName(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		taken []string
+		want  string
+	}{
+		{"NoOneHeard", nil, "NoOneHeard (2)"},
+		{"NoOneHeard", []string{"NoOneHeard (2)"}, "NoOneHeard (3)"},
+		{"NoOneHeard", []string{"NoOneHeard (2)", "NoOneHeard (3)"}, "NoOneHeard (4)"},
+		// a version of a version is the next version, not (2) (2).
+		{"NoOneHeard (2)", []string{"NoOneHeard (2)"}, "NoOneHeard (3)"},
+		// a number that's part of the name stays.
+		{"Track 2", nil, "Track 2 (2)"},
+		{"abcdefghijklmnopqrstuvwxyzabcdef", nil, "abcdefghijklmnopqrstuvwxyzab (2)"},
+		{"abcdefghijklmnopqrstuvwxyzabcd é", nil, "abcdefghijklmnopqrstuvwxyzab (2)"},
+	} {
+		taken := make(map[string][]byte)
+		for _, name := range tt.taken {
+			taken[name] = nil
+		}
+		if got := nextVersionName(tt.name, taken); got != tt.want {
+			t.Errorf("%q taking %v: expected %q, got %q", tt.name, tt.taken, tt.want, got)
+		}
+		if err := validateSoundName(tt.want); err != nil {
+			t.Errorf("%q: %v", tt.want, err)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"path"
 	"strings"
 	"text/template"
+	"time"
 )
 
 var (
 	addSoundCardComponentTmpl *template.Template
+	trashComponentTmpl        *template.Template
 	soundCardComponentTmpl    *template.Template
 	uploadedByComponentTmpl   *template.Template
 )
@@ -17,7 +20,7 @@ const uploadedByComponentTmplRaw = `
             class="max-h-24 max-w-72 p-2 m-2 rounded-lg shadow bg-gray-700 flex flex-row text-sm font-medium text-gray-900 dark:text-white truncate">
             <span class="flex items-center mr-4">Uploaded by</span>
             <img class="rounded-full w-8 h-8"
-                src="{{.avatarCDN}}?size=32">
+                src="{{.avatarSrc}}">
             <span class="flex items-center ml-1 truncate">{{.username}}</span>
 
         </div>
@@ -29,31 +32,63 @@ const uploadedByComponentTmplRaw = `
 `
 
 const addSoundCardComponentTmplRaw = `
-    <div draggable="true" hx-on="htmx:beforeProcessNode: window._makeDraggable(this)" data-soundname="{{ .soundNameEscaped }}" data-soundext="{{ .extension }}"
-        class="add-sound-component h-12 min-w-72 max-w-sm p-2 m-2 bg-white border border-2 border-gray-200 rounded-lg shadow dark:bg-gray-800 dark:border-gray-700 grid grid-cols-1 divide-y divide-gray-700 {{if .hidden}}hidden{{end}}">
+    <div draggable="true" hx-on="htmx:beforeProcessNode: window._makeDraggable(this)" data-soundname="{{ .soundNameEscaped }}" data-soundlocation="{{ .soundLocationEscaped }}{{ .extension }}"
+        class="add-sound-component h-16 min-w-72 max-w-sm p-2 m-2 bg-white border border-2 border-gray-200 rounded-lg shadow dark:bg-gray-800 dark:border-gray-700 grid grid-cols-1 divide-y divide-gray-700 {{if .hidden}}hidden{{end}}">
         <div class="flex flex-row">
-            <h5 class="flex-1 max-w-60 font-bold text-xl truncate text-gray-900 dark:text-white">{{ .soundName }}
+            <h5 class="flex-1 max-w-60 font-bold text-xl truncate text-gray-900 dark:text-white">{{ if .folder }}<span class="text-sm font-normal text-gray-400">{{ .folder }}/</span>{{ end }}{{ .soundName }}
             </h5>
-            <button class="flex shrink items-center justify-center disabled:text-gray-500 text-green-500" hx-swap="none" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'plus')" hx-post="/add-sound?soundLocation={{ .soundNameEscaped }}{{ .extension }}&guildID={{ .guildID }}"></button>
+            {{ if .warning }}<span class="flex shrink items-center justify-center text-amber-400 cursor-help" title="{{ .warningEscaped }}">&#9888;</span>{{ end }}
+            {{ if .duplicateOf }}<button class="flex shrink items-center justify-center text-xs text-amber-400" title="Same audio as {{ .duplicateOfEscaped }}, merge into it" hx-swap="none" hx-post="/library/merge?soundLocation={{ .soundLocation | urlquery }}{{ .extension | urlquery }}&into={{ .duplicateOf | urlquery }}" hx-confirm="Merge {{ .soundNameEscaped }} into {{ .duplicateOfEscaped }}? {{ .soundNameEscaped }} goes to the trash.">dup</button>{{ end }}
+            <button class="flex shrink items-center justify-center text-gray-400" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'headphones')" hx-on:click="window._previewLibrarySound('{{ .audioURL }}')"></button>
+            <button class="flex shrink items-center justify-center text-gray-400" hx-swap="none" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'rename')" hx-post="/library/rename?soundLocation={{ .soundLocation | urlquery }}{{ .extension | urlquery }}" hx-prompt="Rename {{ .soundNameEscaped }} to"></button>
+            <button class="flex shrink items-center justify-center text-gray-400" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'scissors')" hx-on:click="window._editSound(this.closest('.add-sound-component').dataset.soundlocation)"></button>
+            <button class="flex shrink items-center justify-center text-gray-400" hx-swap="none" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'folder')" hx-post="/library/move?soundLocation={{ .soundLocation | urlquery }}{{ .extension | urlquery }}" hx-prompt="Move {{ .soundNameEscaped }} to folder (blank for top level)"></button>
+            <button class="flex shrink items-center justify-center text-rose-400" hx-swap="none" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'trash')" hx-delete="/library/delete?soundLocation={{ .soundLocation | urlquery }}{{ .extension | urlquery }}" hx-confirm="Move {{ .soundNameEscaped }} to the trash?"></button>
+            <button class="add-sound-button flex shrink items-center justify-center disabled:text-gray-500 text-green-500" hx-swap="none" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'plus')" hx-post="/add-sound?soundLocation={{ .soundLocationEscaped }}{{ .extension }}&guildID={{ .guildID }}"></button>
         </div>
+        <img class="h-3 w-full" loading="lazy" alt="" draggable="false" src="/waveform/library?soundLocation={{ .soundLocation | urlquery }}{{ .extension | urlquery }}">
     </div>
 `
 
+const trashComponentTmplRaw = `
+<div id="trash" class="flex flex-col items-center max-w-7xl text-gray-900 dark:text-white">
+    {{ if .trashed }}
+    <details class="m-2">
+        <summary class="cursor-pointer text-gray-400">Trash ({{ len .trashed }}) &middot; kept for {{ .retention }}</summary>
+        <ul>
+            {{ range .trashed }}
+            <li class="flex flex-row items-center m-1">
+                <span class="flex-1 truncate">{{ .Location }}</span>
+                <span class="ml-2 text-sm text-gray-400">{{ .DeletedAt.Format "2006-01-02 15:04" }}</span>
+                <button class="ml-2 text-blue-500" hx-swap="none" hx-post="/library/restore?trashID={{ .TrashID }}&soundLocation={{ .Location | urlquery }}">Restore</button>
+            </li>
+            {{ end }}
+        </ul>
+    </details>
+    {{ end }}
+</div>
+`
+
 const soundCardComponentTmplRaw = `
 <div {{ if .canRemove }}hx-on="htmx:beforeProcessNode: window._makeDroppable(this)"{{end}} data-soundid="{{.soundId}}" id="soundboard-{{.ordinal}}"
-            class="h-24 w-72 p-2 m-2 bg-white border border-2 border-gray-200 rounded-lg shadow dark:bg-gray-800 dark:border-gray-700 grid grid-cols-1 divide-y divide-gray-700 {{ if .canRemove }}droppable{{ end }}">
+            class="h-28 w-72 p-2 m-2 bg-white border border-2 border-gray-200 rounded-lg shadow dark:bg-gray-800 dark:border-gray-700 grid grid-cols-1 divide-y divide-gray-700 {{ if .canRemove }}droppable{{ end }}">
             {{ if .used }}
             <div class="flex flex-row">
                 <h5 class="flex-1 mb-2 text-xl font-bold tracking-tight text-gray-900 dark:text-white truncate">{{.soundName}}
                 </h5>
                 <div class="shrink mb-2">
+                    {{ if .libraryName }}
+                    <span class="text-xs text-gray-400 truncate" title="Already in library as {{.libraryName}}">in library{{ if ne .libraryName .soundName }} as {{.libraryName}}{{ end }}</span>
+                    {{ else }}
                     <button hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'save')" class="enabled:text-blue-500 disabled:text-gray-500"
-                        hx-post="/save-sound?soundID={{.soundId}}&soundName={{.soundName}}" {{if not .canSave}}disabled="true"{{end}}>
+                        hx-post="/save-sound?soundID={{.soundId}}&soundName={{.soundName}}">
                     </button>
+                    {{ end }}
                 </div>
                 <a class="shrink text-blue-500 ml-1"
-                    href="https://cdn.discordapp.com/soundboard-sounds/{{.soundId}}" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'download'); new Audio(this.href)"></a>
+                    href="/cdn/soundboard-sounds/{{.soundId}}" hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'download'); new Audio(this.href)"></a>
             </div>
+            <img class="h-4 w-full" loading="lazy" alt="" src="/waveform/board?soundID={{.soundId}}">
 
             <div class="flex flex-row divide-x divide-gray-700">
                 <button hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'headphones')" hx-on:click="window._playSound('soundboard-{{.ordinal}}', '{{.soundId}}')" class="flex flex-1 items-center justify-center mt-1"></button>
@@ -70,7 +105,9 @@ const soundCardComponentTmplRaw = `
         </div>
 `
 
-func soundCardComponent(i int, id, name string, canSend, canSave, canRemove bool, deleteButton any) string {
+// soundCardComponent renders a board slot. libraryName is the stored sound it's
+// a copy of, if any, and replaces the save button.
+func soundCardComponent(i int, id, name string, canSend bool, libraryName string, canRemove bool, deleteButton any) string {
 	var builder strings.Builder
 	used := id != "" && name != "" && deleteButton != nil
 	m := map[string]any{
@@ -79,7 +116,7 @@ func soundCardComponent(i int, id, name string, canSend, canSave, canRemove bool
 		"soundName":    name,
 		"deleteButton": deleteButton,
 		"canSend":      canSend,
-		"canSave":      canSave,
+		"libraryName":  libraryName,
 		"canRemove":    canRemove || !used,
 		"used":         used,
 	}
@@ -90,14 +127,31 @@ func soundCardComponent(i int, id, name string, canSend, canSave, canRemove bool
 	return builder.String()
 }
 
-func addSoundCardComponent(storedSound, extension, guildID string, hidden bool) string {
+// addSoundCardComponent renders a stored sound. location is relative to
+// soundsDir and has no extension, e.g. "memes/NoOneHeard". A non-empty warning
+// flags sounds Discord won't accept as they are, and duplicateOf names the
+// stored sound with the same audio so they can be merged.
+func addSoundCardComponent(location, extension, guildID string, hidden bool, warning, duplicateOf string) string {
 	var builder strings.Builder
+	storedSound := path.Base(location)
+	folder := path.Dir(location)
+	if folder == "." {
+		folder = ""
+	}
 	m := map[string]any{
-		"soundName": storedSound,
-		"soundNameEscaped": strings.ReplaceAll(storedSound, "\"", "&quot;"),
-		"extension": extension,
-		"guildID":   guildID,
-		"hidden":    hidden,
+		"soundName":            storedSound,
+		"soundNameEscaped":     strings.ReplaceAll(storedSound, "\"", "&quot;"),
+		"soundLocation":        location,
+		"soundLocationEscaped": strings.ReplaceAll(location, "\"", "&quot;"),
+		"folder":               folder,
+		"audioURL":             libraryAudioURL(location + extension),
+		"extension":            extension,
+		"guildID":              guildID,
+		"hidden":               hidden,
+		"warning":              warning,
+		"warningEscaped":       strings.ReplaceAll(warning, "\"", "&quot;"),
+		"duplicateOf":          duplicateOf,
+		"duplicateOfEscaped":   strings.ReplaceAll(duplicateOf, "\"", "&quot;"),
 	}
 	err := addSoundCardComponentTmpl.Execute(&builder, m)
 	if err != nil {
@@ -106,11 +160,24 @@ func addSoundCardComponent(storedSound, extension, guildID string, hidden bool)
 	return builder.String()
 }
 
-func uploadedByComponent(username, avatarCDN string) string {
+func trashComponent(trashed []TrashedSound, retention time.Duration) string {
+	var builder strings.Builder
+	m := map[string]any{
+		"trashed":   trashed,
+		"retention": retention.String(),
+	}
+	err := trashComponentTmpl.Execute(&builder, m)
+	if err != nil {
+		panic(err)
+	}
+	return builder.String()
+}
+
+func uploadedByComponent(username, avatarSrc string) string {
 	var builder strings.Builder
 	m := map[string]any{
 		"username":  username,
-		"avatarCDN": avatarCDN,
+		"avatarSrc": avatarSrc,
 	}
 	err := uploadedByComponentTmpl.Execute(&builder, m)
 	if err != nil {
@@ -121,6 +188,7 @@ func uploadedByComponent(username, avatarCDN string) string {
 
 func init() {
 	addSoundCardComponentTmpl = template.Must(template.New("addSoundCardComponentTmpl").Parse(addSoundCardComponentTmplRaw))
+	trashComponentTmpl = template.Must(template.New("trashComponentTmpl").Parse(trashComponentTmplRaw))
 	soundCardComponentTmpl = template.Must(template.New("soundCardComponentTmpl").Parse(soundCardComponentTmplRaw))
 	uploadedByComponentTmpl = template.Must(template.New("uploadedByComponentTmpl").Parse(uploadedByComponentTmplRaw))
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Fingerprints follow Haitsma and Kalker's approach: every frame gets 16 bits,
+// one per pair of neighbouring frequency bands, set when the energy difference
+// between the bands grew since the last frame. Re-encoding, resampling and
+// volume changes barely move those bits, so two uploads of the same clip
+// match even when their bytes have nothing in common.
+const (
+	fingerprintSampleRate = 8000
+	fingerprintFrameSize  = 1024 // 128ms, must be a power of two
+	fingerprintHopSize    = 256
+	fingerprintBands      = 17 // 16 bits per frame
+	fingerprintMinFreq    = 300.0
+	fingerprintMaxFreq    = 3000.0
+
+	// fingerprintMatchThreshold is the fraction of bits that may differ for
+	// two fingerprints to still count as the same sound.
+	fingerprintMatchThreshold = 0.3
+	// fingerprintMaxShift is how many frames of leading silence or offset
+	// we'll look past when lining fingerprints up.
+	fingerprintMaxShift = 16
+)
+
+type Fingerprint []uint16
+
+func computeFingerprint(samples []int16) Fingerprint {
+	if len(samples) < fingerprintFrameSize {
+		return nil
+	}
+
+	// band edges, spaced logarithmically like hearing is.
+	edges := make([]int, fingerprintBands+1)
+	for i := range edges {
+		freq := fingerprintMinFreq * math.Pow(fingerprintMaxFreq/fingerprintMinFreq, float64(i)/fingerprintBands)
+		edges[i] = int(freq * fingerprintFrameSize / fingerprintSampleRate)
+	}
+	window := make([]float64, fingerprintFrameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrameSize-1))
+	}
+
+	fp := Fingerprint{}
+	frame := make([]complex128, fingerprintFrameSize)
+	var prev []float64
+	for start := 0; start+fingerprintFrameSize <= len(samples); start += fingerprintHopSize {
+		for i := range frame {
+			frame[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft(frame)
+
+		energies := make([]float64, fingerprintBands)
+		for b := range energies {
+			for k := edges[b]; k < edges[b+1]; k++ {
+				energies[b] += math.Pow(cmplx.Abs(frame[k]), 2)
+			}
+		}
+		if prev != nil {
+			var bits uint16
+			for b := 0; b < fingerprintBands-1; b++ {
+				if (energies[b]-energies[b+1])-(prev[b]-prev[b+1]) > 0 {
+					bits |= 1 << b
+				}
+			}
+			fp = append(fp, bits)
+		}
+		prev = energies
+	}
+	return fp
+}
+
+// fft is an in-place iterative radix-2 Cooley-Tukey transform. len(x) must be
+// a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// BitErrorRate lines a and b up at the offset where they agree most and
+// returns the fraction of bits that still differ. Clips of very different
+// lengths never match.
+func (a Fingerprint) BitErrorRate(b Fingerprint) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 1
+	}
+	shorter, longer := min(len(a), len(b)), max(len(a), len(b))
+	if float64(shorter) < 0.75*float64(longer) {
+		return 1
+	}
+
+	best := 1.0
+	for shift := -fingerprintMaxShift; shift <= fingerprintMaxShift; shift++ {
+		errors, compared := 0, 0
+		for i := range a {
+			j := i + shift
+			if j < 0 || j >= len(b) {
+				continue
+			}
+			errors += popcount16(a[i] ^ b[j])
+			compared += 16
+		}
+		if compared < 16*shorter/2 {
+			continue
+		}
+		best = math.Min(best, float64(errors)/float64(compared))
+	}
+	return best
+}
+
+func popcount16(v uint16) int {
+	count := 0
+	for ; v != 0; v &= v - 1 {
+		count++
+	}
+	return count
+}
+
+func (fp Fingerprint) String() string {
+	buf := make([]byte, len(fp)*2)
+	for i, v := range fp {
+		binary.LittleEndian.PutUint16(buf[i*2:], v)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func parseFingerprint(s string) (Fingerprint, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(buf)%2 != 0 {
+		return nil, fmt.Errorf("[error] invalid fingerprint")
+	}
+	fp := make(Fingerprint, len(buf)/2)
+	for i := range fp {
+		fp[i] = binary.LittleEndian.Uint16(buf[i*2:])
+	}
+	return fp, nil
+}
+
+func fingerprintSound(data []byte) (Fingerprint, error) {
+	if pcmDecoder == nil {
+		return nil, fmt.Errorf("[error] no audio decoder configured")
+	}
+	samples, err := pcmDecoder.DecodePCM(data, fingerprintSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	fp := computeFingerprint(samples)
+	if len(fp) == 0 {
+		return nil, fmt.Errorf("[error] sound is too short to fingerprint")
+	}
+	return fp, nil
+}
+
+// fingerprintIndex holds fingerprints by key, library sound names or board
+// sound IDs.
+type fingerprintIndex struct {
+	mu     sync.RWMutex
+	prints map[string]Fingerprint
+	// generation goes up whenever prints changes, see matchInputs.
+	generation atomic.Uint64
+}
+
+func newFingerprintIndex() *fingerprintIndex {
+	return &fingerprintIndex{prints: make(map[string]Fingerprint)}
+}
+
+func (idx *fingerprintIndex) Get(key string) (Fingerprint, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	fp, ok := idx.prints[key]
+	return fp, ok
+}
+
+func (idx *fingerprintIndex) Set(key string, fp Fingerprint) {
+	idx.mu.Lock()
+	idx.prints[key] = fp
+	idx.generation.Add(1)
+	idx.mu.Unlock()
+}
+
+// Retain drops every key that isn't in keep.
+func (idx *fingerprintIndex) Retain(keep map[string][]byte) {
+	idx.mu.Lock()
+	for key := range idx.prints {
+		if _, ok := keep[key]; !ok {
+			delete(idx.prints, key)
+			idx.generation.Add(1)
+		}
+	}
+	idx.mu.Unlock()
+}
+
+func (idx *fingerprintIndex) Generation() uint64 {
+	return idx.generation.Load()
+}
+
+// Match returns the key whose fingerprint is closest to fp, if any is close
+// enough to be the same sound.
+func (idx *fingerprintIndex) Match(fp Fingerprint) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	bestKey, best := "", fingerprintMatchThreshold
+	for key, other := range idx.prints {
+		if ber := fp.BitErrorRate(other); ber < best || (ber == best && bestKey != "" && key < bestKey) {
+			bestKey, best = key, ber
+		}
+	}
+	return bestKey, bestKey != ""
+}
+
+// matchInputs are the generations of everything a board sound's library
+// match depends on: the library, and the hashes and fingerprints on both
+// sides. A match worked out under the same inputs is still right.
+type matchInputs struct {
+	library       int
+	boardHashes   uint64
+	boardPrints   uint64
+	libraryPrints uint64
+}
+
+// libraryMatches memoizes library matches by board sound ID. Matching by
+// fingerprint compares against every library sound, and the match is wanted
+// for every card on every render.
+type libraryMatches struct {
+	mu     sync.Mutex
+	inputs matchInputs
+	names  map[string]string
+}
+
+// Get returns soundID's match under inputs, calling match when it isn't
+// known yet. Matches from older inputs are forgotten.
+func (m *libraryMatches) Get(soundID string, inputs matchInputs, match func() string) string {
+	m.mu.Lock()
+	if m.names == nil || m.inputs != inputs {
+		m.inputs, m.names = inputs, make(map[string]string)
+	}
+	name, ok := m.names[soundID]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	name = match()
+	m.mu.Lock()
+	if m.inputs == inputs {
+		m.names[soundID] = name
+	}
+	m.mu.Unlock()
+	return name
+}
+
+var fingerprintRuns rerunner
+
+// fingerprintSaveEvery is how many new fingerprints fingerprintLibrary
+// computes between saving them, saving the metadata rewrites all of it.
+const fingerprintSaveEvery = 50
+
+// fingerprintLibrary fills idx with a fingerprint for every stored sound in
+// the background, using the ones saved in metadata and computing (and saving)
+// the rest. Only one runs at a time, a call made during one runs after it.
+func fingerprintLibrary(storedSoundMap map[string][]byte, metadata *soundMetadataStore, idx *fingerprintIndex) {
+	if pcmDecoder == nil {
+		return
+	}
+	go fingerprintRuns.Run(func() { fingerprintLibraryPass(storedSoundMap, metadata, idx) })
+}
+
+func fingerprintLibraryPass(storedSoundMap map[string][]byte, metadata *soundMetadataStore, idx *fingerprintIndex) {
+	computed := make(map[string]string)
+	save := func() {
+		if len(computed) == 0 {
+			return
+		}
+		err := metadata.Update(func(entries map[string]SoundMetadata) {
+			for name, fp := range computed {
+				md := entries[name]
+				md.Fingerprint = fp
+				entries[name] = md
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save fingerprints: %v\n", err)
+		}
+		clear(computed)
+	}
+	defer save()
+
+	for name, data := range storedSoundMap {
+		if _, ok := idx.Get(name); ok {
+			continue
+		}
+		if saved := metadata.Get(name).Fingerprint; saved != "" {
+			if fp, err := parseFingerprint(saved); err == nil {
+				idx.Set(name, fp)
+				continue
+			}
+		}
+		fp, err := fingerprintSound(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] fingerprinting %s: %v\n", name, err)
+			continue
+		}
+		idx.Set(name, fp)
+		computed[name] = fp.String()
+		if len(computed) >= fingerprintSaveEvery {
+			save()
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestLibraryMatches(t *testing.T) {
+	var m libraryMatches
+	calls := 0
+	get := func(soundID string, inputs matchInputs, want string) {
+		t.Helper()
+		if name := m.Get(soundID, inputs, func() string { calls++; return want }); name != want {
+			t.Errorf("expected %s to match %q, got %q", soundID, want, name)
+		}
+	}
+	expectCalls := func(want int) {
+		t.Helper()
+		if calls != want {
+			t.Errorf("expected %d matches worked out, got %d", want, calls)
+		}
+	}
+
+	first := matchInputs{library: 1}
+	get("1", first, "airhorn")
+	get("1", first, "airhorn")
+	get("2", first, "")
+	get("2", first, "") // no match is remembered too
+	expectCalls(2)
+
+	// a new board fingerprint may match something now.
+	fingerprinted := matchInputs{library: 1, boardPrints: 1}
+	get("2", fingerprinted, "airhorn")
+	get("1", fingerprinted, "airhorn")
+	expectCalls(4)
+
+	// and a refreshed library may have lost what it matched.
+	get("1", matchInputs{library: 2, boardPrints: 1}, "")
+	expectCalls(5)
+}
+
+func TestFingerprintIndexGeneration(t *testing.T) {
+	idx := newFingerprintIndex()
+	idx.Set("airhorn", Fingerprint{1, 2, 3})
+	before := idx.Generation()
+	idx.Retain(map[string][]byte{"airhorn": nil})
+	if idx.Generation() != before {
+		t.Errorf("expected keeping every fingerprint not to change the generation")
+	}
+	idx.Retain(map[string][]byte{})
+	if idx.Generation() == before {
+		t.Errorf("expected dropping a fingerprint to change the generation")
+	}
+
+	hashes := newSoundHashCache()
+	hashes.Set("1", "abc")
+	before = hashes.Generation()
+	hashes.Set("1", "abc") // fetched again
+	if hashes.Generation() != before {
+		t.Errorf("expected setting the same hash not to change the generation")
+	}
+}
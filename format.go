@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type SoundFormat struct {
+	Ext      string // including the dot
+	MIMEType string
+}
+
+var (
+	formatOgg  = SoundFormat{Ext: ".ogg", MIMEType: "audio/ogg"}
+	formatMP3  = SoundFormat{Ext: ".mp3", MIMEType: "audio/mpeg"}
+	formatWAV  = SoundFormat{Ext: ".wav", MIMEType: "audio/wav"}
+	formatFLAC = SoundFormat{Ext: ".flac", MIMEType: "audio/flac"}
+)
+
+// libraryFormats are the formats fetchStoredSounds picks up. Anything else has
+// to be transcoded into one of these before it can be saved.
+var libraryFormats = []SoundFormat{formatOgg, formatMP3}
+
+// detectSoundFormat sniffs the container from the magic bytes at the start of
+// data rather than trusting file names or Content-Type headers.
+func detectSoundFormat(data []byte) (SoundFormat, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return formatOgg, nil
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return formatMP3, nil
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return formatWAV, nil
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return formatFLAC, nil
+	}
+	// a bare frame sync is only 11 bits, so make sure the rest of the header
+	// makes sense before calling it an mp3.
+	if _, ok := parseMP3Frame(data); ok {
+		return formatMP3, nil
+	}
+	return SoundFormat{}, errUnknownFormat
+}
+
+// soundFormatForExt looks a format up by extension, with or without the dot.
+func soundFormatForExt(ext string) (SoundFormat, bool) {
+	ext = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+	for _, f := range []SoundFormat{formatOgg, formatMP3, formatWAV, formatFLAC} {
+		if f.Ext == ext {
+			return f, true
+		}
+	}
+	return SoundFormat{}, false
+}
+
+func isLibraryFormat(f SoundFormat) bool {
+	for _, lf := range libraryFormats {
+		if lf == f {
+			return true
+		}
+	}
+	return false
+}
+
+// soundMIMEType picks the MIME type to send data to Discord as, trusting the
+// bytes over ext.
+func soundMIMEType(data []byte, ext string) (string, error) {
+	if f, err := detectSoundFormat(data); err == nil {
+		return f.MIMEType, nil
+	}
+	if f, ok := soundFormatForExt(ext); ok {
+		return f.MIMEType, nil
+	}
+	return "", fmt.Errorf("[error] can't tell what kind of audio %q is", ext)
+}
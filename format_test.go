@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDetectSoundFormat(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		format SoundFormat
+	}{
+		{"ogg vorbis", testVorbis(), formatOgg},
+		{"ogg opus", testOpus(), formatOgg},
+		{"id3v2 tag", []byte("ID3\x04\x00\x00\x00\x00\x00\x23TIT2"), formatMP3},
+		// MPEG-1 layer 3, 128kbps, 44.1kHz.
+		{"bare mp3 frame sync", []byte("\xFF\xFB\x90\x64\x00\x00\x00\x00"), formatMP3},
+		// MPEG-2 layer 3, 64kbps, 22.05kHz.
+		{"mpeg-2 frame sync", []byte("\xFF\xF3\x80\xC4\x00\x00\x00\x00"), formatMP3},
+		{"riff wave", []byte("RIFF\x24\x08\x00\x00WAVEfmt \x10\x00\x00\x00"), formatWAV},
+		{"flac", []byte("fLaC\x00\x00\x00\x22\x10\x00\x10\x00"), formatFLAC},
+		{"riff that isn't wave", []byte("RIFF\x24\x08\x00\x00AVI LIST"), SoundFormat{}},
+		{"truncated riff", []byte("RIFF\x24\x08\x00\x00WAV"), SoundFormat{}},
+		{"truncated frame header", []byte("\xFF\xFB\x90"), SoundFormat{}},
+		{"frame sync with a bad bitrate", []byte("\xFF\xFB\xF0\x64"), SoundFormat{}},
+		{"frame sync with a reserved version", []byte("\xFF\xEB\x90\x64"), SoundFormat{}},
+		{"truncated ogg", []byte("Ogg"), SoundFormat{}},
+		{"empty", nil, SoundFormat{}},
+		{"garbage", []byte("<!DOCTYPE html><html>"), SoundFormat{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := detectSoundFormat(tt.data)
+			if tt.format == (SoundFormat{}) {
+				if !errors.Is(err, errUnknownFormat) {
+					t.Errorf("expected errUnknownFormat, got %v, %v", format, err)
+				}
+				return
+			}
+			if err != nil || format != tt.format {
+				t.Errorf("expected %v, got %v, %v", tt.format, format, err)
+			}
+		})
+	}
+}
+
+func TestSoundMIMEType(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		ext      string
+		mimeType string
+	}{
+		{"bytes win over the extension", []byte("ID3\x04\x00\x00\x00\x00\x00\x23"), ".ogg", "audio/mpeg"},
+		{"extension with the dot", []byte("garbage"), ".ogg", "audio/ogg"},
+		{"extension without the dot", []byte("garbage"), "MP3", "audio/mpeg"},
+		{"neither", []byte("garbage"), ".txt", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mimeType, err := soundMIMEType(tt.data, tt.ext)
+			if tt.mimeType == "" {
+				if err == nil {
+					t.Errorf("expected an error, got %q", mimeType)
+				}
+				return
+			}
+			if err != nil || mimeType != tt.mimeType {
+				t.Errorf("expected %q, got %q, %v", tt.mimeType, mimeType, err)
+			}
+		})
+	}
+}
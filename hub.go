@@ -0,0 +1,314 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The hub fans broadcasts out to /ws and /events clients without ever
+// waiting on one. Each client has its own queue that the broadcaster only
+// appends to, and a frame that a newer one replaces completely (the same
+// soundboard-N card, a newer user count) is dropped from the queue rather
+// than sent late. A client whose queue still grows past hubMaxQueue is too
+// far behind to catch up and gets disconnected, it'll reconnect and start
+// over from the whole board.
+//
+// The state clients follow only changes under the hub's lock too, in
+// commit, along with the version going up and the update going out. New
+// clients get their snapshot rendered under it, at the version of the latest
+// broadcast, so a snapshot always shows the state at its version and nothing
+// can land between it and the first update queued after it. Handlers that
+// only read the state don't need to hold up the hub for it: the board is
+// copied out with at, and the library has a lock of its own for them.
+
+const hubMaxQueue = 256
+
+// hubFrame is a frame waiting to be sent. keys are the elements or events it
+// updates, a queued frame is dropped when a newer one updates all of its
+// keys. Frames without keys are never dropped.
+type hubFrame struct {
+	wsFrame
+	keys    []string
+	version uint64
+	// reset marks the start of a snapshot, it applies whatever version the
+	// client is at.
+	reset bool
+}
+
+// supersedes reports whether f updates everything old does.
+func (f hubFrame) supersedes(old hubFrame) bool {
+	if len(old.keys) == 0 {
+		return false
+	}
+	for _, key := range old.keys {
+		found := false
+		for _, newKey := range f.keys {
+			if key == newKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type hubClient struct {
+	protocol  string
+	transport string // "ws" or "events"
+	joined    time.Time
+
+	mu        sync.Mutex
+	queue     []hubFrame
+	coalesced int
+	// sent is the version of the last frame taken, what the next one's prev
+	// is.
+	sent uint64
+	// wake has room for one value, so pushes never block and a writer that's
+	// busy still finds out there's more to do.
+	wake chan struct{}
+	// done is closed when the client leaves or is dropped for lagging.
+	done    chan struct{}
+	dropped bool
+}
+
+// push queues frames, dropping queued ones they supersede, and reports
+// whether the client is keeping up.
+func (c *hubClient) push(frames []hubFrame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, frame := range frames {
+		kept := c.queue[:0]
+		for _, queued := range c.queue {
+			if frame.supersedes(queued) {
+				c.coalesced++
+				// the newer frame is later in the history, resuming from it
+				// loses nothing.
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		c.queue = append(kept, frame)
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(c.queue) <= hubMaxQueue
+}
+
+// take empties the queue, stamping each frame with its versions.
+func (c *hubClient) take() []wsFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frames := make([]wsFrame, 0, len(c.queue))
+	for _, frame := range c.queue {
+		prev := c.sent
+		if frame.reset {
+			prev = 0
+		}
+		c.sent = frame.version
+		frames = append(frames, wsFrame{id: frame.id, data: stampVersion(c.protocol, frame.data, frame.version, prev)})
+	}
+	c.queue = c.queue[:0]
+	return frames
+}
+
+func (c *hubClient) queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+type hub struct {
+	mu      sync.Mutex
+	clients map[*hubClient]bool
+	history *broadcastHistory
+	// laggards counts clients dropped for falling behind.
+	laggards int
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[*hubClient]bool), history: newBroadcastHistory()}
+}
+
+func newHubClient(protocol, transport string) *hubClient {
+	return &hubClient{
+		protocol:  protocol,
+		transport: transport,
+		joined:    time.Now(),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// join adds a client that starts from what snapshot renders for the current
+// state version.
+func (h *hub) join(protocol, transport string, snapshot func(version uint64) []hubFrame) *hubClient {
+	c := newHubClient(protocol, transport)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pushSnapshot(c, snapshot)
+	h.clients[c] = true
+	return c
+}
+
+// resnapshot starts a client that's missed something over again, anything
+// still queued for it is out of date.
+func (h *hub) resnapshot(c *hubClient, snapshot func(version uint64) []hubFrame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.mu.Lock()
+	c.queue = c.queue[:0]
+	c.mu.Unlock()
+	h.pushSnapshot(c, snapshot)
+}
+
+// pushSnapshot expects h.mu to be held.
+func (h *hub) pushSnapshot(c *hubClient, snapshot func(version uint64) []hubFrame) {
+	// the snapshot may be shared, stamp a copy.
+	frames := append([]hubFrame{}, snapshot(h.history.seq)...)
+	for i := range frames {
+		frames[i].version = h.history.seq
+	}
+	if len(frames) > 0 {
+		frames[0].reset = true
+		frames[len(frames)-1].id = h.history.lastID()
+	}
+	c.push(frames)
+}
+
+// resume adds a client that's seen everything up to lastEventID, or returns
+// false when what it missed isn't kept any more.
+func (h *hub) resume(protocol, transport, lastEventID string) (*hubClient, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	missed, version, ok := h.history.since(lastEventID)
+	if !ok {
+		return nil, false
+	}
+	c := newHubClient(protocol, transport)
+	c.sent = version
+	if !c.push(framesFor(missed, protocol)) {
+		// it'd be dropped on the next broadcast and be back with the same
+		// ID, the whole board is less to send anyway.
+		return nil, false
+	}
+	h.clients[c] = true
+	return c, true
+}
+
+// at runs render with the current state version and the ID of the broadcast
+// that got the board there. It holds the hub's lock like a snapshot does, so
+// a client resuming from that ID gets exactly the updates after what render
+// saw.
+func (h *hub) at(render func(version uint64, lastEventID string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	render(h.history.seq, h.history.lastID())
+}
+
+// leave removes a client. It's fine to call more than once.
+func (h *hub) leave(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+// remove expects h.mu to be held.
+func (h *hub) remove(c *hubClient) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	close(c.done)
+}
+
+// broadcast queues msg for every client. Kept messages go in the history for
+// /events clients to be replayed when they reconnect.
+func (h *hub) broadcast(msg wsMessage, keep bool) {
+	frames := msg.frames()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.send(frames, keep)
+}
+
+// commit runs change, which changes the state clients follow and returns the
+// update for it, and broadcasts the update, all under the hub's lock. change
+// returns false when nothing changed. It mustn't call back into the hub.
+func (h *hub) commit(change func() (wsMessage, bool)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if msg, ok := change(); ok {
+		h.send(msg.frames(), true)
+	}
+}
+
+// send expects h.mu to be held.
+func (h *hub) send(frames map[string][]hubFrame, keep bool) {
+	entry := broadcastEntry{frames: frames}
+	if keep {
+		entry.id = h.history.add(entry.frames)
+	}
+	entry.version = h.history.seq
+	for c := range h.clients {
+		if !c.push(framesFor([]broadcastEntry{entry}, c.protocol)) {
+			c.dropped = true
+			h.laggards++
+			h.remove(c)
+		}
+	}
+}
+
+func (h *hub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+type hubClientStats struct {
+	Protocol  string    `json:"protocol"`
+	Transport string    `json:"transport"`
+	Joined    time.Time `json:"joined"`
+	Queued    int       `json:"queued"`
+	Coalesced int       `json:"coalesced"`
+}
+
+type hubStats struct {
+	Clients     []hubClientStats `json:"clients"`
+	MaxQueue    int              `json:"maxQueue"`
+	LastEventID string           `json:"lastEventID"`
+	Laggards    int              `json:"laggardsDisconnected"`
+}
+
+// stats reports every client's queue.
+func (h *hub) stats() hubStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := hubStats{
+		Clients:     make([]hubClientStats, 0, len(h.clients)),
+		MaxQueue:    hubMaxQueue,
+		LastEventID: h.history.lastID(),
+		Laggards:    h.laggards,
+	}
+	for c := range h.clients {
+		c.mu.Lock()
+		stats.Clients = append(stats.Clients, hubClientStats{
+			Protocol:  c.protocol,
+			Transport: c.transport,
+			Joined:    c.joined,
+			Queued:    len(c.queue),
+			Coalesced: c.coalesced,
+		})
+		c.mu.Unlock()
+	}
+	return stats
+}
+
+// slotKey is the key for board slot i in both protocols' frames.
+func slotKey(i int) string {
+	return "soundboard-" + strconv.Itoa(i)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var hubLoad = flag.Bool("hub-load", false, "run TestHubLoad at full size, hundreds of clients and thousands of updates")
+
+var stateVersionRegexp = regexp.MustCompile(`data-version="([0-9]+)" data-prev="([0-9]+)"`)
+
+type hubLoadTest struct {
+	clients      int           // clients that keep reading
+	stalled      int           // clients that never read
+	updates      int           // updates to broadcast
+	playEvery    int           // make every nth update a play, which is never coalesced
+	writeDelay   time.Duration // how long a reading client takes to send what's queued
+	maxBroadcast time.Duration // fail if any broadcast takes longer than this
+}
+
+// TestHubLoad pushes updates through a hub with simulated clients, some of
+// which never read, and checks that broadcasting never waits on them, that
+// they get dropped, and that everyone else still ends up with the latest
+// card for every slot and every play. It's scaled down unless -hub-load is
+// set.
+func TestHubLoad(t *testing.T) {
+	lt := hubLoadTest{
+		clients:      50,
+		stalled:      10,
+		updates:      500,
+		playEvery:    20,
+		writeDelay:   2 * time.Millisecond,
+		maxBroadcast: 50 * time.Millisecond,
+	}
+	if *hubLoad {
+		lt.clients, lt.stalled, lt.updates = 500, 50, 5000
+	}
+
+	h := newHub()
+	noSnapshot := func(uint64) []hubFrame { return nil }
+	type tally struct {
+		slots  [soundboardSoundCount]int // latest version seen for each slot
+		plays  int
+		frames int
+		// gaps counts frames whose prev wasn't the version before, which
+		// would have the client ask for a snapshot.
+		gaps    int
+		version uint64
+	}
+	tallies := make([]tally, lt.clients)
+	live := make([]*hubClient, lt.clients)
+	var wg sync.WaitGroup
+	for i := range live {
+		live[i] = h.join(wsProtocolHTMX, "ws", noSnapshot)
+		wg.Add(1)
+		go func(c *hubClient, t *tally) {
+			defer wg.Done()
+			for {
+				select {
+				case <-c.wake:
+					for _, frame := range c.take() {
+						t.frames++
+						var version, prev uint64
+						if m := stateVersionRegexp.FindSubmatch(frame.data); m != nil {
+							version, _ = strconv.ParseUint(string(m[1]), 10, 64)
+							prev, _ = strconv.ParseUint(string(m[2]), 10, 64)
+						}
+						if prev != t.version {
+							t.gaps++
+						}
+						t.version = version
+						var slot, n int
+						if _, err := fmt.Sscanf(string(frame.data), "slot %d %d", &slot, &n); err == nil {
+							t.slots[slot] = n
+						} else {
+							t.plays++
+						}
+					}
+					time.Sleep(lt.writeDelay)
+				case <-c.done:
+					return
+				}
+			}
+		}(live[i], &tallies[i])
+	}
+	stalled := make([]*hubClient, lt.stalled)
+	for i := range stalled {
+		stalled[i] = h.join(wsProtocolHTMX, "ws", noSnapshot)
+	}
+
+	var latest [soundboardSoundCount]int
+	plays := 0
+	durations := make([]time.Duration, 0, lt.updates)
+	start := time.Now()
+	for i := 1; i <= lt.updates; i++ {
+		var msg wsMessage
+		keep := true
+		if lt.playEvery > 0 && i%lt.playEvery == 0 {
+			msg = wsMessage{html: []byte(fmt.Sprintf("play %d", i))}
+			keep = false
+			plays++
+		} else {
+			slot := i % soundboardSoundCount
+			latest[slot] = i
+			msg = wsMessage{html: []byte(fmt.Sprintf("slot %d %d", slot, i)), keys: []string{slotKey(slot)}}
+		}
+		began := time.Now()
+		h.broadcast(msg, keep)
+		durations = append(durations, time.Since(began))
+	}
+	elapsed := time.Since(start)
+
+	// give the readers time to catch up, then stop them.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		behind := 0
+		for _, c := range live {
+			behind += c.queued()
+		}
+		if behind == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := h.stats()
+	for _, c := range live {
+		h.leave(c)
+	}
+	wg.Wait()
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p float64) time.Duration {
+		return durations[int(float64(len(durations)-1)*p)]
+	}
+	t.Logf("%d updates to %d clients (%d stalled) in %v", lt.updates, lt.clients+lt.stalled, lt.stalled, elapsed)
+	t.Logf("broadcast p50 %v  p99 %v  max %v", percentile(0.5), percentile(0.99), durations[len(durations)-1])
+
+	if max := durations[len(durations)-1]; max > lt.maxBroadcast {
+		t.Errorf("a broadcast took %v, more than %v", max, lt.maxBroadcast)
+	}
+	// coalescing leaves a stalled client one card per slot and every play,
+	// only more than hubMaxQueue of those gets it disconnected.
+	stalledDropped := plays+soundboardSoundCount > hubMaxQueue
+	for i, c := range stalled {
+		if c.dropped != stalledDropped {
+			t.Errorf("stalled client %d: disconnected %v, want %v", i, c.dropped, stalledDropped)
+			break
+		}
+	}
+	framesSent, coalesced, droppedLive := 0, 0, 0
+	for _, c := range stats.Clients {
+		coalesced += c.Coalesced
+	}
+	for i, c := range live {
+		framesSent += tallies[i].frames
+		if c.dropped {
+			droppedLive++
+			continue
+		}
+		if tallies[i].slots != latest {
+			t.Errorf("client %d ended with slots %v, want %v", i, tallies[i].slots, latest)
+		}
+		if tallies[i].gaps > 0 {
+			t.Errorf("client %d saw %d gaps in the state versions", i, tallies[i].gaps)
+		}
+		if tallies[i].plays != plays {
+			t.Errorf("client %d got %d plays, want %d", i, tallies[i].plays, plays)
+		}
+	}
+	if droppedLive > 0 {
+		t.Errorf("%d reading clients were disconnected for lagging", droppedLive)
+	}
+	t.Logf("frames sent %d  coalesced %d  laggards disconnected %d", framesSent, coalesced, stats.Laggards)
+}
+
+func TestHubUnkeptBroadcast(t *testing.T) {
+	h := newHub()
+	h.broadcast(wsMessage{html: []byte("slot 0 1"), keys: []string{slotKey(0)}}, true)
+	id := h.history.lastID()
+	h.broadcast(wsMessage{html: []byte("<span id=user-count>2</span>"), keys: []string{"user-count"}}, false)
+	if h.history.lastID() != id || h.history.seq != 1 {
+		t.Errorf("expected an unkept broadcast to leave the state version alone, got %s", h.history.lastID())
+	}
+
+	c, ok := h.resume(wsProtocolHTMX, "ws", id)
+	if !ok {
+		t.Fatal("expected to resume from the last kept broadcast")
+	}
+	if frames := c.take(); len(frames) != 0 {
+		t.Errorf("expected nothing to replay, got %d frames", len(frames))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// importMaxRedirects is how many redirects an import follows.
+const importMaxRedirects = 5
+
+// importClient is used for pulling sounds from arbitrary links, so unlike
+// http.DefaultClient it gives up on slow or stalled servers, and it won't
+// connect to anything that isn't on the public internet, so an import can't
+// be used to reach the server's own network. It doesn't go through a proxy,
+// the check has to see the address actually connected to.
+var importClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: refuseNonPublicAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= importMaxRedirects {
+			return fmt.Errorf("[error] stopped after %d redirects", importMaxRedirects)
+		}
+		return nil
+	},
+}
+
+// refuseNonPublicAddress is a net.Dialer Control refusing loopback, private,
+// link-local and other addresses that aren't public. It runs on the resolved
+// address, so a host name pointing at one is refused too, redirects included.
+func refuseNonPublicAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("[error] can't tell where %s is: %v", address, err)
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("[error] %s isn't a public address", ip)
+	}
+	return nil
+}
+
+// fetchSoundFromURL downloads rawURL with client and returns the bytes and the
+// extension they were sniffed as. Anything bigger than maxSize is rejected
+// without reading the rest of the body.
+func fetchSoundFromURL(client *http.Client, rawURL string, maxSize int64) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("[error] %q is not an http(s) url", rawURL)
+	}
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("[error] fetching %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("[error] fetching %s: invalid status code %v", u, resp.StatusCode)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, "", fmt.Errorf("[error] %s is bigger than %d bytes", u, maxSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("[error] reading %s: %v", u, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, "", fmt.Errorf("[error] %s is bigger than %d bytes", u, maxSize)
+	}
+
+	format, err := detectSoundFormat(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("[error] %s: %v", u, err)
+	}
+	return data, format.Ext, nil
+}
+
+// importNameFromURL guesses a sound name from the last path segment, e.g.
+// https://example.com/clips/NoOneHeard.ogg?dl=1 becomes NoOneHeard.
+func importNameFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	base := path.Base(u.Path)
+	if base == "/" || base == "." {
+		return ""
+	}
+	return strings.TrimSuffix(base, path.Ext(base))
+}
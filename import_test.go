@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchSoundFromURL(t *testing.T) {
+	vorbis := testVorbis()
+	const maxSize = 1024
+	done := make(chan struct{})
+	defer close(done)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clips/NoOneHeard.ogg", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(vorbis)
+	})
+	mux.HandleFunc("/missing.ogg", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/redirect.ogg", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/clips/NoOneHeard.ogg", http.StatusFound)
+	})
+	mux.HandleFunc("/page.ogg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/ogg")
+		w.Write([]byte("<!DOCTYPE html><html><body>not a sound</body></html>"))
+	})
+	mux.HandleFunc("/big.ogg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(maxSize+1))
+		w.Write(append(vorbis, make([]byte, maxSize+1-len(vorbis))...))
+	})
+	// chunked, so there's no Content-Length to turn it away by.
+	mux.HandleFunc("/chunked.ogg", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(vorbis)
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, maxSize))
+	})
+	// claims to be too big, it should be turned away before the body is read.
+	mux.HandleFunc("/lying.ogg", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", 100*maxSize, vorbis)
+		buf.Flush()
+	})
+	mux.HandleFunc("/loop.ogg", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop.ogg", http.StatusFound)
+	})
+	mux.HandleFunc("/slow.ogg", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// importClient refuses the loopback server, see TestImportClient.
+	client := &http.Client{Timeout: time.Second, CheckRedirect: importClient.CheckRedirect}
+
+	for _, tt := range []struct {
+		path string
+		err  string // empty if it should be fetched
+	}{
+		{"/clips/NoOneHeard.ogg", ""},
+		{"/redirect.ogg", ""},
+		{"/missing.ogg", "invalid status code 404"},
+		{"/page.ogg", errUnknownFormat.Error()},
+		{"/big.ogg", "bigger than"},
+		{"/chunked.ogg", "bigger than"},
+		{"/lying.ogg", "bigger than"},
+		{"/loop.ogg", "redirects"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			data, ext, err := fetchSoundFromURL(client, server.URL+tt.path, maxSize)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil || ext != ".ogg" || !bytes.Equal(data, vorbis) {
+				t.Errorf("expected the sound as .ogg, got %d bytes as %q, %v", len(data), ext, err)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		client := &http.Client{Timeout: 50 * time.Millisecond}
+		if _, _, err := fetchSoundFromURL(client, server.URL+"/slow.ogg", maxSize); err == nil {
+			t.Error("expected a stalled server to time out")
+		}
+	})
+	t.Run("not http", func(t *testing.T) {
+		for _, rawURL := range []string{"file:///etc/passwd", "ftp://example.com/a.ogg", "/relative.ogg", "http://"} {
+			if _, _, err := fetchSoundFromURL(client, rawURL, maxSize); err == nil {
+				t.Errorf("expected %q to be refused", rawURL)
+			}
+		}
+	})
+}
+
+func TestImportClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testVorbis())
+	}))
+	defer server.Close()
+	if _, _, err := fetchSoundFromURL(importClient, server.URL+"/NoOneHeard.ogg", 1024); err == nil || !strings.Contains(err.Error(), "public address") {
+		t.Errorf("expected a server on loopback to be refused, got %v", err)
+	}
+
+	for address, public := range map[string]bool{
+		"93.184.215.14:443":         true,
+		"[2606:2800:21f::1]:443":    true,
+		"127.0.0.1:80":              false,
+		"[::1]:80":                  false,
+		"10.0.0.1:80":               false,
+		"172.16.5.4:80":             false,
+		"192.168.1.1:80":            false,
+		"169.254.169.254:80":        false, // cloud metadata
+		"[fe80::1]:80":              false,
+		"[fd00::1]:80":              false,
+		"0.0.0.0:80":                false,
+		"[::ffff:127.0.0.1]:80":     false,
+		"[::ffff:93.184.215.14]:80": true,
+	} {
+		if err := refuseNonPublicAddress("tcp", address, nil); (err == nil) != public {
+			t.Errorf("%s: expected public to be %v, got %v", address, public, err)
+		}
+	}
+}
+
+func TestImportNameFromURL(t *testing.T) {
+	for rawURL, name := range map[string]string{
+		"https://example.com/clips/NoOneHeard.ogg?dl=1":  "NoOneHeard",
+		"https://example.com/clips/No%20One%20Heard.mp3": "No One Heard",
+		"https://example.com/clips/NoOneHeard":           "NoOneHeard",
+		"https://example.com/":                           "",
+		"https://example.com":                            "",
+	} {
+		if got := importNameFromURL(rawURL); got != name {
+			t.Errorf("%s: expected %q, got %q", rawURL, name, got)
+		}
+	}
+}
@@ -73,6 +73,18 @@ const iconLoad = (el: any, iconType: any) => {
                         <line x1="5" y1="12" x2="19" y2="12"></line>
                     </svg>`;
             break;
+        case 'rename':
+            iconSvg = `<svg class="h-6 w-6" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round">  <path d="M12 20h9" />  <path d="M16.5 3.5a2.121 2.121 0 0 1 3 3L7 19l-4 1 1-4L16.5 3.5z" /></svg>`
+            break;
+        case 'folder':
+            iconSvg = `<svg class="h-6 w-6" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round">  <path d="M22 19a2 2 0 0 1-2 2H4a2 2 0 0 1-2-2V5a2 2 0 0 1 2-2h5l2 3h9a2 2 0 0 1 2 2z" /></svg>`
+            break;
+        case 'scissors':
+            iconSvg = `<svg class="h-6 w-6" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round">  <circle cx="6" cy="6" r="3" />  <circle cx="6" cy="18" r="3" />  <line x1="20" y1="4" x2="8.12" y2="15.88" />  <line x1="14.47" y1="14.48" x2="20" y2="20" />  <line x1="8.12" y1="8.12" x2="12" y2="12" /></svg>`
+            break;
+        case 'trash':
+            iconSvg = `<svg class="h-6 w-6" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round">  <polyline points="3 6 5 6 21 6" />  <path d="M19 6v14a2 2 0 0 1-2 2H7a2 2 0 0 1-2-2V6m3 0V4a2 2 0 0 1 2-2h4a2 2 0 0 1 2 2v2" /></svg>`
+            break;
         default:
             break;
     }
@@ -112,7 +124,7 @@ const playSound = (elId: any, soundId: string, sent: boolean) => {
     if (playingAudio[soundId]) {
         playingAudio[soundId].pause();
     }
-    const audio = new Audio(`https://cdn.discordapp.com/soundboard-sounds/${soundId}`);
+    const audio = new Audio(`/cdn/soundboard-sounds/${soundId}`);
     playingAudio[soundId] = audio;
     let el = undefined;
     if (elId) {
@@ -130,6 +142,19 @@ const playSound = (elId: any, soundId: string, sent: boolean) => {
     });
 }
 
+// previewLibrarySound plays a stored sound from the server, for sounds that
+// aren't on the board and so aren't on the CDN.
+const previewLibrarySound = (audioURL: string) => {
+    if (playingAudio[audioURL]) {
+        playingAudio[audioURL].pause();
+    }
+    const audio = new Audio(audioURL);
+    playingAudio[audioURL] = audio;
+    if (!muted.state) {
+        audio.play();
+    }
+}
+
 const muteSounds = (ev: any) => {
     muted.update(ev.target.checked)
 }
@@ -164,6 +189,37 @@ const dragEnd = () => {
     })
 }
 
+const uploadSound = async (file: File, slot?: string) => {
+    const status = document.querySelector('#upload-status');
+    const body = new FormData();
+    body.append('sound', file);
+    if (slot !== undefined) {
+        body.append('slot', slot);
+    }
+    const resp = await fetch('/upload', { method: 'POST', body });
+    if (status) {
+        status.textContent = await resp.text();
+    }
+}
+
+const makeUploadDropzone = (el: any) => {
+    el.addEventListener('dragover', (event: any) => {
+        if (event.dataTransfer?.types.includes('Files')) {
+            event.preventDefault();
+        }
+    });
+    el.addEventListener('drop', (event: any) => {
+        const files: FileList | undefined = event.dataTransfer?.files;
+        if (!files || files.length === 0) {
+            return;
+        }
+        event.preventDefault();
+        for (const file of Array.from(files)) {
+            uploadSound(file);
+        }
+    });
+}
+
 const makeDroppable = (el: any) => {
     const target = el;
     target.addEventListener('dragover', (event: any) => {
@@ -177,15 +233,21 @@ const makeDroppable = (el: any) => {
         while (!target.classList.contains('droppable')) {
             target = target.parentNode;
         }
+        // files dropped straight from the desktop go into this slot.
+        const files: FileList | undefined = event.dataTransfer?.files;
+        if (files && files.length > 0) {
+            const slot = target.id.replace('soundboard-', '');
+            uploadSound(files[0], slot);
+            return;
+        }
         if (dragged !== null && target.classList.contains('droppable')) {
 
-            const soundLocation = dragged.getAttribute('data-soundname');
-            const soundExtension = dragged.getAttribute('data-soundext');
-            if (soundLocation && soundExtension) {
+            const soundLocation = dragged.getAttribute('data-soundlocation');
+            if (soundLocation) {
                 const soundID = target.getAttribute('data-soundid');
                 const body: any = {
                     add: {
-                        soundLocation: (soundLocation + soundExtension)
+                        soundLocation,
                     }
                 };
                 if (soundID != null && soundID !== '') {
@@ -223,15 +285,153 @@ const addSoundUpdates = (hiddenSounds: any, hasEmpty: boolean) => {
         } else {
             el.classList.remove('hidden');
         }
-        disableFn(el.querySelector('button'));
+        disableFn(el.querySelector('.add-sound-button'));
     });
 }
 
+let previewAudio: HTMLAudioElement | null = null;
+
+const editSound = (soundLocation: string | null) => {
+    const form = document.querySelector<HTMLFormElement>('#clip-editor');
+    if (!form) {
+        return;
+    }
+    if (soundLocation === null) {
+        form.classList.add('hidden');
+        return;
+    }
+    form.reset();
+    (form.elements.namedItem('soundLocation') as HTMLInputElement).value = soundLocation;
+    const name = document.querySelector('#clip-editor-name');
+    if (name) {
+        name.textContent = soundLocation;
+    }
+    form.classList.remove('hidden');
+    form.scrollIntoView({ behavior: 'smooth', block: 'center' });
+}
+
+const previewEdit = () => {
+    const form = document.querySelector<HTMLFormElement>('#clip-editor');
+    if (!form) {
+        return;
+    }
+    const params = new URLSearchParams(new FormData(form) as any);
+    if (previewAudio) {
+        previewAudio.pause();
+    }
+    previewAudio = new Audio(`/library/edit/preview?${params}`);
+    previewAudio.play();
+}
+
+// applyFragments swaps in an update from /events the way the ws extension
+// does: every top level element replaces the one with the same id.
+const applyFragments = (html: string) => {
+    const template = document.createElement('template');
+    template.innerHTML = html;
+    for (const fragment of Array.from(template.content.children)) {
+        const current = fragment.id ? document.getElementById(fragment.id) : null;
+        if (!current) {
+            continue;
+        }
+        current.replaceWith(fragment);
+        // scripts parsed with innerHTML never run, fresh ones do.
+        for (const script of Array.from(fragment.querySelectorAll('script'))) {
+            const runnable = document.createElement('script');
+            runnable.textContent = script.textContent;
+            script.replaceWith(runnable);
+        }
+        (window as any).htmx.process(fragment);
+    }
+}
+
+// Every update says which state version it brings the board to and which
+// one it expects the board to be at, 0 for a snapshot that starts it over.
+// When the board is behind what an update expects, one went missing and the
+// page asks for the whole board again, ignoring updates until it arrives.
+// The page comes rendered at a version and the websocket resumes from it, so
+// after a reconnect it replays updates the board already has, those are
+// skipped.
+const stateVersionPattern = /<div id="state-version" hidden data-version="(\d+)" data-prev="(\d+)">/;
+let stateVersion = Number(document.getElementById('state-version')?.dataset.version ?? 0);
+let awaitingSnapshot = false;
+const sequence = (html: string): 'apply' | 'seen' | 'gap' => {
+    const match = stateVersionPattern.exec(html);
+    if (!match) {
+        return 'apply';
+    }
+    const version = Number(match[1]);
+    const prev = Number(match[2]);
+    if (prev !== 0 && (awaitingSnapshot || prev > stateVersion)) {
+        return 'gap';
+    }
+    // plays don't move the version, prev is the version they're at.
+    if (prev !== 0 && prev < version && version <= stateVersion) {
+        return 'seen';
+    }
+    stateVersion = version;
+    awaitingSnapshot = false;
+    return 'apply';
+}
+document.addEventListener('htmx:wsBeforeMessage', (event: any) => {
+    const next = sequence(event.detail.message);
+    if (next === 'apply') {
+        return;
+    }
+    event.preventDefault();
+    if (next === 'gap' && !awaitingSnapshot) {
+        awaitingSnapshot = true;
+        event.detail.socketWrapper.send(JSON.stringify({ type: 'snapshot_request' }));
+    }
+});
+
+// Some proxies refuse the websocket upgrade, so after a couple of failed
+// attempts the board follows /events instead. The ws extension keeps
+// retrying and /events is dropped again once it gets through.
+const wsFailuresBeforeFallback = 2;
+let wsFailures = 0;
+let eventSource: EventSource | undefined;
+const closeEventSource = () => {
+    if (eventSource) {
+        eventSource.close();
+        eventSource = undefined;
+    }
+}
+// openEventSource starts from a snapshot, /events can't be asked for one
+// once it's going.
+const openEventSource = () => {
+    closeEventSource();
+    eventSource = new EventSource('/events');
+    eventSource.onmessage = (event) => {
+        const next = sequence(event.data);
+        if (next === 'gap') {
+            openEventSource();
+            return;
+        }
+        if (next === 'apply') {
+            applyFragments(event.data);
+        }
+    };
+}
+document.addEventListener('htmx:wsOpen', () => {
+    wsFailures = 0;
+    closeEventSource();
+});
+document.addEventListener('htmx:wsClose', () => {
+    wsFailures++;
+    if (wsFailures < wsFailuresBeforeFallback || eventSource) {
+        return;
+    }
+    openEventSource();
+});
+
 (window as any)._makeDraggable = makeDraggable;
+(window as any)._editSound = editSound;
+(window as any)._previewEdit = previewEdit;
 (window as any)._makeDroppable = makeDroppable;
+(window as any)._makeUploadDropzone = makeUploadDropzone;
 // TODO this is pretty much the same as play sound
 (window as any)._highlightSound = (elId: any, soundId: string) => {
-    const audio = new Audio(`https://cdn.discordapp.com/soundboard-sounds/${soundId}`);
+    const audio = new Audio(`/cdn/soundboard-sounds/${soundId}`);
     let el = undefined;
     if (elId) {
         el = document.querySelector('#' + elId);
@@ -243,6 +443,7 @@ const addSoundUpdates = (hiddenSounds: any, hasEmpty: boolean) => {
     });
 };
 (window as any)._playSound = playSound;
+(window as any)._previewLibrarySound = previewLibrarySound;
 (window as any)._muteSounds = muteSounds;
 (window as any)._playSendSounds = playSendSounds;
 (window as any)._iconLoad = iconLoad;
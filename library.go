@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// soundMetadataFile lives next to the sounds and holds anything we know about a
+// stored sound that can't be read back from the file itself.
+const soundMetadataFile = ".metadata.json"
+
+type SoundMetadata struct {
+	Tags       []string `json:"tags,omitempty"`
+	Uploader   string   `json:"uploader,omitempty"`
+	UploaderID string   `json:"uploader_id,omitempty"`
+	Source     string   `json:"source,omitempty"` // "discord", "upload", "url" or "edit"
+	SourceURL  string   `json:"source_url,omitempty"`
+	EditedFrom string   `json:"edited_from,omitempty"`
+	// SourceHash is the hash of the sound as it came in, before any
+	// transcoding, so the same upload or board sound is still recognized.
+	SourceHash string    `json:"source_hash,omitempty"`
+	SavedAt    time.Time `json:"saved_at,omitempty"`
+	Loudness   *float64  `json:"loudness_lufs,omitempty"`
+	// Fingerprint is the sound's acoustic fingerprint, see fingerprint.go.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// soundMetadataStore is keyed the same way as storedSoundMap, by name without
+// the extension.
+type soundMetadataStore struct {
+	mu      sync.RWMutex
+	path    string
+	entries map[string]SoundMetadata
+}
+
+func loadSoundMetadata(dir string) (*soundMetadataStore, error) {
+	store := &soundMetadataStore{
+		path:    path.Join(dir, soundMetadataFile),
+		entries: make(map[string]SoundMetadata),
+	}
+	data, err := os.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.entries); err != nil {
+		return nil, fmt.Errorf("[error] parsing %s: %v", store.path, err)
+	}
+	return store, nil
+}
+
+func (s *soundMetadataStore) Get(name string) SoundMetadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries[name]
+}
+
+func (s *soundMetadataStore) Set(name string, metadata SoundMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[name] = metadata
+	return s.save()
+}
+
+// Update runs change on every entry and saves once, for changing a lot of
+// sounds at a time.
+func (s *soundMetadataStore) Update(change func(entries map[string]SoundMetadata)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change(s.entries)
+	return s.save()
+}
+
+func (s *soundMetadataStore) Rename(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata, ok := s.entries[oldName]
+	if !ok {
+		return nil
+	}
+	delete(s.entries, oldName)
+	s.entries[newName] = metadata
+	return s.save()
+}
+
+func (s *soundMetadataStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, name)
+	return s.save()
+}
+
+// save expects s.mu to be held.
+func (s *soundMetadataStore) save() error {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func soundHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashStoredSounds maps the hash of every stored sound, and the hash of what it
+// was saved from, to the names with that audio. More than one name means
+// the library has duplicates.
+func hashStoredSounds(storedSoundMap map[string][]byte, metadata *soundMetadataStore) map[string][]string {
+	hashes := make(map[string][]string, len(storedSoundMap))
+	for name, data := range storedSoundMap {
+		hash := soundHash(data)
+		hashes[hash] = append(hashes[hash], name)
+		if source := metadata.Get(name).SourceHash; source != "" && source != hash {
+			hashes[source] = append(hashes[source], name)
+		}
+	}
+	for _, names := range hashes {
+		sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+	}
+	return hashes
+}
+
+// duplicateOf returns the name name duplicates, or "" if it's unique. The first
+// name alphabetically is treated as the original.
+func duplicateOf(name string, data []byte, hashes map[string][]string) string {
+	names := hashes[soundHash(data)]
+	if len(names) < 2 || names[0] == name {
+		return ""
+	}
+	return names[0]
+}
+
+// rerunner runs one pass over the library at a time. A pass asked for while
+// one is running isn't dropped, it runs once that one is done, and of several
+// asked for only the latest does since it has the newest library.
+type rerunner struct {
+	mu      sync.Mutex
+	running bool
+	next    func()
+}
+
+// Run runs pass, or leaves it for the goroutine that's already running one.
+func (r *rerunner) Run(pass func()) {
+	r.mu.Lock()
+	if r.running {
+		r.next = pass
+		r.mu.Unlock()
+		return
+	}
+	r.running = true
+	r.mu.Unlock()
+
+	for pass != nil {
+		pass()
+		r.mu.Lock()
+		pass, r.next = r.next, nil
+		r.running = pass != nil
+		r.mu.Unlock()
+	}
+}
+
+// soundHashCache remembers the hash of board sounds by ID. A soundboard sound's
+// audio can't change, so entries never go stale.
+type soundHashCache struct {
+	mu     sync.RWMutex
+	hashes map[string]string
+	// generation goes up whenever a hash is added, see matchInputs.
+	generation atomic.Uint64
+}
+
+func newSoundHashCache() *soundHashCache {
+	return &soundHashCache{hashes: make(map[string]string)}
+}
+
+func (c *soundHashCache) Get(soundID string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	hash, ok := c.hashes[soundID]
+	return hash, ok
+}
+
+func (c *soundHashCache) Set(soundID, hash string) {
+	c.mu.Lock()
+	if c.hashes[soundID] != hash {
+		c.hashes[soundID] = hash
+		c.generation.Add(1)
+	}
+	c.mu.Unlock()
+}
+
+func (c *soundHashCache) Generation() uint64 {
+	return c.generation.Load()
+}
+
+// Discord rejects soundboard sound names outside of these lengths.
+const (
+	minSoundNameLength = 2
+	maxSoundNameLength = 32
+)
+
+func validateSoundName(name string) error {
+	if name != strings.TrimSpace(name) {
+		return fmt.Errorf("[error] sound name %q has leading or trailing spaces", name)
+	}
+	if n := utf8.RuneCountInString(name); n < minSoundNameLength || n > maxSoundNameLength {
+		return fmt.Errorf("[error] sound name %q must be between %d and %d characters", name, minSoundNameLength, maxSoundNameLength)
+	}
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("[error] sound name %q can't contain slashes or start with a dot", name)
+	}
+	return nil
+}
+
+// libraryPath resolves a location relative to soundsDir, refusing absolute
+// locations and any that go up a level or into a hidden directory like the
+// trash.
+func libraryPath(location string) (string, error) {
+	slashed := filepath.ToSlash(location)
+	if location == "" || path.IsAbs(slashed) || filepath.IsAbs(location) || filepath.VolumeName(location) != "" {
+		return "", fmt.Errorf("[error] invalid sound location %q", location)
+	}
+	// ".." starts with a dot too.
+	for _, part := range strings.Split(slashed, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("[error] invalid sound location %q", location)
+		}
+	}
+	cleaned := path.Clean("/" + slashed)
+	if cleaned == "/" {
+		return "", fmt.Errorf("[error] invalid sound location %q", location)
+	}
+	return filepath.Join(soundsDir, filepath.FromSlash(cleaned)), nil
+}
+
+// libraryAudioURL is where the browser can fetch the sound at location (with
+// its extension), escaped segment by segment so folders keep their slashes.
+// Quotes are escaped too so it can go straight into inline scripts.
+func libraryAudioURL(location string) string {
+	parts := strings.Split(location, "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(url.PathEscape(part), "'", "%27")
+	}
+	return "/library/audio/" + strings.Join(parts, "/")
+}
+
+// renameStoredSound renames the sound at location in place, keeping its folder
+// and extension, and returns the new location.
+func renameStoredSound(location, newName string) (string, error) {
+	if err := validateSoundName(newName); err != nil {
+		return "", err
+	}
+	ext := path.Ext(location)
+	newLocation := path.Join(path.Dir(location), newName+ext)
+	return newLocation, moveLibraryFile(location, newLocation)
+}
+
+// moveStoredSound moves the sound at location into folder, which is relative
+// to soundsDir. An empty folder moves it back to the top level.
+func moveStoredSound(location, folder string) (string, error) {
+	newLocation := path.Base(location)
+	if folder = strings.Trim(folder, "/"); folder != "" {
+		newLocation = path.Join(folder, newLocation)
+	}
+	return newLocation, moveLibraryFile(location, newLocation)
+}
+
+func moveLibraryFile(location, newLocation string) error {
+	from, err := libraryPath(location)
+	if err != nil {
+		return err
+	}
+	to, err := libraryPath(newLocation)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(from); err != nil {
+		return fmt.Errorf("[error] sound %s does not exist", location)
+	}
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("[error] sound %s already exists", newLocation)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+type soundSearchEntry struct {
+	file     string // file name with extension, as in storedSounds
+	name     string
+	uploader string
+	tags     []string
+}
+
+// soundSearchIndex is rebuilt whenever the stored sounds change so searches
+// never have to touch the disk.
+type soundSearchIndex struct {
+	mu      sync.RWMutex
+	entries []soundSearchEntry
+}
+
+func (idx *soundSearchIndex) Rebuild(storedSounds []string, metadata *soundMetadataStore) {
+	entries := make([]soundSearchEntry, 0, len(storedSounds))
+	for _, storedSound := range storedSounds {
+		name := path.Base(strings.TrimSuffix(storedSound, filepath.Ext(storedSound)))
+		md := metadata.Get(name)
+		tags := make([]string, 0, len(md.Tags))
+		for _, tag := range md.Tags {
+			tags = append(tags, strings.ToLower(tag))
+		}
+		entries = append(entries, soundSearchEntry{
+			file:     storedSound,
+			name:     strings.ToLower(name),
+			uploader: strings.ToLower(md.Uploader),
+			tags:     tags,
+		})
+	}
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.mu.Unlock()
+}
+
+// Search returns the stored sound files matching query, best match first.
+func (idx *soundSearchIndex) Search(query string) []string {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil
+	}
+
+	type result struct {
+		file  string
+		score int
+	}
+	results := []result{}
+
+	idx.mu.RLock()
+	for _, entry := range idx.entries {
+		best, matched := fuzzyScore(query, entry.name)
+		// names are what people usually look for, so they win ties against
+		// the uploader and tags.
+		best *= 2
+		if score, ok := fuzzyScore(query, entry.uploader); ok {
+			matched = true
+			best = max(best, score)
+		}
+		for _, tag := range entry.tags {
+			if score, ok := fuzzyScore(query, tag); ok {
+				matched = true
+				best = max(best, score)
+			}
+		}
+		if matched {
+			results = append(results, result{file: entry.file, score: best})
+		}
+	}
+	idx.mu.RUnlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return strings.ToLower(results[i].file) < strings.ToLower(results[j].file)
+	})
+
+	files := make([]string, 0, len(results))
+	for _, r := range results {
+		files = append(files, r.file)
+	}
+	return files
+}
+
+// fuzzyScore reports whether every rune of query appears in target in order.
+// Substrings beat scattered matches, prefixes beat both, and consecutive runs
+// are rewarded so "nhrd" still finds "NoOneHeard" but ranks below "noone".
+// Both arguments are expected to already be lower case.
+func fuzzyScore(query, target string) (int, bool) {
+	if target == "" {
+		return 0, false
+	}
+	if strings.HasPrefix(target, query) {
+		return 1000 - len(target), true
+	}
+	if strings.Contains(target, query) {
+		return 500 - len(target), true
+	}
+
+	score := 0
+	run := 0
+	q := []rune(query)
+	qi := 0
+	for _, r := range target {
+		if qi == len(q) {
+			break
+		}
+		if r == q[qi] {
+			qi++
+			run++
+			score += run
+		} else {
+			run = 0
+		}
+	}
+	if qi != len(q) {
+		return 0, false
+	}
+	return score, true
+}
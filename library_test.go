@@ -0,0 +1,168 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRerunner(t *testing.T) {
+	var r rerunner
+	started, release := make(chan struct{}), make(chan struct{})
+	var ran []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(func() {
+			close(started)
+			<-release
+			ran = append(ran, "first")
+		})
+	}()
+
+	<-started
+	// both come in during the first pass and return straight away, only the
+	// later one is worth running.
+	r.Run(func() { ran = append(ran, "second") })
+	r.Run(func() { ran = append(ran, "third") })
+	close(release)
+	<-done
+
+	if len(ran) != 2 || ran[0] != "first" || ran[1] != "third" {
+		t.Errorf("expected the first pass and then the latest, got %v", ran)
+	}
+
+	r.Run(func() { ran = append(ran, "fourth") })
+	if len(ran) != 3 {
+		t.Errorf("expected a pass to run straight away once the last one's done, got %v", ran)
+	}
+}
+
+func TestDuplicateOf(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = t.TempDir()
+	defer func() { soundsDir = oldSoundsDir }()
+	metadata, err := loadSoundMetadata(soundsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	airhorn, other := testVorbis(), testOpus()
+	storedSoundMap := map[string][]byte{
+		"airhorn":      airhorn,
+		"Airhorn copy": airhorn, // renamed, but the same audio
+		"horn":         airhorn,
+		"other":        other,
+	}
+	hashes := hashStoredSounds(storedSoundMap, metadata)
+	for name, want := range map[string]string{
+		// the first name alphabetically is the original.
+		"airhorn":      "",
+		"Airhorn copy": "airhorn",
+		"horn":         "airhorn",
+		"other":        "",
+	} {
+		if got := duplicateOf(name, storedSoundMap[name], hashes); got != want {
+			t.Errorf("%s: expected it to duplicate %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	for _, tt := range []struct {
+		query, better, worse string
+	}{
+		{"air", "airhorn", "hotair"},            // prefix over substring
+		{"horn", "hornet", "airhorn"},           // both prefixes, shorter wins
+		{"horn", "airhorn", "highnoonbrewing"},  // substring over scattered
+		{"noone", "noone", "noone heard"},       // both prefixes, shorter wins
+		{"nohe", "noheadphones", "noone heard"}, // prefix over scattered
+		{"nhrd", "no one hrd", "nothing heard"}, // runs beat scattered letters
+	} {
+		better, ok := fuzzyScore(tt.query, tt.better)
+		if !ok {
+			t.Errorf("expected %q to match %q", tt.query, tt.better)
+		}
+		worse, ok := fuzzyScore(tt.query, tt.worse)
+		if !ok {
+			t.Errorf("expected %q to match %q", tt.query, tt.worse)
+		}
+		if better <= worse {
+			t.Errorf("expected %q to rank %q (%d) over %q (%d)", tt.query, tt.better, better, tt.worse, worse)
+		}
+	}
+	for _, target := range []string{"", "hron", "air"} {
+		if score, ok := fuzzyScore("horn", target); ok {
+			t.Errorf("expected %q not to match, got %d", target, score)
+		}
+	}
+}
+
+func TestSoundSearchIndex(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = t.TempDir()
+	defer func() { soundsDir = oldSoundsDir }()
+	metadata, err := loadSoundMetadata(soundsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Set("Bruh", SoundMetadata{Tags: []string{"Meme"}})
+	metadata.Set("Airhorn", SoundMetadata{Uploader: "NoOne"})
+
+	var idx soundSearchIndex
+	idx.Rebuild([]string{"Airhorn.mp3", "Bruh.ogg", "NoOneHeard.ogg", "memes/noone.ogg", "Bananas.ogg", "Bark.ogg"}, metadata)
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		// the shorter prefix first, then the uploader's, which only count
+		// half as much as a name.
+		{"NOONE", []string{"memes/noone.ogg", "NoOneHeard.ogg", "Airhorn.mp3"}},
+		{"  noone  ", []string{"memes/noone.ogg", "NoOneHeard.ogg", "Airhorn.mp3"}},
+		{"nhrd", []string{"NoOneHeard.ogg"}},
+		{"meme", []string{"Bruh.ogg"}},
+		// equal scores go alphabetically.
+		{"b", []string{"Bark.ogg", "Bruh.ogg", "Bananas.ogg"}},
+		{"zzz", []string{}},
+		{"", nil},
+	} {
+		got := idx.Search(tt.query)
+		if !slices.Equal(got, tt.want) || (tt.want == nil) != (got == nil) {
+			t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestLibraryPath(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = "/srv/sounds"
+	defer func() { soundsDir = oldSoundsDir }()
+
+	for location, want := range map[string]string{
+		"NoOneHeard.ogg":        "/srv/sounds/NoOneHeard.ogg",
+		"memes/NoOneHeard.ogg":  "/srv/sounds/memes/NoOneHeard.ogg",
+		"memes//NoOneHeard.ogg": "/srv/sounds/memes/NoOneHeard.ogg",
+		"":                      "",
+		"/":                     "",
+		"memes/":                "/srv/sounds/memes",
+		"../secrets.ogg":        "",
+		"memes/../../x.ogg":     "",
+		"memes/..":              "",
+		"/etc/passwd":           "",
+		"/srv/sounds/a.ogg":     "",
+		".trash/1/a.ogg":        "",
+		"memes/.hidden.ogg":     "",
+		"./a.ogg":               "",
+	} {
+		p, err := libraryPath(location)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%q: expected it to be refused, got %s", location, p)
+			}
+			continue
+		}
+		if err != nil || p != filepath.FromSlash(want) {
+			t.Errorf("%q: expected %s, got %s, %v", location, want, p, err)
+		}
+	}
+}
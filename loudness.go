@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// LoudnessMeter measures integrated loudness in LUFS, as in EBU R128.
+type LoudnessMeter interface {
+	IntegratedLoudness(data []byte) (float64, error)
+}
+
+// gainApplier is implemented by transcoders that can bake a gain into a copy
+// of a sound.
+type gainApplier interface {
+	ApplyGain(data []byte, ext string, gainDB float64) ([]byte, string, error)
+}
+
+const (
+	loudnessModeOff    = ""
+	loudnessModeVolume = "volume" // set the soundboard sound's volume
+	loudnessModeGain   = "gain"   // upload a copy with the gain applied
+)
+
+var (
+	loudnessMode   = loudnessModeOff
+	loudnessTarget = -18.0 // LUFS
+	loudnessMeter  LoudnessMeter
+	loudnessGainer gainApplier
+)
+
+var ebur128IntegratedRegexp = regexp.MustCompile(`I:\s+(-?[0-9.]+|-inf) LUFS`)
+
+// IntegratedLoudness runs the sound through ffmpeg's ebur128 filter and reads
+// the integrated loudness out of its summary.
+func (t *ffmpegTranscoder) IntegratedLoudness(data []byte) (float64, error) {
+	_, stderr, err := t.exec(data, "-af", "ebur128=framelog=quiet", "-f", "null", "-")
+	if err != nil {
+		return 0, err
+	}
+	matches := ebur128IntegratedRegexp.FindAllSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return 0, errors.New("[error] ffmpeg didn't report a loudness")
+	}
+	// the summary comes last, after any per-frame lines.
+	value := string(matches[len(matches)-1][1])
+	if value == "-inf" {
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func (t *ffmpegTranscoder) ApplyGain(data []byte, ext string, gainDB float64) ([]byte, string, error) {
+	return t.run(data, "-af", fmt.Sprintf("volume=%.2fdB", gainDB), "-c:a", t.format.codec, "-b:a", t.bitrate)
+}
+
+// loudnessGain is how many dB a sound measured at loudness needs to reach
+// loudnessTarget. Silent sounds are left alone.
+func loudnessGain(loudness float64) float64 {
+	if math.IsInf(loudness, 0) || math.IsNaN(loudness) {
+		return 0
+	}
+	return loudnessTarget - loudness
+}
+
+// loudnessVolume turns a gain into Discord's per-sound volume. Discord can only
+// turn sounds down, so quiet ones stay at full volume.
+func loudnessVolume(gainDB float64) float64 {
+	return math.Min(1, math.Pow(10, gainDB/20))
+}
+
+// soundLoudness returns the stored loudness for name, measuring and saving it
+// first if we don't have it yet.
+func soundLoudness(name string, data []byte, metadata *soundMetadataStore) (float64, error) {
+	md := metadata.Get(name)
+	if md.Loudness != nil {
+		return *md.Loudness, nil
+	}
+	if loudnessMeter == nil {
+		return 0, errors.New("[error] no loudness meter configured")
+	}
+	loudness, err := loudnessMeter.IntegratedLoudness(data)
+	if err != nil {
+		return 0, err
+	}
+	// json can't hold -inf, and silence doesn't need normalizing anyway.
+	if !math.IsInf(loudness, 0) {
+		md = metadata.Get(name)
+		md.Loudness = &loudness
+		if err := metadata.Set(name, md); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save loudness for %s: %v\n", name, err)
+		}
+	}
+	return loudness, nil
+}
+
+var loudnessRuns rerunner
+
+// loudnessSaveEvery is how many measurements measureLibraryLoudness keeps
+// before saving them, so a big library isn't rewritten for every sound.
+const loudnessSaveEvery = 50
+
+// measureLibraryLoudness fills in the loudness of every stored sound that
+// doesn't have one yet, in the background. Only one runs at a time, a call
+// made during one runs after it.
+func measureLibraryLoudness(storedSoundMap map[string][]byte, metadata *soundMetadataStore) {
+	if loudnessMeter == nil {
+		return
+	}
+	go loudnessRuns.Run(func() { measureLibraryLoudnessPass(storedSoundMap, metadata) })
+}
+
+func measureLibraryLoudnessPass(storedSoundMap map[string][]byte, metadata *soundMetadataStore) {
+	measured := make(map[string]float64)
+	save := func() {
+		if len(measured) == 0 {
+			return
+		}
+		err := metadata.Update(func(entries map[string]SoundMetadata) {
+			for name, loudness := range measured {
+				md := entries[name]
+				md.Loudness = &loudness
+				entries[name] = md
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save loudness: %v\n", err)
+		}
+		clear(measured)
+	}
+	defer save()
+
+	for name, data := range storedSoundMap {
+		if metadata.Get(name).Loudness != nil {
+			continue
+		}
+		loudness, err := loudnessMeter.IntegratedLoudness(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] measuring loudness of %s: %v\n", name, err)
+			continue
+		}
+		// json can't hold -inf, and silence doesn't need normalizing anyway.
+		if math.IsInf(loudness, 0) {
+			continue
+		}
+		measured[name] = loudness
+		if len(measured) >= loudnessSaveEvery {
+			save()
+		}
+	}
+}
+
+// normalizeSoundboardSound works out how to play data at loudnessTarget,
+// returning the (possibly re-encoded) sound and the volume to upload it with.
+func normalizeSoundboardSound(name string, data []byte, ext string, metadata *soundMetadataStore) ([]byte, string, float64) {
+	if loudnessMode == loudnessModeOff {
+		return data, ext, 1
+	}
+	loudness, err := soundLoudness(name, data, metadata)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] couldn't normalize %s: %v\n", name, err)
+		return data, ext, 1
+	}
+	gain := loudnessGain(loudness)
+
+	if loudnessMode == loudnessModeGain && math.Abs(gain) >= 0.5 {
+		gained, gainedExt, err := loudnessGainer.ApplyGain(data, ext, gain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] couldn't apply %.1fdB to %s: %v\n", gain, name, err)
+			return data, ext, 1
+		}
+		// the applied gain can push it back over the size limit.
+		if len(gained) <= maxSoundboardSize || len(data) > maxSoundboardSize {
+			return gained, gainedExt, 1
+		}
+		fmt.Fprintf(os.Stderr, "[warn] %s is too large after applying gain, using volume instead\n", name)
+	}
+	return data, ext, loudnessVolume(gain)
+}
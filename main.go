@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -84,45 +88,61 @@ const soundboardSoundCount = 8
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  32 * 1024,
 	WriteBufferSize: 32 * 1024,
-} // use default options
+	Subprotocols:    []string{wsProtocolJSON, wsProtocolHTMX},
+}
 
-func deleteButton(soundId, guildId, username, avatarCDN string, disabled bool) string {
+func deleteButton(soundId, guildId, username, avatarSrc string, disabled bool) string {
 	textColor := "text-rose-400"
 	disabledProp := ""
 	hiddenTooltip := ""
 	if disabled {
 		disabledProp = "disabled"
 		textColor = "text-gray-400"
-		hiddenTooltip = uploadedByComponent(username, avatarCDN)
+		hiddenTooltip = uploadedByComponent(username, avatarSrc)
 	}
 
 	return fmt.Sprintf(`<button hx-on="htmx:beforeProcessNode: window._iconLoad(this, 'minus')" class="flex flex-1 peer items-center justify-center mt-1 %s" hx-delete="/delete-sound?soundID=%s&guildID=%s" %s></button>%s`, textColor, soundId, guildId, disabledProp, hiddenTooltip)
 }
 
+// fetchStoredSounds returns every sound under soundsDir as a location relative
+// to it, including ones in folders. Hidden directories like the trash are
+// skipped.
 func fetchStoredSounds() ([]string, map[string][]byte, error) {
-	files, err := os.ReadDir(soundsDir)
-	if err != nil {
-		panic(err)
-	}
-	sort.Slice(files, func(i, j int) bool { return strings.ToLower(files[i].Name()) < strings.ToLower(files[j].Name()) })
-
 	storedSounds := []string{}
-	storedSoundMap := make(map[string][]byte) // these won't contain the extension
-	for _, f := range files {
-		ext := path.Ext(f.Name())
+	storedSoundMap := make(map[string][]byte) // these won't contain the extension or folder
+	err := filepath.WalkDir(soundsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != soundsDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := path.Ext(d.Name())
 		if ext != ".ogg" && ext != ".mp3" {
-			continue
+			return nil
+		}
+		rel, err := filepath.Rel(soundsDir, p)
+		if err != nil {
+			return err
 		}
-		nameWithoutExt := strings.TrimSuffix(f.Name(), ext)
-		storedSounds = append(storedSounds, f.Name())
-		data, err := os.ReadFile(path.Join(soundsDir, f.Name()))
+		nameWithoutExt := strings.TrimSuffix(d.Name(), ext)
+		storedSounds = append(storedSounds, filepath.ToSlash(rel))
+		data, err := os.ReadFile(p)
 		if err == nil {
 			storedSoundMap[nameWithoutExt] = data
 		} else {
 			storedSoundMap[nameWithoutExt] = []byte{}
-			fmt.Printf("[warn] couldn't prefetch file %s\n", f.Name())
+			fmt.Printf("[warn] couldn't prefetch file %s\n", rel)
 		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
 	}
+	sort.Slice(storedSounds, func(i, j int) bool { return strings.ToLower(storedSounds[i]) < strings.ToLower(storedSounds[j]) })
 	return storedSounds, storedSoundMap, nil
 }
 
@@ -131,49 +151,283 @@ type SoundboardSoundWithOrdinal struct {
 	ordinal int
 }
 
-type UserInfo struct {
-	UserID   string
-	Username string
-	Avatar   string
+// uploadSlotTimeout is how long a sound uploaded into a slot is waited for.
+// If the gateway hasn't told us about it by then it isn't coming, it was
+// taken off again or we reconnected and placed it already.
+const uploadSlotTimeout = time.Minute
+
+// uploadSlot is where a sound uploaded into one should go.
+type uploadSlot struct {
+	slot    int
+	created time.Time
+}
+
+// gatewayHandler is how the server hears from Discord's gateway.
+type gatewayHandler struct {
+	// message handles one message from the gateway. fetchSoundboardSounds
+	// asks it for the guild's sounds again.
+	message func(msg DiscordMessage, fetchSoundboardSounds func())
+	// disconnected is called when the connection drops.
+	disconnected func()
 }
 
 func main() {
-	userInfoCache := make(map[string]UserInfo)
+	if len(os.Args) > 1 && os.Args[1] == "migrate-library" {
+		purgeOriginals := len(os.Args) > 2 && os.Args[2] == "-purge-originals"
+		if err := migrateLibrary(transcoder, purgeOriginals); err != nil {
+			fmt.Fprintf(os.Stderr, "[error] migrating library: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && cliCommands[os.Args[1]] {
+		if err := runCLI(os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	handler, gateway := newServer(NewDiscordRestClient(authToken, ""))
+
+	go func() {
+		port := "3000"
+		fmt.Printf("starting http server on localhost:%s...\n", port)
+		err := http.ListenAndServe("0.0.0.0:"+port, handler)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	for {
+		for i := 0; i < 5; i++ {
+			err, isCritical := connectDiscordWebsocket(gateway)
+			fmt.Fprintf(os.Stderr, "error occurred with discord's websocket: %v", err)
+			if !isCritical {
+				continue
+			}
+			panic(err)
+		}
+	}
+}
 
+// newServer sets up the board and library and returns the server's handler,
+// and what has to hear from Discord's gateway to keep the board up to date.
+func newServer(discordClient soundboardAPI) (http.Handler, gatewayHandler) {
+	mux := http.NewServeMux()
 	m := minify.New()
 	m.AddFunc("text/html", html.Minify)
 
 	var userIsInChannel atomic.Bool
 	userIsInChannel.Store(false)
-	var mu sync.RWMutex
+	var gatewayConnected atomic.Bool
+	// sounds is the board. It's only read or changed under clients' lock, in
+	// clients.at and clients.commit, so it's always what its state version
+	// says it is. Handlers work from a copy, see boardNow.
 	sounds := [soundboardSoundCount]SoundboardSound{}
+	// uploadSlots are the slots sounds uploaded into one should go in, by
+	// sound ID. Discord has no order of its own for soundboard sounds, the
+	// slots are ours, so a new sound would otherwise take the first free
+	// one. It's kept under clients' lock too.
+	uploadSlots := make(map[string]uploadSlot)
+	// pruneUploadSlots drops the ones past uploadSlotTimeout, it expects
+	// clients' lock to be held.
+	pruneUploadSlots := func() {
+		for id, upload := range uploadSlots {
+			if time.Since(upload.created) > uploadSlotTimeout {
+				delete(uploadSlots, id)
+			}
+		}
+	}
+	// The library is replaced as a whole by refreshStoredSounds, under
+	// libraryMu, while handlers read it without clients' lock. Read it
+	// through libraryNow.
+	var libraryMu sync.RWMutex
+	libraryGeneration := 0
 	storedSounds, storedSoundMap, err := fetchStoredSounds()
 	if err != nil {
 		panic(err)
 	}
-	discordClient := NewDiscordRestClient(authToken, "")
+	storedSoundProbes := probeStoredSounds(storedSoundMap)
+	soundMetadata, err := loadSoundMetadata(soundsDir)
+	if err != nil {
+		panic(err)
+	}
+	storedSoundHashes := hashStoredSounds(storedSoundMap, soundMetadata)
+	boardSoundHashes := newSoundHashCache()
+	cdnCache, err := newSoundboardCDNCache(filepath.Join(soundsDir, cdnCacheDir), cdnBaseURL, cdnClient, cdnCacheSize)
+	if err != nil {
+		panic(err)
+	}
+	libraryFingerprints := newFingerprintIndex()
+	boardFingerprints := newFingerprintIndex()
+	var searchIndex soundSearchIndex
+	searchIndex.Rebuild(storedSounds, soundMetadata)
+	measureLibraryLoudness(storedSoundMap, soundMetadata)
+	fingerprintLibrary(storedSoundMap, soundMetadata, libraryFingerprints)
+	users, err := loadUserCache(soundsDir, discordClient)
+	if err != nil {
+		panic(err)
+	}
+	avatars, err := newAvatarProxy(filepath.Join(soundsDir, avatarCacheDir), cdnBaseURL, cdnClient)
+	if err != nil {
+		panic(err)
+	}
 
-	msgUpdates := make(chan []byte, 100)
-	soundUpdates := make(chan []SoundboardSoundWithOrdinal, 100)
-	clients := make(map[*websocket.Conn]chan []byte)
-	latestSoundUpdate := func(newSounds []SoundboardSoundWithOrdinal) bytes.Buffer {
-		var buf bytes.Buffer
-		// write updates for new sounds
-		for _, sound := range newSounds {
-			if sound.SoundboardSound == (SoundboardSound{}) {
-				buf.WriteString(soundCardComponent(sound.ordinal, "", "", userIsInChannel.Load(), false, true, nil))
+	msgUpdates := make(chan wsMessage, 100)
+	clients := newHub()
+	// boardNow copies the board, for handlers that only read it.
+	boardNow := func() [soundboardSoundCount]SoundboardSound {
+		var board [soundboardSoundCount]SoundboardSound
+		clients.at(func(uint64, string) { board = sounds })
+		return board
+	}
+	// libraryView is the library at one generation. refreshStoredSounds
+	// replaces these rather than changing them, so a copy stays consistent
+	// once libraryMu is let go.
+	type libraryView struct {
+		generation int
+		sounds     []string
+		byName     map[string][]byte
+		probes     map[string]SoundProbe
+		hashes     map[string][]string
+	}
+	libraryNow := func() libraryView {
+		libraryMu.RLock()
+		defer libraryMu.RUnlock()
+		return libraryView{
+			generation: libraryGeneration,
+			sounds:     storedSounds,
+			byName:     storedSoundMap,
+			probes:     storedSoundProbes,
+			hashes:     storedSoundHashes,
+		}
+	}
+	var matches libraryMatches
+	libraryMatchInputs := func(library libraryView) matchInputs {
+		return matchInputs{
+			library:       library.generation,
+			boardHashes:   boardSoundHashes.Generation(),
+			boardPrints:   boardFingerprints.Generation(),
+			libraryPrints: libraryFingerprints.Generation(),
+		}
+	}
+	// libraryMatch names the stored sound a board sound is a copy of, going by
+	// the exact bytes first and then by how it sounds, so re-encoded uploads
+	// of the same clip are caught too. It's empty when we haven't got it, or
+	// haven't fetched the board sound yet.
+	libraryMatch := func(soundID string) string {
+		library := libraryNow()
+		return matches.Get(soundID, libraryMatchInputs(library), func() string {
+			if hash, ok := boardSoundHashes.Get(soundID); ok {
+				if names := library.hashes[hash]; len(names) > 0 {
+					return names[0]
+				}
+			}
+			if fp, ok := boardFingerprints.Get(soundID); ok {
+				if name, ok := libraryFingerprints.Match(fp); ok {
+					return name
+				}
 			}
-			disabled := sound.UserID != discordClient.userID
-			_, cannotSave := storedSoundMap[sound.Name]
-			userInfo := userInfoCache[sound.UserID]
-			avatarCDN := fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.webp", sound.UserID, userInfo.Avatar)
-			buf.WriteString(soundCardComponent(sound.ordinal, sound.ID, sound.Name, userIsInChannel.Load(), !cannotSave, !disabled, deleteButton(sound.ID, guildID, userInfo.Username, avatarCDN, disabled)))
+			return ""
+		})
+	}
+	apiBoardSoundFor := func(sound SoundboardSound) apiBoardSound {
+		return apiBoardSound{
+			ID:          sound.ID,
+			Name:        sound.Name,
+			UserID:      sound.UserID,
+			Uploader:    users.Get(sound.UserID).Username,
+			AvatarURL:   avatarURL(sound.UserID),
+			AudioURL:    "/cdn/soundboard-sounds/" + sound.ID,
+			LibraryName: libraryMatch(sound.ID),
+			Removable:   sound.UserID == discordClient.GetUserId(),
 		}
-
+	}
+	apiBoardSlotFor := func(ordinal int, sound SoundboardSound) apiBoardSlot {
+		slot := apiBoardSlot{Slot: ordinal}
+		if sound != (SoundboardSound{}) {
+			boardSound := apiBoardSoundFor(sound)
+			slot.Sound = &boardSound
+		}
+		return slot
+	}
+	boardUpdatedEvent := func(newSounds []SoundboardSoundWithOrdinal) wsEvent {
+		slots := make([]apiBoardSlot, 0, len(newSounds))
+		for _, sound := range newSounds {
+			slots = append(slots, apiBoardSlotFor(sound.ordinal, sound.SoundboardSound))
+		}
+		return newWSEvent(wsEventBoardUpdated, wsBoardUpdated{Slots: slots})
+	}
+	userCountMessage := func(count int) wsMessage {
+		return wsMessage{
+			html:   []byte(fmt.Sprintf("<span id=user-count>%d</span>", count)),
+			keys:   []string{"user-count"},
+			events: []wsEvent{newWSEvent(wsEventUserCount, wsUserCount{Count: count})},
+		}
+	}
+	// soundUpdateKeys are the elements latestSoundUpdate replaces.
+	soundUpdateKeys := func(newSounds []SoundboardSoundWithOrdinal) []string {
+		keys := make([]string, 0, len(newSounds)+1)
+		for _, sound := range newSounds {
+			keys = append(keys, slotKey(sound.ordinal))
+		}
+		return append(keys, "addsoundscript")
+	}
+	// sendGatewayStatus tells JSON clients about the gateway and voice
+	// channel, the page picks it up from the sound cards.
+	sendGatewayStatus := func() {
+		msgUpdates <- wsMessage{events: []wsEvent{newWSEvent(wsEventGatewayStatus, wsGatewayStatus{
+			GatewayConnected: gatewayConnected.Load(),
+			UserInChannel:    userIsInChannel.Load(),
+		})}}
+	}
+	fragments := newFragmentCache()
+	minifyHTML := func(fragment string) []byte {
+		var minifiedBuf bytes.Buffer
+		m.Minify("text/html", &minifiedBuf, strings.NewReader(fragment))
+		return minifiedBuf.Bytes()
+	}
+	cardKeyFor := func(sound SoundboardSoundWithOrdinal) cardKey {
+		return cardKey{
+			ordinal:  sound.ordinal,
+			sound:    sound.SoundboardSound,
+			canSend:  userIsInChannel.Load(),
+			matches:  libraryMatchInputs(libraryNow()),
+			username: users.Get(sound.UserID).Username,
+		}
+	}
+	// renderCardFor only needs key, so it can render what was copied under
+	// clients' lock after letting go of it.
+	renderCardFor := func(key cardKey) []byte {
+		return fragments.card(key, func() []byte {
+			sound := key.sound
+			// go by the audio when we've seen it, the name can be reused by a different sound.
+			libraryName := libraryMatch(sound.ID)
+			if _, seen := boardSoundHashes.Get(sound.ID); !seen {
+				if _, ok := libraryNow().byName[sound.Name]; ok {
+					libraryName = sound.Name
+				}
+			}
+			disabled := sound.UserID != discordClient.GetUserId()
+			var card string
+			if sound == (SoundboardSound{}) {
+				card = soundCardComponent(key.ordinal, "", "", key.canSend, "", true, nil)
+			}
+			card += soundCardComponent(key.ordinal, sound.ID, sound.Name, key.canSend, libraryName, !disabled, deleteButton(sound.ID, guildID, key.username, avatarURL(sound.UserID), disabled))
+			return minifyHTML(card)
+		})
+	}
+	renderCard := func(sound SoundboardSoundWithOrdinal) []byte {
+		return renderCardFor(cardKeyFor(sound))
+	}
+	// addSoundUpdates is the call that prunes the library of sounds on the
+	// board, and disables adding new sounds when it's full.
+	addSoundUpdates := func(board [soundboardSoundCount]SoundboardSound) string {
 		hasEmpty := false
 		hiddenSounds := make([]string, 0)
 		// This is used later to prune sounds that can be added or disables adding new sounds.
-		for _, sound := range sounds {
+		for _, sound := range board {
 			if sound == (SoundboardSound{}) {
 				hasEmpty = true
 				break
@@ -186,94 +440,341 @@ func main() {
 		if hasEmpty {
 			hasEmptyString = "true"
 		}
+		return `window._addSoundUpdates(` + hiddenSoundString + `, ` + hasEmptyString + `)`
+	}
+	latestSoundUpdate := func(board [soundboardSoundCount]SoundboardSound, newSounds []SoundboardSoundWithOrdinal) bytes.Buffer {
+		var buf bytes.Buffer
+		// write updates for new sounds
+		for _, sound := range newSounds {
+			buf.Write(renderCard(sound))
+		}
+		buf.Write(minifyHTML(`<div id="addsoundscript"><script type="text/javascript">` + addSoundUpdates(board) + `</script></div>`))
+		return buf
+	}
+	// renderLibrary is the #storedsounds list followed by #trash.
+	renderLibrary := func(board [soundboardSoundCount]SoundboardSound, library libraryView) []byte {
+		onBoard := boardNames(board[:])
+		return fragments.libraryList(libraryKey{generation: library.generation, onBoard: onBoard}, func() []byte {
+			var buf bytes.Buffer
+			soundMap := make(map[string]bool)
+			for _, sound := range board {
+				if sound != (SoundboardSound{}) {
+					soundMap[sound.Name] = true
+				}
+			}
 
-		buf.WriteString(`<div id="addsoundscript"><script type="text/javascript">window._addSoundUpdates(` + hiddenSoundString + `, ` + hasEmptyString + `)</script></div>`)
+			buf.WriteString("<div id=\"storedsounds\" class=\"flex flex-1 flex-wrap justify-center items-center max-w-7xl\">")
+			for _, storedSound := range library.sounds {
+				ext := filepath.Ext(storedSound)
+				storedSoundNoExt := strings.TrimSuffix(storedSound, ext)
+				// hide sounds already present on the sound map
+				_, ok := soundMap[path.Base(storedSoundNoExt)]
+				buf.Write(fragments.libraryCard(library.generation, libraryCardKey{location: storedSound, onBoard: ok}, func() []byte {
+					name := path.Base(storedSoundNoExt)
+					warning := library.probes[name].LimitWarning()
+					duplicate := duplicateOf(name, library.byName[name], library.hashes)
+					return minifyHTML(addSoundCardComponent(storedSoundNoExt, ext, guildID, ok, warning, duplicate))
+				}))
+			}
+			buf.WriteString("</div>")
 
-		var minifiedBuf bytes.Buffer
-		m.Minify("text/html", &minifiedBuf, &buf)
-		return minifiedBuf
+			trashed, err := fetchTrashedSounds()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[warn] couldn't list trash: %v\n", err)
+			}
+			buf.Write(minifyHTML(trashComponent(trashed, trashRetention)))
+			return buf.Bytes()
+		})
 	}
-	updateStoredSounds := func(soundsWithOrdinal []SoundboardSoundWithOrdinal) *bytes.Buffer {
-		var buf bytes.Buffer = latestSoundUpdate(soundsWithOrdinal)
-		soundMap := make(map[string]bool)
-		hasEmpty := false
-		// This is used later to prune sounds that can be added or disables adding new sounds.
-		for _, sound := range sounds {
-			if sound == (SoundboardSound{}) {
-				hasEmpty = true
-				continue
+	updateStoredSounds := func(board [soundboardSoundCount]SoundboardSound, library libraryView, soundsWithOrdinal []SoundboardSoundWithOrdinal) *bytes.Buffer {
+		var buf bytes.Buffer = latestSoundUpdate(board, soundsWithOrdinal)
+		buf.Write(renderLibrary(board, library))
+		return &buf
+	}
+	// soundUpdateMessage is the update for the slots in newSounds. It expects
+	// clients' lock to be held.
+	soundUpdateMessage := func(newSounds []SoundboardSoundWithOrdinal) wsMessage {
+		buf := latestSoundUpdate(sounds, newSounds)
+		return wsMessage{html: buf.Bytes(), keys: soundUpdateKeys(newSounds), events: []wsEvent{boardUpdatedEvent(newSounds)}}
+	}
+	// redraw a user's sounds once we know who they are.
+	users.onFetch = func(user UserInfo) {
+		clients.commit(func() (wsMessage, bool) {
+			updates := []SoundboardSoundWithOrdinal{}
+			for i, sound := range sounds {
+				if sound.UserID == user.UserID {
+					updates = append(updates, SoundboardSoundWithOrdinal{ordinal: i, SoundboardSound: sound})
+				}
 			}
-			soundMap[sound.Name] = true
-		}
-		_ = hasEmpty
-
-		buf.WriteString("<div id=\"storedsounds\" class=\"flex flex-1 flex-wrap justify-center items-center max-w-7xl\">")
-		for _, storedSound := range storedSounds {
-			ext := filepath.Ext(storedSound)
-			storedSoundNoExt := strings.TrimSuffix(storedSound, ext)
-			// hide sounds already present on the sound map
-			_, ok := soundMap[storedSoundNoExt]
-			buf.WriteString(addSoundCardComponent(storedSoundNoExt, ext, guildID, ok))
+			return soundUpdateMessage(updates), len(updates) > 0
+		})
+	}
+	// refreshStoredSounds rereads the library from disk and pushes it to every
+	// client. Call it after anything that changes soundsDir.
+	refreshStoredSounds := func() error {
+		newStoredSounds, newStoredSoundMap, err := fetchStoredSounds()
+		if err != nil {
+			return err
 		}
-		buf.WriteString("</div>")
-		return &buf
+		newStoredSoundProbes := probeStoredSounds(newStoredSoundMap)
+		newStoredSoundHashes := hashStoredSounds(newStoredSoundMap, soundMetadata)
+		searchIndex.Rebuild(newStoredSounds, soundMetadata)
+		libraryFingerprints.Retain(newStoredSoundMap)
+		measureLibraryLoudness(newStoredSoundMap, soundMetadata)
+		fingerprintLibrary(newStoredSoundMap, soundMetadata, libraryFingerprints)
+
+		// swapped in under clients' lock as well, so it goes out to clients
+		// at the version it changed in.
+		clients.commit(func() (wsMessage, bool) {
+			libraryMu.Lock()
+			storedSounds = newStoredSounds
+			storedSoundMap = newStoredSoundMap
+			storedSoundProbes = newStoredSoundProbes
+			storedSoundHashes = newStoredSoundHashes
+			libraryGeneration++
+			libraryMu.Unlock()
+
+			soundsWithOrdinal := make([]SoundboardSoundWithOrdinal, 0)
+			for i, sound := range sounds {
+				soundsWithOrdinal = append(soundsWithOrdinal, SoundboardSoundWithOrdinal{
+					ordinal:         i,
+					SoundboardSound: sound,
+				})
+			}
+			return wsMessage{
+				html:   updateStoredSounds(sounds, libraryNow(), soundsWithOrdinal).Bytes(),
+				keys:   append(soundUpdateKeys(soundsWithOrdinal), "storedsounds", "trash"),
+				events: []wsEvent{boardUpdatedEvent(soundsWithOrdinal), newWSEvent(wsEventLibraryChanged, nil)},
+			}, true
+		})
+		return nil
 	}
 
+	// the user count and gateway status aren't kept for replay, every
+	// connection sends a new count and a resumed one the gateway status.
 	go func() {
-		for newSounds := range soundUpdates {
-			buf := latestSoundUpdate(newSounds)
-			msgUpdates <- buf.Bytes()
+		for msgUpdate := range msgUpdates {
+			clients.broadcast(msgUpdate, false)
 		}
 	}()
-	go func() {
-		for msgUpdate := range msgUpdates {
-			mu.RLock()
-			for _, c := range clients {
-				c <- msgUpdate
+	currentBoard := func(sounds [soundboardSoundCount]SoundboardSound) apiBoard {
+		board := apiBoard{
+			Slots:            make([]apiBoardSlot, 0, len(sounds)),
+			UserInChannel:    userIsInChannel.Load(),
+			GatewayConnected: gatewayConnected.Load(),
+		}
+		for i, sound := range sounds {
+			board.Slots = append(board.Slots, apiBoardSlotFor(i, sound))
+		}
+		return board
+	}
+	const playableSoundsOpen = "<div id=\"playable-sounds\" class=\"flex flex-1 flex-wrap justify-center items-center max-w-7xl md:sticky md:top-0 md:bg-white md:dark:bg-gray-900\">"
+	// renderSnapshot is the whole board for a client that's just connected
+	// or missed an update. The hub calls it under its lock.
+	renderSnapshot := func(protocol string) []hubFrame {
+		soundsWithOrdinal := make([]SoundboardSoundWithOrdinal, 0)
+		for i, sound := range sounds {
+			soundsWithOrdinal = append(soundsWithOrdinal, SoundboardSoundWithOrdinal{
+				ordinal:         i,
+				SoundboardSound: sound,
+			})
+		}
+		if protocol == wsProtocolJSON {
+			// no keys, a snapshot is never replaced by a later update.
+			return wsMessage{events: []wsEvent{newWSEvent(wsEventSnapshot, currentBoard(sounds))}}.frames()[wsProtocolJSON]
+		}
+		var buf bytes.Buffer
+		buf.WriteString(playableSoundsOpen)
+		for i := 0; i < soundboardSoundCount; i++ {
+			buf.WriteString(fmt.Sprintf("<div id=\"soundboard-%d\"></div>", i))
+		}
+		buf.WriteString("</div>")
+		return []hubFrame{
+			{wsFrame: wsFrame{data: buf.Bytes()}},
+			{wsFrame: wsFrame{data: updateStoredSounds(sounds, libraryNow(), soundsWithOrdinal).Bytes()}, keys: append(soundUpdateKeys(soundsWithOrdinal), "storedsounds", "trash")},
+		}
+	}
+	snapshotFrames := func(protocol string, version uint64) []hubFrame {
+		key := snapshotKey{
+			version:          version,
+			library:          libraryKey{generation: libraryNow().generation, onBoard: boardNames(sounds[:])},
+			gatewayConnected: gatewayConnected.Load(),
+		}
+		for i, sound := range sounds {
+			key.cards[i] = cardKeyFor(SoundboardSoundWithOrdinal{ordinal: i, SoundboardSound: sound})
+		}
+		return fragments.snapshot(protocol, key, func() []hubFrame { return renderSnapshot(protocol) })
+	}
+	// renderIndex fills in page with the board and library as of the latest
+	// broadcast, so it shows everything before the websocket connects and
+	// the websocket only has to bring it up to date. Only copying that state
+	// is done under clients' lock, rendering it would hold up every update.
+	renderIndex := func(page []byte) []byte {
+		userCount := clients.count()
+		var (
+			board       [soundboardSoundCount]SoundboardSound
+			cards       [soundboardSoundCount]cardKey
+			library     libraryView
+			version     uint64
+			lastEventID string
+		)
+		clients.at(func(v uint64, id string) {
+			board, library, version, lastEventID = sounds, libraryNow(), v, id
+			for i, sound := range sounds {
+				cards[i] = cardKeyFor(SoundboardSoundWithOrdinal{ordinal: i, SoundboardSound: sound})
+			}
+		})
+
+		var playable bytes.Buffer
+		playable.WriteString(playableSoundsOpen)
+		for _, card := range cards {
+			if card.sound == (SoundboardSound{}) {
+				// renderCard's free slot is two cards with the same id,
+				// which only works as an update.
+				playable.Write(minifyHTML(soundCardComponent(card.ordinal, "", "", card.canSend, "", true, nil)))
+				continue
 			}
-			mu.RUnlock()
+			playable.Write(renderCardFor(card))
 		}
-	}()
-	http.HandleFunc("/send-sound", func(w http.ResponseWriter, r *http.Request) {
+		playable.WriteString("</div>")
+		return renderPage(page, map[string][]byte{
+			"playable-sounds": playable.Bytes(),
+			// index.js is a module, it's only there once the page is parsed.
+			"addsoundscript": minifyHTML(`<div id="addsoundscript"><script type="text/javascript">document.addEventListener("DOMContentLoaded", () => ` + addSoundUpdates(board) + `)</script></div>`),
+			// the library comes with #trash.
+			"storedsounds":  renderLibrary(board, library),
+			"trash":         nil,
+			"state-version": stampVersion(wsProtocolHTMX, nil, version, 0),
+			"user-count":    []byte(fmt.Sprintf("<span id=user-count>%d</span>", userCount)),
+		}, lastEventID)
+	}
+	// sendSound plays soundID in the channel and has every client play it too.
+	sendSound := func(soundID string) error {
+		err := discordClient.SendSoundboardSound(guildID, channelID, soundID)
+		if err != nil {
+			return err
+		}
+
+		// plays aren't kept, replaying one late is worse than missing it.
+		clients.broadcast(wsMessage{
+			html:   []byte("<div id=\"playsound\"><script>window._playSound(null, '" + soundID + "', true)</script></div>"),
+			events: []wsEvent{newWSEvent(wsEventSoundPlayed, wsSoundPlayed{SoundID: soundID})},
+		}, false)
+		return nil
+	}
+	mux.HandleFunc("/send-sound", func(w http.ResponseWriter, r *http.Request) {
 		soundID := r.URL.Query().Get("soundID")
 		if soundID == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		err := discordClient.SendSoundboardSound(guildID, channelID, soundID)
+		err := sendSound(soundID)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "[error] send soundboard err: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
-		playSoundPayload := []byte("<div id=\"playsound\"><script>window._playSound(null, '" + soundID + "', true)</script></div>")
-		mu.RLock()
-		for _, clientChan := range clients {
-			clientChan <- playSoundPayload
+	})
+	// board sounds are proxied through cdnCache, so previews keep working when
+	// the browser can't reach Discord's CDN and we only fetch each sound once.
+	mux.HandleFunc("/cdn/soundboard-sounds/", func(w http.ResponseWriter, r *http.Request) {
+		soundID := strings.TrimPrefix(r.URL.Path, "/cdn/soundboard-sounds/")
+		if !validSnowflake(soundID) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// a soundboard sound's audio never changes, so its ID is its version.
+		w.Header().Set("ETag", `"`+soundID+`"`)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		if r.Header.Get("If-None-Match") == `"`+soundID+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		data, err := cdnCache.Get(soundID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return
+		}
+		if mimeType, err := soundMIMEType(data, ""); err == nil {
+			w.Header().Set("Content-Type", mimeType)
+		}
+		http.ServeContent(w, r, soundID, time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/avatars/", func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimPrefix(r.URL.Path, "/avatars/")
+		if !validSnowflake(userID) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-		mu.RUnlock()
+		user := users.Get(userID)
+		// the url doesn't change with the avatar, so only cache briefly.
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		data, contentType, err := avatars.Avatar(user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] no avatar for %s: %v\n", userID, err)
+			data, contentType = placeholderAvatar, "image/svg+xml"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
 	})
+	fetchBoardSound := func(soundID string) ([]byte, error) {
+		data, err := cdnCache.Get(soundID)
+		if err != nil {
+			return nil, err
+		}
+		boardSoundHashes.Set(soundID, soundHash(data))
+		if _, ok := boardFingerprints.Get(soundID); !ok && pcmDecoder != nil {
+			if fp, err := fingerprintSound(data); err == nil {
+				boardFingerprints.Set(soundID, fp)
+			} else {
+				fmt.Fprintf(os.Stderr, "[warn] fingerprinting board sound %s: %v\n", soundID, err)
+			}
+		}
+		return data, nil
+	}
 	saveSoundFunc := func(soundID, soundName string) error {
-		resp, err := http.DefaultClient.Get("https://cdn.discordapp.com/soundboard-sounds/" + soundID)
+		data, err := fetchBoardSound(soundID)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "[error] saving file: %v\n", err)
 			return err
 		}
 
-		contentType := resp.Header.Get("Content-Type")
-		var extension string
-		switch contentType {
-		case "audio/mpeg3":
-			extension = "mp3"
-		default:
-			extension = "ogg"
+		sourceHash := soundHash(data)
+		if name := libraryMatch(soundID); name != "" {
+			fmt.Printf("%s is already saved as %s\n", soundName, name)
+			// the board card may still think it can be saved.
+			clients.commit(func() (wsMessage, bool) {
+				updates := []SoundboardSoundWithOrdinal{}
+				for i, sound := range sounds {
+					if sound.ID == soundID {
+						updates = append(updates, SoundboardSoundWithOrdinal{ordinal: i, SoundboardSound: sound})
+					}
+				}
+				return soundUpdateMessage(updates), len(updates) > 0
+			})
+			return nil
+		}
+		library := libraryNow()
+		if _, ok := library.byName[soundName]; ok {
+			newName := nextVersionName(soundName, library.byName)
+			fmt.Printf("%s is already taken by a different sound, saving as %s\n", soundName, newName)
+			soundName = newName
 		}
 
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[error] saving file, could not read response body: %v\n", err)
-			return err
+		// the CDN's Content-Type isn't reliable, so go by the bytes.
+		extension := "ogg"
+		if format, err := detectSoundFormat(data); err == nil {
+			extension = strings.TrimPrefix(format.Ext, ".")
+		} else {
+			fmt.Fprintf(os.Stderr, "[warn] couldn't tell what format %s is, saving it as ogg\n", soundName)
+		}
+
+		if transcoded, transcodedExt, err := transcoder.Transcode(data, "."+extension); err == nil {
+			data = transcoded
+			extension = strings.TrimPrefix(transcodedExt, ".")
+		} else {
+			fmt.Fprintf(os.Stderr, "[warn] couldn't transcode %s, saving it as is: %v\n", soundName, err)
 		}
 
 		err = os.WriteFile(path.Join(soundsDir, soundName+"."+extension), data, 0644)
@@ -282,36 +783,56 @@ func main() {
 			return err
 		}
 
-		soundboardSound := SoundboardSoundWithOrdinal{}
-		soundsWithOrdinal := make([]SoundboardSoundWithOrdinal, 0)
-		for i, sound := range sounds {
+		uploaderID := ""
+		for _, sound := range boardNow() {
 			if sound.ID == soundID {
-				soundboardSound = SoundboardSoundWithOrdinal{
-					ordinal:         i,
-					SoundboardSound: sound,
-				}
+				uploaderID = sound.UserID
 			}
-			soundsWithOrdinal = append(soundsWithOrdinal, SoundboardSoundWithOrdinal{
-				ordinal:         i,
-				SoundboardSound: sound,
-			})
 		}
 
-		if newStoredSounds, newStoredSoundMap, err := fetchStoredSounds(); err == nil {
-			storedSounds = newStoredSounds
-			storedSoundMap = newStoredSoundMap
-			if soundboardSound != (SoundboardSoundWithOrdinal{}) {
-				soundUpdates <- []SoundboardSoundWithOrdinal{
-					soundboardSound,
-				}
-			}
-			msgUpdates <- updateStoredSounds(soundsWithOrdinal).Bytes()
+		metadata := soundMetadata.Get(soundName)
+		metadata.Source = "discord"
+		metadata.SourceHash = sourceHash
+		metadata.SavedAt = time.Now()
+		if uploaderID != "" {
+			metadata.UploaderID = uploaderID
+			metadata.Uploader = users.Get(uploaderID).Username
+		}
+		if err := soundMetadata.Set(soundName, metadata); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save metadata for %s: %v\n", soundName, err)
+		}
+
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
 		}
 
 		return nil
 	}
+	// queueSave saves a new board sound in the background, one at a time, so
+	// fetching and decoding it doesn't hold up the gateway. A sound that's
+	// already waiting isn't queued again, and when the queue is full it's left
+	// for the next time the board comes in.
+	saveQueue := make(chan SoundboardSound, 2*soundboardSoundCount)
+	var savesPending sync.Map
+	queueSave := func(sound SoundboardSound) {
+		if _, pending := savesPending.LoadOrStore(sound.ID, true); pending {
+			return
+		}
+		select {
+		case saveQueue <- sound:
+		default:
+			savesPending.Delete(sound.ID)
+		}
+	}
+	go func() {
+		for sound := range saveQueue {
+			fmt.Printf("attempting to save new sound %v\n", sound.Name)
+			saveSoundFunc(sound.ID, sound.Name)
+			savesPending.Delete(sound.ID)
+		}
+	}()
 
-	http.HandleFunc("/save-sound", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/save-sound", func(w http.ResponseWriter, r *http.Request) {
 		soundID := r.URL.Query().Get("soundID")
 		soundName := r.URL.Query().Get("soundName")
 		if soundID == "" || soundName == "" {
@@ -326,81 +847,665 @@ func main() {
 		}
 	})
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Print("upgrade:", err)
-			return
-		}
-		defer c.Close()
-		soundChan := make(chan []byte, 100)
-		soundsWithOrdinal := make([]SoundboardSoundWithOrdinal, 0)
-		for i, sound := range sounds {
-			soundsWithOrdinal = append(soundsWithOrdinal, SoundboardSoundWithOrdinal{
-				ordinal:         i,
-				SoundboardSound: sound,
-			})
+	mux.HandleFunc("/library/search", func(w http.ResponseWriter, r *http.Request) {
+		soundMap := make(map[string]bool)
+		for _, sound := range boardNow() {
+			if sound != (SoundboardSound{}) {
+				soundMap[sound.Name] = true
+			}
 		}
 
-		waitChan := make(chan struct{})
+		var buf bytes.Buffer
+		library := libraryNow()
+		for _, storedSound := range searchIndex.Search(r.URL.Query().Get("q")) {
+			ext := filepath.Ext(storedSound)
+			storedSoundNoExt := strings.TrimSuffix(storedSound, ext)
+			name := path.Base(storedSoundNoExt)
+			warning := library.probes[name].LimitWarning()
+			duplicate := duplicateOf(name, library.byName[name], library.hashes)
+			buf.WriteString(addSoundCardComponent(storedSoundNoExt, ext, guildID, soundMap[name], warning, duplicate))
+		}
+		w.Write(buf.Bytes())
+	})
 
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		input, err := parseUpload(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		input.SourceHash = soundHash(input.Data)
+		if transcoded, transcodedExt, err := transcoder.Transcode(input.Data, input.Ext); err == nil {
+			input.Data, input.Ext = transcoded, transcodedExt
+		} else {
+			fmt.Fprintf(os.Stderr, "[warn] couldn't transcode %s, saving it as is: %v\n", input.Name, err)
+		}
+
+		library := libraryNow()
+		soundLocation, err := saveUploadedSound(input, library.byName, library.hashes)
+		if errors.Is(err, errSoundExists) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "%v", err)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(os.Stderr, "[error] saving upload %s: %v\n", input.Name, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+
+		name := path.Base(strings.TrimSuffix(soundLocation, path.Ext(soundLocation)))
+		if err := soundMetadata.Set(name, SoundMetadata{Source: "upload", SourceHash: input.SourceHash, SavedAt: time.Now()}); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save metadata for %s: %v\n", name, err)
+		}
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+
+		if input.Slot >= 0 {
+			// only take the old sound off once the new one is ready to go on.
+			sound, err := prepareSound(libraryNow().byName, soundMetadata, addSoundInput{SoundLocation: soundLocation})
+			if err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, errSoundRejected) {
+					status = http.StatusBadRequest
+				}
+				w.WriteHeader(status)
+				fmt.Fprintf(os.Stderr, "[error] preparing upload %s: %v\n", soundLocation, err)
+				fmt.Fprintf(w, "[error] saved %s but it can't go on the board: %v", soundLocation, err)
+				return
+			}
+			existing := boardNow()[input.Slot]
+			if existing.ID != "" {
+				err = deleteSound(discordClient, guildID, deleteSoundInput{SoundID: existing.ID})
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintf(os.Stderr, "[error] deleting during upload: %v\n", err)
+					fmt.Fprintf(w, "[error] saved %s but couldn't free slot %d: %v", soundLocation, input.Slot, err)
+					return
+				}
+			}
+			created, err := uploadSound(discordClient, sound)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(os.Stderr, "[error] adding during upload: %v\n", err)
+				fmt.Fprintf(w, "[error] saved %s but couldn't add it to the board: %v", soundLocation, err)
+				return
+			}
+			// Discord tells the gateway about the new sound without saying
+			// where it goes, so have it put in the chosen slot. If the gateway
+			// beat us to it, move it there. Nothing is left waiting when the
+			// upload fails, it's only recorded once Discord has the sound.
+			clients.commit(func() (wsMessage, bool) {
+				for i, sound := range sounds {
+					if sound.ID != created.SoundID {
+						continue
+					}
+					// the sound we deleted may not have come off yet.
+					occupant := sounds[input.Slot]
+					if i == input.Slot || (occupant != (SoundboardSound{}) && occupant.ID != existing.ID) {
+						return wsMessage{}, false
+					}
+					sounds[input.Slot], sounds[i] = sound, SoundboardSound{}
+					return soundUpdateMessage([]SoundboardSoundWithOrdinal{{ordinal: i}, {ordinal: input.Slot, SoundboardSound: sound}}), true
+				}
+				pruneUploadSlots()
+				uploadSlots[created.SoundID] = uploadSlot{slot: input.Slot, created: time.Now()}
+				return wsMessage{}, false
+			})
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Uploaded %s", soundLocation)
+	})
+
+	mux.HandleFunc("/library/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		soundURL := r.FormValue("url")
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			name = importNameFromURL(soundURL)
+		}
+		if err := validateSoundName(name); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+
+		data, ext, err := fetchSoundFromURL(importClient, soundURL, maxUploadSize)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] importing %s: %v\n", soundURL, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		sourceHash := soundHash(data)
+		if transcoded, transcodedExt, err := transcoder.Transcode(data, ext); err == nil {
+			data, ext = transcoded, transcodedExt
+		} else {
+			fmt.Fprintf(os.Stderr, "[warn] couldn't transcode %s, saving it as is: %v\n", name, err)
+		}
+
+		library := libraryNow()
+		soundLocation, err := saveUploadedSound(uploadInput{
+			Name:       name,
+			Folder:     strings.Trim(r.FormValue("folder"), "/"),
+			Slot:       -1,
+			Ext:        ext,
+			Data:       data,
+			SourceHash: sourceHash,
+		}, library.byName, library.hashes)
+		if errors.Is(err, errSoundExists) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "%v", err)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(os.Stderr, "[error] saving import %s: %v\n", name, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+
+		name = path.Base(strings.TrimSuffix(soundLocation, path.Ext(soundLocation)))
+		if err := soundMetadata.Set(name, SoundMetadata{Source: "url", SourceURL: soundURL, SourceHash: sourceHash, SavedAt: time.Now()}); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save metadata for %s: %v\n", name, err)
+		}
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Imported %s", soundLocation)
+	})
+
+	editStoredSound := func(r *http.Request) (string, []byte, string, error) {
+		if err := r.ParseForm(); err != nil {
+			return "", nil, "", err
+		}
+		soundLocation := r.Form.Get("soundLocation")
+		edit, err := parseClipEdit(r.Form)
+		if err != nil {
+			return "", nil, "", err
+		}
+		p, err := libraryPath(soundLocation)
+		if err != nil {
+			return "", nil, "", err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("[error] trouble reading file %v", soundLocation)
+		}
+		edited, ext, err := clipEditor.EditClip(data, path.Ext(soundLocation), edit)
+		return soundLocation, edited, ext, err
+	}
+
+	// The editor previews edits by playing this straight from an <audio> tag,
+	// nothing is written until /library/edit is posted with the same fields.
+	mux.HandleFunc("/library/edit/preview", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation, data, ext, err := editStoredSound(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] previewing edit of %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		mimeType, _ := soundMIMEType(data, ext)
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+	})
+
+	mux.HandleFunc("/library/edit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		soundLocation, data, ext, err := editStoredSound(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] editing %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+
+		name := path.Base(strings.TrimSuffix(soundLocation, path.Ext(soundLocation)))
+		folder := path.Dir(soundLocation)
+		if folder == "." {
+			folder = ""
+		}
+		library := libraryNow()
+		newName := nextVersionName(name, library.byName)
+		newLocation, err := saveUploadedSound(uploadInput{
+			Name:   newName,
+			Folder: folder,
+			Slot:   -1,
+			Ext:    ext,
+			Data:   data,
+		}, library.byName, library.hashes)
+		if errors.Is(err, errSoundExists) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "%v", err)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(os.Stderr, "[error] saving edit of %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+
+		metadata := soundMetadata.Get(name)
+		metadata.Source = "edit"
+		metadata.EditedFrom = name
+		metadata.SourceHash = ""
+		metadata.SavedAt = time.Now()
+		metadata.Loudness = nil   // the edit may have changed it
+		metadata.Fingerprint = "" // or it would match what the original matches
+		if err := soundMetadata.Set(newName, metadata); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save metadata for %s: %v\n", newName, err)
+		}
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Saved %s", newLocation)
+	})
+
+	// library sounds are served straight from disk so they can be previewed
+	// without being on the board. http.ServeContent handles Range requests and
+	// If-None-Match, which audio elements rely on for seeking.
+	mux.HandleFunc("/library/audio/", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation := strings.TrimPrefix(r.URL.Path, "/library/audio/")
+		p, err := libraryPath(soundLocation)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if format, ok := soundFormatForExt(path.Ext(p)); ok {
+			w.Header().Set("Content-Type", format.MIMEType)
+		}
+		w.Header().Set("ETag", `"`+fileVersion(info.ModTime(), info.Size())+`"`)
+		// files get renamed and replaced, so always check they're still current.
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+
+	waveforms := newWaveformCache(waveformCacheSize)
+	writeWaveform := func(w http.ResponseWriter, r *http.Request, version string, peaks []float64) {
+		w.Header().Set("ETag", `"`+version+`"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"peaks": peaks})
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(waveformSVG(peaks))
+	}
+
+	mux.HandleFunc("/waveform/library", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation := r.URL.Query().Get("soundLocation")
+		p, err := libraryPath(soundLocation)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		version := fileVersion(info.ModTime(), info.Size())
+		if r.Header.Get("If-None-Match") == `"`+version+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		peaks, err := waveforms.Peaks("library:"+soundLocation, version, func() ([]byte, error) {
+			return os.ReadFile(p)
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(os.Stderr, "[error] waveform for %s: %v\n", soundLocation, err)
+			return
+		}
+		writeWaveform(w, r, version, peaks)
+	})
+
+	mux.HandleFunc("/waveform/board", func(w http.ResponseWriter, r *http.Request) {
+		soundID := r.URL.Query().Get("soundID")
+		if soundID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// a soundboard sound's audio never changes, so its ID is its version.
+		if r.Header.Get("If-None-Match") == `"`+soundID+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		peaks, err := waveforms.Peaks("board:"+soundID, soundID, func() ([]byte, error) {
+			return cdnCache.Get(soundID)
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(os.Stderr, "[error] waveform for %s: %v\n", soundID, err)
+			return
+		}
+		writeWaveform(w, r, soundID, peaks)
+	})
+
+	mux.HandleFunc("/library/rename", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation := r.URL.Query().Get("soundLocation")
+		newName := r.Header.Get("HX-Prompt")
+		if newName == "" {
+			newName = r.URL.Query().Get("name")
+		}
+		if soundLocation == "" || newName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		oldName := path.Base(strings.TrimSuffix(soundLocation, path.Ext(soundLocation)))
+		if _, ok := libraryNow().byName[newName]; ok && newName != oldName {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "[error] a sound named %s already exists", newName)
+			return
+		}
+
+		if _, err := renameStoredSound(soundLocation, newName); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] renaming %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		waveforms.Invalidate("library:" + soundLocation)
+		if err := soundMetadata.Rename(oldName, newName); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not rename metadata for %s: %v\n", oldName, err)
+		}
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/library/move", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation := r.URL.Query().Get("soundLocation")
+		folder := r.URL.Query().Get("folder")
+		if r.Header.Get("HX-Request") != "" {
+			folder = r.Header.Get("HX-Prompt")
+		}
+		if soundLocation == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if _, err := moveStoredSound(soundLocation, folder); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] moving %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		waveforms.Invalidate("library:" + soundLocation)
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/library/delete", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation := r.URL.Query().Get("soundLocation")
+		if soundLocation == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if _, err := trashStoredSound(soundLocation); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] deleting %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		waveforms.Invalidate("library:" + soundLocation)
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/library/merge", func(w http.ResponseWriter, r *http.Request) {
+		soundLocation := r.URL.Query().Get("soundLocation")
+		into := r.URL.Query().Get("into")
+		if soundLocation == "" || into == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name := path.Base(strings.TrimSuffix(soundLocation, path.Ext(soundLocation)))
+		if library := libraryNow(); duplicateOf(name, library.byName[name], library.hashes) != into {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "[error] %s isn't a duplicate of %s", name, into)
+			return
+		}
+
+		if _, err := trashStoredSound(soundLocation); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] merging %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		waveforms.Invalidate("library:" + soundLocation)
+
+		// keep any tags the duplicate had so searches for them still work.
+		merged := soundMetadata.Get(into)
+		for _, tag := range soundMetadata.Get(name).Tags {
+			if !slices.Contains(merged.Tags, tag) {
+				merged.Tags = append(merged.Tags, tag)
+			}
+		}
+		if err := soundMetadata.Set(into, merged); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not save metadata for %s: %v\n", into, err)
+		}
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/library/restore", func(w http.ResponseWriter, r *http.Request) {
+		trashID := r.URL.Query().Get("trashID")
+		soundLocation := r.URL.Query().Get("soundLocation")
+		if trashID == "" || soundLocation == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := restoreTrashedSound(trashID, soundLocation); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "[error] restoring %s: %v\n", soundLocation, err)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		if err := refreshStoredSounds(); err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] could not refresh stored sounds: %v\n", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// the trash is purged once before we start serving and then hourly.
+	purgeExpiredTrash := func() {
+		purged, err := purgeTrash(trashRetention)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] purging trash: %v\n", err)
+		}
+		if len(purged) > 0 {
+			refreshStoredSounds()
+		}
+		library := libraryNow()
+		for _, t := range purged {
+			fmt.Printf("purged %s from the trash\n", t.Location)
+			// a sound with the same name may have been saved since it was deleted.
+			name := path.Base(strings.TrimSuffix(t.Location, path.Ext(t.Location)))
+			if _, ok := library.byName[name]; !ok {
+				soundMetadata.Delete(name)
+			}
+		}
+	}
+	purgeExpiredTrash()
+	go func() {
+		for {
+			time.Sleep(time.Hour)
+			purgeExpiredTrash()
+		}
+	}()
+
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Print("upgrade:", err)
+			return
+		}
+		defer c.Close()
+
+		protocol := wsProtocol(c.Subprotocol())
+		snapshot := func(version uint64) []hubFrame { return snapshotFrames(protocol, version) }
+		// the page comes rendered as of lastEventID, it only needs what's
+		// happened since.
+		client, resumed := clients.resume(protocol, "ws", r.URL.Query().Get("lastEventID"))
+		if !resumed {
+			client = clients.join(protocol, "ws", snapshot)
+		} else {
+			sendGatewayStatus()
+		}
+		msgUpdates <- userCountMessage(clients.count())
+
+		waitChan := make(chan struct{})
 		go func() {
+			defer close(waitChan)
+			// closing the connection ends the read loop below, whether we
+			// stopped writing because of an error or because the hub dropped
+			// us for falling behind.
+			defer c.Close()
+			ping := time.NewTicker(5 * time.Second)
+			defer ping.Stop()
 			for {
-				timer := time.NewTimer(5 * time.Second)
 				var err error
 				select {
-				case <-timer.C:
+				case <-ping.C:
 					err = c.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(2*time.Second))
-				case sound := <-soundChan:
-					c.SetWriteDeadline(time.Now().Add(10 * time.Second))
-					err = c.WriteMessage(websocket.TextMessage, []byte(sound))
+				case <-client.wake:
+					for _, frame := range client.take() {
+						c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+						if err = c.WriteMessage(websocket.TextMessage, frame.data); err != nil {
+							break
+						}
+					}
+				case <-client.done:
+					return
 				}
 
 				if err != nil {
 					opErr := &net.OpError{}
-					if errors.Is(err, websocket.ErrCloseSent) || errors.As(err, &opErr) {
-						break
+					if !errors.Is(err, websocket.ErrCloseSent) && !errors.As(err, &opErr) {
+						fmt.Fprintf(os.Stderr, "[error] write: %v %T\n", err, err)
 					}
-					fmt.Fprintf(os.Stderr, "[error] write: %v %T\n", err, err)
+					return
 				}
-			}
-			waitChan <- struct{}{}
-		}()
-		var buf bytes.Buffer
-		buf.WriteString("<div id=\"playable-sounds\" class=\"flex flex-1 flex-wrap justify-center items-center max-w-7xl md:sticky md:top-0 md:bg-white md:dark:bg-gray-900\">")
-		for i := 0; i < soundboardSoundCount; i++ {
-			buf.WriteString(fmt.Sprintf("<div id=\"soundboard-%d\"></div>", i))
-		}
-		buf.WriteString("</div>")
-		soundChan <- buf.Bytes()
-
-		soundChan <- updateStoredSounds(soundsWithOrdinal).Bytes()
-
-		mu.Lock()
-		clients[c] = soundChan
-		mu.Unlock()
-
-		msgUpdates <- []byte(fmt.Sprintf("<span id=user-count>%d</span>", len(clients)))
+			}
+		}()
 
 		for {
-			_, _, err := c.ReadMessage()
+			_, msg, err := c.ReadMessage()
 			if err != nil {
 				fmt.Printf("read error: %v\n", err)
 				c.Close()
 				break
 			}
+			if isSnapshotRequest(msg) {
+				clients.resnapshot(client, snapshot)
+			}
 		}
 
-		mu.Lock()
-		delete(clients, c)
-		mu.Unlock()
-
-		close(soundChan)
+		clients.leave(client)
 		<-waitChan
 
-		msgUpdates <- []byte(fmt.Sprintf("<span id=user-count>%d</span>", len(clients)))
+		msgUpdates <- userCountMessage(clients.count())
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "[error] streaming isn't supported\n")
+			return
+		}
+		protocol := wsProtocol(r.URL.Query().Get("protocol"))
+
+		// pick up where the client left off if we still have everything it
+		// missed, otherwise start it over from the whole board.
+		client, resumed := clients.resume(protocol, "events", r.Header.Get("Last-Event-ID"))
+		if !resumed {
+			client = clients.join(protocol, "events", func(version uint64) []hubFrame { return snapshotFrames(protocol, version) })
+		}
+		defer func() {
+			clients.leave(client)
+			msgUpdates <- userCountMessage(clients.count())
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		if resumed {
+			sendGatewayStatus()
+		}
+		msgUpdates <- userCountMessage(clients.count())
+
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			var err error
+			select {
+			case <-client.wake:
+				for _, frame := range client.take() {
+					if err = writeSSE(w, frame); err != nil {
+						break
+					}
+				}
+			case <-keepAlive.C:
+				_, err = io.WriteString(w, ": ping\n\n")
+			case <-client.done:
+				return
+			case <-r.Context().Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
 	})
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		code := r.URL.Query().Get("code")
 
 		if code != "" {
@@ -448,9 +1553,21 @@ func main() {
 			return
 		}
 
-		http.FileServer(http.Dir("./dist")).ServeHTTP(w, r)
+		if r.URL.Path == "/" {
+			page, err := fs.ReadFile(staticFiles, "index.html")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "[error] the page isn't built, run pnpm build and rebuild the server: %v", err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(renderIndex(page))
+			return
+		}
+		http.FileServer(http.FS(staticFiles)).ServeHTTP(w, r)
 	})
-	http.HandleFunc("/swap-sound", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/swap-sound", func(w http.ResponseWriter, r *http.Request) {
 		input := struct {
 			Add    addSoundInput    `json:"add"`
 			Delete deleteSoundInput `json:"delete"`
@@ -475,7 +1592,7 @@ func main() {
 		}
 
 		if input.Add != (addSoundInput{}) {
-			err = addSound(discordClient, storedSoundMap, input.Add)
+			_, err = addSound(discordClient, libraryNow().byName, soundMetadata, input.Add)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprintf(os.Stderr, "[error] deleting during swap: %v\n", err)
@@ -493,7 +1610,7 @@ func main() {
 
 		w.WriteHeader(http.StatusOK)
 	})
-	http.Handle("/delete-sound", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/delete-sound", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := deleteSound(discordClient, r.URL.Query().Get("guildID"), deleteSoundInput{
 			SoundID: r.URL.Query().Get("soundID"),
 		})
@@ -505,9 +1622,9 @@ func main() {
 
 		w.WriteHeader(http.StatusNoContent)
 	}))
-	http.HandleFunc("/add-sound", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/add-sound", func(w http.ResponseWriter, r *http.Request) {
 		soundLocation := r.URL.Query().Get("soundLocation")
-		err := addSound(discordClient, storedSoundMap, addSoundInput{
+		_, err := addSound(discordClient, libraryNow().byName, soundMetadata, addSoundInput{
 			SoundLocation: soundLocation,
 		})
 		if err != nil {
@@ -519,21 +1636,21 @@ func main() {
 
 		w.WriteHeader(http.StatusOK)
 	})
-	http.Handle("/sounds", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/sounds", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var buf bytes.Buffer
 		buf.WriteString("<ul>")
-		for _, sound := range sounds {
-			buf.WriteString(fmt.Sprintf("<li>%s (%s) <button onclick=\"new Audio('https://cdn.discordapp.com/soundboard-sounds/%s').play()\">Play</button><button hx-delete=\"/delete-sound?soundID=%s&guildID=%s\">Delete</button></li>", sound.Name, sound.ID, sound.ID, sound.ID, guildID))
+		for _, sound := range boardNow() {
+			buf.WriteString(fmt.Sprintf("<li>%s (%s) <button onclick=\"new Audio('/cdn/soundboard-sounds/%s').play()\">Play</button><button hx-delete=\"/delete-sound?soundID=%s&guildID=%s\">Delete</button></li>", sound.Name, sound.ID, sound.ID, sound.ID, guildID))
 		}
-		for _, storedSound := range storedSounds {
-			buf.WriteString(fmt.Sprintf("<li>%s <button hx-post=\"/add-sound?soundLocation=%s&guildID=%s\">Add</button></li>", storedSound, storedSound, guildID))
+		for _, storedSound := range libraryNow().sounds {
+			buf.WriteString(fmt.Sprintf("<li>%s <button onclick=\"new Audio('%s').play()\">Play</button><button hx-post=\"/add-sound?soundLocation=%s&guildID=%s\">Add</button></li>", storedSound, libraryAudioURL(storedSound), storedSound, guildID))
 		}
 		buf.WriteString("</ul>")
 		w.Write(buf.Bytes())
 	}))
-	http.HandleFunc("/quickplay", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/quickplay", func(w http.ResponseWriter, r *http.Request) {
 		soundId := ""
-		for _, sound := range sounds {
+		for _, sound := range boardNow() {
 			if sound.Name == "NoOneHeard" {
 				soundId = sound.ID
 				break
@@ -551,7 +1668,13 @@ func main() {
 		}
 
 		soundLocation := r.URL.Query().Get("soundLocation")
-		data, err := os.ReadFile("/Users/lew/repos/discord-soundboard/sounds/" + soundLocation)
+		soundPath, err := libraryPath(soundLocation)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		data, err := os.ReadFile(soundPath)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "[error] trouble reading file %s\n", soundLocation)
@@ -562,9 +1685,22 @@ func main() {
 		nameAndExt := arr[len(arr)-1]
 
 		extension := strings.TrimPrefix(filepath.Ext(nameAndExt), ".")
-		name := strings.TrimSuffix(nameAndExt, extension)
+		name := strings.TrimSuffix(nameAndExt, "."+extension)
+
+		data, fittedExt, err := prepareSoundboardSound(name, data, "."+extension)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
+		mimeType, err := soundMIMEType(data, fittedExt)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
 
-		soundboardResponse, err := discordClient.CreateSoundboardSound(guildID, name, "audio/"+extension, data)
+		soundboardResponse, err := discordClient.CreateSoundboardSound(guildID, name, mimeType, 1, data)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "[error] creating soundboard sound for %s %v\n", soundLocation, err)
@@ -583,186 +1719,342 @@ func main() {
 			panic(err)
 		}
 
-		data, err = os.ReadFile("/Users/lew/repos/discord-soundboard/sounds/NoOneHeard.ogg")
+		data, err = os.ReadFile(filepath.Join(soundsDir, "NoOneHeard.ogg"))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "[error] trouble reading file %s\n", soundLocation)
 			return
 		}
 
-		_, err = discordClient.CreateSoundboardSound(guildID, "NoOneHeard", "audio/ogg", data)
+		_, err = discordClient.CreateSoundboardSound(guildID, "NoOneHeard", "audio/ogg", 1, data)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "[error] creating soundboard sound for %s %v\n", soundLocation, err)
 			return
 		}
 
-		w.Write([]byte(fmt.Sprintf("<script type=\"text/javascript\">new Audio('http://localhost:3000/sounds/%s.%s').play();</script>", name, extension)))
+		w.Write([]byte(fmt.Sprintf("<script type=\"text/javascript\">new Audio('%s').play();</script>", libraryAudioURL(soundLocation))))
 	})
-	go func() {
-		port := "3000"
-		fmt.Printf("starting http server on localhost:%s...\n", port)
-		err := http.ListenAndServe("0.0.0.0:"+port, http.DefaultServeMux)
+	apiLibrarySoundFor := func(board [soundboardSoundCount]SoundboardSound, library libraryView, location string) apiLibrarySound {
+		ext := filepath.Ext(location)
+		name := path.Base(strings.TrimSuffix(location, ext))
+		folder := path.Dir(location)
+		if folder == "." {
+			folder = ""
+		}
+		onBoard := false
+		for _, sound := range board {
+			if sound != (SoundboardSound{}) && sound.Name == name {
+				onBoard = true
+			}
+		}
+		probe := library.probes[name]
+		md := soundMetadata.Get(name)
+		sound := apiLibrarySound{
+			Name:        name,
+			Location:    location,
+			Folder:      folder,
+			Format:      strings.TrimPrefix(ext, "."),
+			Duration:    probe.Duration.Seconds(),
+			Size:        len(library.byName[name]),
+			OnBoard:     onBoard,
+			Warning:     probe.LimitWarning(),
+			DuplicateOf: duplicateOf(name, library.byName[name], library.hashes),
+			Tags:        md.Tags,
+			Uploader:    md.Uploader,
+			Source:      md.Source,
+			AudioURL:    libraryAudioURL(location),
+			WaveformURL: "/waveform/library?soundLocation=" + url.QueryEscape(location),
+		}
+		if !md.SavedAt.IsZero() {
+			sound.SavedAt = &md.SavedAt
+		}
+		return sound
+	}
+	findBoardSound := func(soundID string) (SoundboardSound, bool) {
+		for _, sound := range boardNow() {
+			if sound != (SoundboardSound{}) && sound.ID == soundID {
+				return sound, true
+			}
+		}
+		return SoundboardSound{}, false
+	}
+	// apiPrepareSound gets the library sound at location ready to go on the
+	// board, answering with what's wrong if it can't.
+	apiPrepareSound := func(w http.ResponseWriter, location string) (preparedSound, bool) {
+		p, err := libraryPath(location)
 		if err != nil {
-			panic(err)
+			writeAPIError(w, http.StatusBadRequest, apiErrorBadRequest, err)
+			return preparedSound{}, false
 		}
-	}()
-
-	// Returns true on critical error
-	connectDiscordWebsocket := func() (error, bool) {
-		conn, _, err := websocket.DefaultDialer.Dial("wss://gateway.discord.gg/?encoding=json&v=9", http.Header{})
+		if _, err := os.Stat(p); err != nil {
+			writeAPIError(w, http.StatusNotFound, apiErrorNotFound, fmt.Errorf("[error] no library sound at %s", location))
+			return preparedSound{}, false
+		}
+		sound, err := prepareSound(libraryNow().byName, soundMetadata, addSoundInput{SoundLocation: location})
+		if errors.Is(err, errSoundRejected) {
+			writeAPIError(w, http.StatusBadRequest, apiErrorBadRequest, err)
+			return preparedSound{}, false
+		} else if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, apiErrorInternal, err)
+			return preparedSound{}, false
+		}
+		return sound, true
+	}
+	// apiUploadSound puts sound on the board and returns it as it is there.
+	apiUploadSound := func(w http.ResponseWriter, sound preparedSound) {
+		created, err := uploadSound(discordClient, sound)
 		if err != nil {
-			return err, true
+			writeAPIError(w, http.StatusBadGateway, apiErrorUpstream, err)
+			return
 		}
-		done := make(chan struct{})
-		defer func() {
-			done <- struct{}{}
-			conn.Close()
-		}()
+		writeAPIJSON(w, http.StatusCreated, apiBoardSoundFor(SoundboardSound{
+			Name:   created.Name,
+			ID:     created.SoundID,
+			UserID: discordClient.GetUserId(),
+		}))
+	}
 
-		recvMsgChan := make(chan DiscordMessage, 100)
+	mux.HandleFunc("/api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	})
+	mux.HandleFunc("/api/v1/board", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, currentBoard(boardNow()))
+	})
+	mux.HandleFunc("/api/v1/board/sounds", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var input apiAddSoundRequest
+		if err := decodeAPIBody(r, &input); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrorBadRequest, err)
+			return
+		}
+		if board := boardNow(); !slices.Contains(board[:], SoundboardSound{}) {
+			writeAPIError(w, http.StatusConflict, apiErrorConflict, errors.New("[error] the board is full, swap a sound out instead"))
+			return
+		}
+		if sound, ok := apiPrepareSound(w, input.Location); ok {
+			apiUploadSound(w, sound)
+		}
+	})
+	// /api/v1/board/sounds/{soundID} and its /play and /save actions.
+	mux.HandleFunc("/api/v1/board/sounds/", func(w http.ResponseWriter, r *http.Request) {
+		soundID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/board/sounds/"), "/")
+		sound, ok := findBoardSound(soundID)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, apiErrorNotFound, fmt.Errorf("[error] no board sound %q", soundID))
+			return
+		}
 
-		go func() {
-			for {
-				var msg DiscordMessage
-				err := conn.ReadJSON(&msg)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "[discord-websocket] read error occurred shutting down: %v", err)
-					close(recvMsgChan)
+		switch action {
+		case "":
+			if !allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+				return
+			}
+			if r.Method == http.MethodDelete {
+				if err := deleteSound(discordClient, guildID, deleteSoundInput{SoundID: soundID}); err != nil {
+					writeAPIError(w, http.StatusBadGateway, apiErrorUpstream, err)
 					return
 				}
-
-				switch msg.Data.(type) {
-				case map[string]interface{}:
-					data, err := json.Marshal(msg.Data)
-					if err != nil {
-						close(recvMsgChan)
-						return
-					}
-					var dmd DiscordMessageData
-					err = json.Unmarshal(data, &dmd)
-					if err != nil {
-						close(recvMsgChan)
-						return
-					}
-					msg.Data = &dmd
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeAPIJSON(w, http.StatusOK, apiBoardSoundFor(sound))
+		case "play":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			if err := sendSound(soundID); err != nil {
+				writeAPIError(w, http.StatusBadGateway, apiErrorUpstream, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "save":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			var input apiSaveSoundRequest
+			if r.ContentLength != 0 {
+				if err := decodeAPIBody(r, &input); err != nil {
+					writeAPIError(w, http.StatusBadRequest, apiErrorBadRequest, err)
+					return
 				}
-
-				recvMsgChan <- msg
 			}
-		}()
-
-		err = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":2,"d":{"token":"`+authToken+`","capabilities":30717,"properties":{"os":"Windows","browser":"Chrome","device":"","system_locale":"en-US","browser_user_agent":"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.0.0 Safari/537.36","browser_version":"125.0.0.0","os_version":"10","referrer":"https://www.google.com/","referring_domain":"www.google.com","search_engine":"google","referrer_current":"","referring_domain_current":"","release_channel":"stable","client_build_number":301920,"client_event_source":null,"design_id":0},"presence":{"status":"unknown","since":0,"activities":[],"afk":false},"compress":false,"client_state":{"guild_versions":{}}}}`))
-		if err != nil {
-			return err, true
-		}
-		err = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":31,"d":{"guild_ids":["`+guildID+`"]}}`))
-		if err != nil {
-			return err, false
-		}
-
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-
-		msgChan := make(chan []byte, 100)
-
-		go func() {
-			for {
-				select {
-				case <-done:
+			name := sound.Name
+			if input.Name != "" {
+				if err := validateSoundName(input.Name); err != nil {
+					writeAPIError(w, http.StatusBadRequest, apiErrorBadRequest, err)
 					return
-				case msg := <-msgChan:
-					err = conn.WriteMessage(websocket.TextMessage, msg)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "[error] writing message to discord ws %v\n", err)
-					}
-					ticker.Reset(10 * time.Second)
-				case <-ticker.C:
-					err = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":1,"d":4}`))
-					if err != nil {
-						return
-					}
 				}
+				name = input.Name
 			}
-		}()
-
-		fetchSoundboardSounds := func() {
-			msgChan <- []byte(`{"op":31,"d":{"guild_ids":["` + guildID + `"]}}`)
+			if err := saveSoundFunc(soundID, name); err != nil {
+				writeAPIError(w, http.StatusBadGateway, apiErrorUpstream, err)
+				return
+			}
+			saved := libraryMatch(soundID)
+			library := libraryNow()
+			for _, location := range library.sounds {
+				if path.Base(strings.TrimSuffix(location, filepath.Ext(location))) == saved {
+					writeAPIJSON(w, http.StatusCreated, apiLibrarySoundFor(boardNow(), library, location))
+					return
+				}
+			}
+			writeAPIError(w, http.StatusInternalServerError, apiErrorInternal, fmt.Errorf("[error] saved %s but can't find it in the library", name))
+		default:
+			writeAPIError(w, http.StatusNotFound, apiErrorNotFound, fmt.Errorf("[error] no such action %q", action))
+		}
+	})
+	mux.HandleFunc("/api/v1/board/swap", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var input apiSwapRequest
+		if err := decodeAPIBody(r, &input); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrorBadRequest, err)
+			return
+		}
+		if _, ok := findBoardSound(input.Remove); !ok {
+			writeAPIError(w, http.StatusNotFound, apiErrorNotFound, fmt.Errorf("[error] no board sound %q", input.Remove))
+			return
+		}
+		// only take the old sound off once the new one is ready to go on.
+		sound, ok := apiPrepareSound(w, input.Add)
+		if !ok {
+			return
+		}
+		if err := deleteSound(discordClient, guildID, deleteSoundInput{SoundID: input.Remove}); err != nil {
+			writeAPIError(w, http.StatusBadGateway, apiErrorUpstream, err)
+			return
+		}
+		apiUploadSound(w, sound)
+	})
+	mux.HandleFunc("/api/v1/library", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		stored := libraryNow()
+		locations := stored.sounds
+		if q := r.URL.Query().Get("q"); q != "" {
+			locations = searchIndex.Search(q)
+		}
+		library := apiLibrary{Sounds: make([]apiLibrarySound, 0, len(locations))}
+		board := boardNow()
+		for _, location := range locations {
+			library.Sounds = append(library.Sounds, apiLibrarySoundFor(board, stored, location))
+		}
+		writeAPIJSON(w, http.StatusOK, library)
+	})
+	mux.HandleFunc("/api/v1/clients", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
 		}
+		writeAPIJSON(w, http.StatusOK, clients.stats())
+	})
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, apiErrorNotFound, fmt.Errorf("[error] no endpoint at %s", r.URL.Path))
+	})
 
-		for recvMsg := range recvMsgChan {
-			if recvMsg.Type == nil || recvMsg.Data == nil {
-				continue
-			}
+	// handleGatewayMessage keeps the board up to date with what the gateway
+	// tells us.
+	handleGatewayMessage := func(recvMsg DiscordMessage, fetchSoundboardSounds func()) {
+		if recvMsg.Type == nil || recvMsg.Data == nil {
+			return
+		}
 
-			dmd, ok := recvMsg.Data.(*DiscordMessageData)
-			if !ok {
-				continue
-			}
+		dmd, ok := recvMsg.Data.(*DiscordMessageData)
+		if !ok {
+			return
+		}
 
-			if *recvMsg.Type == "READY_SUPPLEMENTAL" {
-				for _, guild := range dmd.Guilds {
-					if guild.ID != guildID {
-						continue
-					}
-					for _, voiceState := range guild.VoiceStates {
-						if voiceState.ChannelID == channelID {
-							userIsInChannel.Store(true)
-						}
-					}
+		if *recvMsg.Type == "READY_SUPPLEMENTAL" {
+			for _, guild := range dmd.Guilds {
+				if guild.ID != guildID {
+					continue
 				}
-			} else if *recvMsg.Type == "READY" {
-				for _, user := range dmd.Users {
-					if user.Avatar != "" {
-						userInfoCache[user.ID] = UserInfo{
-							UserID:   user.ID,
-							Avatar:   user.Avatar,
-							Username: user.Username,
-						}
+				for _, voiceState := range guild.VoiceStates {
+					if voiceState.ChannelID == channelID {
+						userIsInChannel.Store(true)
 					}
 				}
-			} else if *recvMsg.Type == "SOUNDBOARD_SOUNDS" && dmd.GuildID == guildID {
+			}
+			sendGatewayStatus()
+		} else if *recvMsg.Type == "READY" {
+			gatewayConnected.Store(true)
+			sendGatewayStatus()
+			readyUsers := make([]UserInfo, 0, len(dmd.Users))
+			for _, user := range dmd.Users {
+				readyUsers = append(readyUsers, UserInfo{
+					UserID:   user.ID,
+					Avatar:   user.Avatar,
+					Username: user.Username,
+				})
+			}
+			users.Set(readyUsers...)
+		} else if *recvMsg.Type == "SOUNDBOARD_SOUNDS" && dmd.GuildID == guildID {
+			for _, soundboardSound := range dmd.SoundboardSounds {
+				if soundboardSound.User.Avatar != "" {
+					users.SetAvatar(soundboardSound.UserID, soundboardSound.User.Avatar)
+				}
+			}
+			// the board changes and goes out to clients at its new version
+			// in one go, see sounds.
+			var toSave []SoundboardSound
+			clients.commit(func() (wsMessage, bool) {
+				pruneUploadSlots()
 				newSounds := [soundboardSoundCount]SoundboardSound{}
 
-				emptyPositions := []int{}
 				soundMap := make(map[string]int)
 				for i, sound := range sounds {
-					if sound == (SoundboardSound{}) {
-						emptyPositions = append(emptyPositions, i)
-					} else {
+					if sound != (SoundboardSound{}) {
 						soundMap[sound.ID] = i
 					}
 				}
 
-				newUpdates := []SoundboardSoundWithOrdinal{}
+				// sounds already present keep their spot, so see where
+				// they all are before placing new ones.
+				var added, addedToSlot []SoundboardSound
 				for _, soundboardSound := range dmd.SoundboardSounds {
-					id := soundboardSound.SoundID
-					name := soundboardSound.Name
-
-					userID := soundboardSound.UserID
-					if soundboardSound.User.Avatar != "" {
-						avatar := soundboardSound.User.Avatar
-						old := userInfoCache[userID]
-						old.Avatar = avatar
-						userInfoCache[userID] = old
-					}
-					newSound := SoundboardSound{Name: name, ID: id, UserID: userID, Avatar: soundboardSound.User.Avatar}
-
-					// check if new sound is in sounds, if so place in same spot
-					if pos, ok := soundMap[newSound.ID]; ok { // sound was already present
+					newSound := SoundboardSound{Name: soundboardSound.Name, ID: soundboardSound.SoundID, UserID: soundboardSound.UserID, Avatar: soundboardSound.User.Avatar}
+					if pos, ok := soundMap[newSound.ID]; ok {
 						newSounds[pos] = newSound
-					} else { // otherwise place in first available spot
-						if len(emptyPositions) > 0 {
-							emptyPos := emptyPositions[0]
-							emptyPositions = emptyPositions[1:]
-							newSounds[emptyPos] = newSound
-							// send updates for any sounds added
-							newUpdates = append(newUpdates, SoundboardSoundWithOrdinal{
-								ordinal:         emptyPos,
-								SoundboardSound: newSound,
-							})
+					} else if _, ok := uploadSlots[newSound.ID]; ok {
+						addedToSlot = append(addedToSlot, newSound)
+					} else {
+						added = append(added, newSound)
+					}
+				}
+				// new sounds go in the slot they were uploaded into if it's
+				// free, otherwise in the first free spot.
+				newUpdates := []SoundboardSoundWithOrdinal{}
+				for _, newSound := range append(addedToSlot, added...) {
+					pos := -1
+					if upload, ok := uploadSlots[newSound.ID]; ok && newSounds[upload.slot] == (SoundboardSound{}) {
+						pos = upload.slot
+					}
+					delete(uploadSlots, newSound.ID)
+					for i := 0; pos < 0 && i < len(newSounds); i++ {
+						if newSounds[i] == (SoundboardSound{}) {
+							pos = i
 						}
 					}
+					if pos < 0 {
+						break
+					}
+					newSounds[pos] = newSound
+					// send updates for any sounds added
+					newUpdates = append(newUpdates, SoundboardSoundWithOrdinal{
+						ordinal:         pos,
+						SoundboardSound: newSound,
+					})
 				}
 				// send updates for any sounds removed
 				for i, newSound := range newSounds {
@@ -772,28 +2064,34 @@ func main() {
 						})
 					} else {
 						// if we detect a new sound that we don't have try to save it.
-						if _, ok := storedSoundMap[newSound.Name]; !ok {
-							fmt.Printf("attempting to save new sound %v\n", newSound.Name)
-							saveSoundFunc(newSound.ID, newSound.Name)
+						_, seen := boardSoundHashes.Get(newSound.ID)
+						if !seen || libraryMatch(newSound.ID) == "" {
+							toSave = append(toSave, newSound)
 						}
 					}
 				}
 				sounds = newSounds
-				soundUpdates <- newUpdates
-			} else if *recvMsg.Type == "GUILD_SOUNDBOARD_SOUND_CREATE" {
-				json.NewEncoder(os.Stdout).Encode(recvMsg)
-				fetchSoundboardSounds()
-			} else if *recvMsg.Type == "GUILD_SOUNDBOARD_SOUND_DELETE" {
-				json.NewEncoder(os.Stdout).Encode(recvMsg)
-				fetchSoundboardSounds()
-			} else if *recvMsg.Type == "VOICE_STATE_UPDATE" {
-				updateUserID := dmd.UserID
-				updateGuildID := dmd.GuildID
-				if updateUserID == discordClient.userID && guildID == updateGuildID {
-					updateChannelID := dmd.ChannelID
-					userIsInChannel.Store(updateChannelID == channelID)
-				}
-				// just force updates on all the sounds!
+				return soundUpdateMessage(newUpdates), true
+			})
+			for _, newSound := range toSave {
+				queueSave(newSound)
+			}
+		} else if *recvMsg.Type == "GUILD_SOUNDBOARD_SOUND_CREATE" {
+			json.NewEncoder(os.Stdout).Encode(recvMsg)
+			fetchSoundboardSounds()
+		} else if *recvMsg.Type == "GUILD_SOUNDBOARD_SOUND_DELETE" {
+			json.NewEncoder(os.Stdout).Encode(recvMsg)
+			fetchSoundboardSounds()
+		} else if *recvMsg.Type == "VOICE_STATE_UPDATE" {
+			updateUserID := dmd.UserID
+			updateGuildID := dmd.GuildID
+			if updateUserID == discordClient.GetUserId() && guildID == updateGuildID {
+				updateChannelID := dmd.ChannelID
+				userIsInChannel.Store(updateChannelID == channelID)
+				sendGatewayStatus()
+			}
+			// just force updates on all the sounds!
+			clients.commit(func() (wsMessage, bool) {
 				updates := make([]SoundboardSoundWithOrdinal, 0)
 				for i, sound := range sounds {
 					updates = append(updates, SoundboardSoundWithOrdinal{
@@ -801,22 +2099,108 @@ func main() {
 						SoundboardSound: sound,
 					})
 				}
-				soundUpdates <- updates
+				return soundUpdateMessage(updates), true
+			})
+		}
+	}
+
+	return mux, gatewayHandler{
+		message: handleGatewayMessage,
+		disconnected: func() {
+			gatewayConnected.Store(false)
+			sendGatewayStatus()
+		},
+	}
+}
+
+// connectDiscordWebsocket connects to the gateway and hands what it says to
+// gateway until the connection drops. It returns true on critical error.
+func connectDiscordWebsocket(gateway gatewayHandler) (error, bool) {
+	conn, _, err := websocket.DefaultDialer.Dial("wss://gateway.discord.gg/?encoding=json&v=9", http.Header{})
+	if err != nil {
+		return err, true
+	}
+	done := make(chan struct{})
+	defer func() {
+		gateway.disconnected()
+		done <- struct{}{}
+		conn.Close()
+	}()
+
+	recvMsgChan := make(chan DiscordMessage, 100)
+
+	go func() {
+		for {
+			var msg DiscordMessage
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[discord-websocket] read error occurred shutting down: %v", err)
+				close(recvMsgChan)
+				return
+			}
+
+			switch msg.Data.(type) {
+			case map[string]interface{}:
+				data, err := json.Marshal(msg.Data)
+				if err != nil {
+					close(recvMsgChan)
+					return
+				}
+				var dmd DiscordMessageData
+				err = json.Unmarshal(data, &dmd)
+				if err != nil {
+					close(recvMsgChan)
+					return
+				}
+				msg.Data = &dmd
 			}
+
+			recvMsgChan <- msg
 		}
-		return nil, false
+	}()
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":2,"d":{"token":"`+authToken+`","capabilities":30717,"properties":{"os":"Windows","browser":"Chrome","device":"","system_locale":"en-US","browser_user_agent":"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.0.0 Safari/537.36","browser_version":"125.0.0.0","os_version":"10","referrer":"https://www.google.com/","referring_domain":"www.google.com","search_engine":"google","referrer_current":"","referring_domain_current":"","release_channel":"stable","client_build_number":301920,"client_event_source":null,"design_id":0},"presence":{"status":"unknown","since":0,"activities":[],"afk":false},"compress":false,"client_state":{"guild_versions":{}}}}`))
+	if err != nil {
+		return err, true
+	}
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":31,"d":{"guild_ids":["`+guildID+`"]}}`))
+	if err != nil {
+		return err, false
 	}
 
-	for {
-		for i := 0; i < 5; i++ {
-			err, isCritical := connectDiscordWebsocket()
-			fmt.Fprintf(os.Stderr, "error occurred with discord's websocket: %v", err)
-			if !isCritical {
-				continue
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	msgChan := make(chan []byte, 100)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case msg := <-msgChan:
+				err = conn.WriteMessage(websocket.TextMessage, msg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "[error] writing message to discord ws %v\n", err)
+				}
+				ticker.Reset(10 * time.Second)
+			case <-ticker.C:
+				err = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":1,"d":4}`))
+				if err != nil {
+					return
+				}
 			}
-			panic(err)
 		}
+	}()
+
+	fetchSoundboardSounds := func() {
+		msgChan <- []byte(`{"op":31,"d":{"guild_ids":["` + guildID + `"]}}`)
+	}
+
+	for recvMsg := range recvMsgChan {
+		gateway.message(recvMsg, fetchSoundboardSounds)
 	}
+	return nil, false
 }
 
 func init() {
@@ -824,4 +2208,65 @@ func init() {
 	clientSecret = os.Getenv("CLIENT_SECRET")
 	authToken = os.Getenv("AUTH_TOKEN")
 	soundsDir = os.Getenv("SOUNDS_DIR")
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			panic(err)
+		}
+		trashRetention = d
+	}
+	if base := os.Getenv("DISCORD_CDN_URL"); base != "" {
+		cdnBaseURL = base
+	}
+	if size := os.Getenv("CDN_CACHE_SIZE"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n <= 0 {
+			panic(fmt.Sprintf("CDN_CACHE_SIZE must be a positive number of bytes, got %q", size))
+		}
+		cdnCacheSize = n
+	}
+	if format := os.Getenv("TRANSCODE_FORMAT"); format != "" {
+		t, err := newFFmpegTranscoder(os.Getenv("FFMPEG_PATH"), format, os.Getenv("TRANSCODE_BITRATE"))
+		if err != nil {
+			panic(err)
+		}
+		transcoder = t
+	}
+	// fitting and normalizing need ffmpeg even when saves aren't transcoded.
+	ffmpegBackend := func() *ffmpegTranscoder {
+		if t, ok := transcoder.(*ffmpegTranscoder); ok {
+			return t
+		}
+		t, err := newFFmpegTranscoder(os.Getenv("FFMPEG_PATH"), "mp3", os.Getenv("TRANSCODE_BITRATE"))
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	if os.Getenv("FIT_SOUNDS") != "" {
+		soundboardFitter = ffmpegBackend()
+	}
+	clipEditor = ffmpegBackend()
+	// loudness is measured whenever it can be, LOUDNESS_MODE only decides
+	// what's done with it.
+	if backend := ffmpegBackend(); backend.available() {
+		pcmDecoder = backend
+		loudnessMeter = backend
+	} else {
+		fmt.Fprintf(os.Stderr, "[warn] %s not found, sounds won't be fingerprinted, measured or get waveforms\n", backend.ffmpegPath)
+	}
+	loudnessGainer = ffmpegBackend()
+	if mode := os.Getenv("LOUDNESS_MODE"); mode != "" {
+		if mode != loudnessModeVolume && mode != loudnessModeGain {
+			panic(fmt.Sprintf("LOUDNESS_MODE must be %q or %q", loudnessModeVolume, loudnessModeGain))
+		}
+		loudnessMode = mode
+	}
+	if target := os.Getenv("LOUDNESS_TARGET"); target != "" {
+		t, err := strconv.ParseFloat(target, 64)
+		if err != nil {
+			panic(err)
+		}
+		loudnessTarget = t
+	}
 }
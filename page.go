@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/url"
+	"regexp"
+)
+
+// The page and its assets are built into dist by vite (pnpm build) and
+// embedded, so the binary serves them from wherever it runs. dist/robots.txt
+// is committed so this builds before the first vite build, and vite copies
+// the same file in from public on every build.
+//
+//go:embed dist
+var distFS embed.FS
+
+// staticFiles is dist as it's served.
+var staticFiles = func() fs.FS {
+	files, err := fs.Sub(distFS, "dist")
+	if err != nil {
+		panic(err)
+	}
+	return files
+}()
+
+// pagePlaceholder matches the empty elements index.html leaves for the board
+// to fill in, the id is the first group.
+var pagePlaceholder = regexp.MustCompile(`<(?:div|span) id="([a-z-]+)"(?: hidden)?></(?:div|span)>`)
+
+// renderPage fills the empty elements in page with the fragment for their id,
+// leaving the ones fragments doesn't have, and has the websocket resume from
+// lastEventID rather than start over from a snapshot of what's already on
+// the page.
+func renderPage(page []byte, fragments map[string][]byte, lastEventID string) []byte {
+	page = pagePlaceholder.ReplaceAllFunc(page, func(element []byte) []byte {
+		id := pagePlaceholder.FindSubmatch(element)[1]
+		if fragment, ok := fragments[string(id)]; ok {
+			return fragment
+		}
+		return element
+	})
+	return bytes.Replace(page, []byte(`ws-connect="/ws"`), []byte(`ws-connect="/ws?lastEventID=`+url.QueryEscape(lastEventID)+`"`), 1)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Discord refuses soundboard sounds over these limits.
+const (
+	maxSoundboardDuration = 5200 * time.Millisecond
+	maxSoundboardSize     = 512 * 1024
+)
+
+type SoundProbe struct {
+	Format     string // "vorbis", "opus" or "mp3"
+	Duration   time.Duration
+	Bitrate    int // average, in bits per second
+	SampleRate int
+	Size       int
+}
+
+// TooLong and TooLarge report whether Discord would reject the sound.
+func (p SoundProbe) TooLong() bool  { return p.Duration > maxSoundboardDuration }
+func (p SoundProbe) TooLarge() bool { return p.Size > maxSoundboardSize }
+
+// LimitWarning describes why the sound won't fit on the soundboard, or returns
+// "" if it will.
+func (p SoundProbe) LimitWarning() string {
+	switch {
+	case p.TooLong() && p.TooLarge():
+		return fmt.Sprintf("%.2fs and %dKB, over Discord's %gs and %dKB limits", p.Duration.Seconds(), p.Size/1024, maxSoundboardDuration.Seconds(), maxSoundboardSize/1024)
+	case p.TooLong():
+		return fmt.Sprintf("%.2fs, over Discord's %gs limit", p.Duration.Seconds(), maxSoundboardDuration.Seconds())
+	case p.TooLarge():
+		return fmt.Sprintf("%dKB, over Discord's %dKB limit", p.Size/1024, maxSoundboardSize/1024)
+	}
+	return ""
+}
+
+var errUnknownFormat = errors.New("unknown audio format")
+
+// probeSound reads duration and bitrate out of Ogg (Vorbis or Opus) and MP3
+// headers without decoding any audio.
+func probeSound(data []byte) (SoundProbe, error) {
+	format, err := detectSoundFormat(data)
+	if err != nil {
+		return SoundProbe{}, err
+	}
+	var probe SoundProbe
+	switch format {
+	case formatOgg:
+		probe, err = probeOgg(data)
+	case formatMP3:
+		probe, err = probeMP3(data)
+	default:
+		return SoundProbe{}, errUnknownFormat
+	}
+	if err != nil {
+		return SoundProbe{}, err
+	}
+	probe.Size = len(data)
+	if probe.Duration > 0 {
+		probe.Bitrate = int(float64(len(data)*8) / probe.Duration.Seconds())
+	}
+	return probe, nil
+}
+
+// probeOgg walks the Ogg pages of the first logical stream. The codec comes
+// from the first packet and the duration from the last granule position.
+func probeOgg(data []byte) (SoundProbe, error) {
+	var probe SoundProbe
+	var serial uint32
+	preSkip := int64(0)
+	lastGranule := int64(-1)
+	first := true
+
+	for offset := 0; offset+27 <= len(data); {
+		page := data[offset:]
+		if !bytes.HasPrefix(page, []byte("OggS")) {
+			return SoundProbe{}, fmt.Errorf("bad ogg page at byte %d", offset)
+		}
+		segments := int(page[26])
+		if len(page) < 27+segments {
+			break
+		}
+		bodySize := 0
+		for _, s := range page[27 : 27+segments] {
+			bodySize += int(s)
+		}
+		body := page[27+segments:]
+		if len(body) > bodySize {
+			body = body[:bodySize]
+		}
+		granule := int64(binary.LittleEndian.Uint64(page[6:14]))
+		pageSerial := binary.LittleEndian.Uint32(page[14:18])
+
+		if first {
+			serial = pageSerial
+			switch {
+			case bytes.HasPrefix(body, []byte("\x01vorbis")) && len(body) >= 16:
+				probe.Format = "vorbis"
+				probe.SampleRate = int(binary.LittleEndian.Uint32(body[12:16]))
+			case bytes.HasPrefix(body, []byte("OpusHead")) && len(body) >= 12:
+				probe.Format = "opus"
+				// opus always decodes at 48kHz regardless of the input rate.
+				probe.SampleRate = 48000
+				preSkip = int64(binary.LittleEndian.Uint16(body[10:12]))
+			default:
+				return SoundProbe{}, errors.New("ogg stream isn't vorbis or opus")
+			}
+			first = false
+		} else if pageSerial == serial && granule != -1 {
+			// -1 means no packet ends on the page, anything else below 0
+			// isn't a position.
+			if granule < 0 {
+				return SoundProbe{}, fmt.Errorf("bad granule position %d at byte %d", granule, offset)
+			}
+			lastGranule = granule
+		}
+
+		offset += 27 + segments + bodySize
+	}
+
+	if probe.SampleRate == 0 {
+		return SoundProbe{}, errors.New("ogg stream has no sample rate")
+	}
+	if lastGranule > preSkip {
+		samples := lastGranule - preSkip
+		if samples/int64(probe.SampleRate) >= int64(math.MaxInt64/time.Second) {
+			return SoundProbe{}, fmt.Errorf("granule position %d is too far in to be a duration", lastGranule)
+		}
+		probe.Duration = time.Duration(samples) * time.Second / time.Duration(probe.SampleRate)
+	}
+	return probe, nil
+}
+
+var (
+	// indexed by [version][layer][bitrate index], in kbps. Version 0 is MPEG-1,
+	// 1 is MPEG-2 and 2.5. Layers are 1 through 3.
+	mp3Bitrates = [2][4][16]int{
+		{
+			{},
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		},
+		{
+			{},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		},
+	}
+	// indexed by the two version bits and the sample rate index.
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},  // MPEG 2.5
+		{},                    // reserved
+		{22050, 24000, 16000}, // MPEG 2
+		{44100, 48000, 32000}, // MPEG 1
+	}
+)
+
+type mp3Frame struct {
+	size       int
+	samples    int
+	sampleRate int
+	// tagOffset is where a Xing or Info header would start, after the side
+	// information. It's 0 for layers other than 3, which don't have them.
+	tagOffset int
+}
+
+func parseMP3Frame(header []byte) (mp3Frame, bool) {
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	versionBits := (header[1] >> 3) & 0x3
+	layerBits := (header[1] >> 1) & 0x3
+	bitrateIndex := header[2] >> 4
+	sampleRateIndex := (header[2] >> 2) & 0x3
+	padding := int((header[2] >> 1) & 0x1)
+	if versionBits == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	layer := 4 - int(layerBits)
+	version := 0
+	if versionBits != 3 {
+		version = 1
+	}
+	bitrate := mp3Bitrates[version][layer][bitrateIndex] * 1000
+	sampleRate := mp3SampleRates[versionBits][sampleRateIndex]
+
+	var frame mp3Frame
+	frame.sampleRate = sampleRate
+	if layer == 3 {
+		mono := header[3]>>6 == 3
+		switch {
+		case version == 0 && mono:
+			frame.tagOffset = 4 + 17
+		case version == 0:
+			frame.tagOffset = 4 + 32
+		case mono:
+			frame.tagOffset = 4 + 9
+		default:
+			frame.tagOffset = 4 + 17
+		}
+	}
+	switch {
+	case layer == 1:
+		frame.samples = 384
+		frame.size = (12*bitrate/sampleRate + padding) * 4
+	case layer == 3 && version == 1:
+		frame.samples = 576
+		frame.size = 72*bitrate/sampleRate + padding
+	default:
+		frame.samples = 1152
+		frame.size = 144*bitrate/sampleRate + padding
+	}
+	return frame, frame.size > 4
+}
+
+// isXingFrame reports whether frame, at the start of data, is the Xing (or
+// Info, for CBR) frame some encoders put first. It describes the file and
+// decodes to silence, it isn't part of the sound.
+func isXingFrame(data []byte, frame mp3Frame) bool {
+	if frame.tagOffset == 0 || len(data) < frame.tagOffset+4 {
+		return false
+	}
+	tag := string(data[frame.tagOffset : frame.tagOffset+4])
+	return tag == "Xing" || tag == "Info"
+}
+
+// probeMP3 skips any ID3v2 tag and adds up every frame, which handles VBR files
+// with or without a Xing header as well as CBR ones.
+func probeMP3(data []byte) (SoundProbe, error) {
+	offset := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		offset = 10 + size
+		if data[5]&0x10 != 0 { // footer present
+			offset += 10
+		}
+	}
+
+	// some encoders pad between the tag and the first frame.
+	for offset+4 <= len(data) {
+		if _, ok := parseMP3Frame(data[offset:]); ok {
+			break
+		}
+		offset++
+	}
+
+	var probe SoundProbe
+	if frame, ok := parseMP3Frame(data[min(offset, len(data)):]); ok && isXingFrame(data[offset:], frame) {
+		probe.SampleRate = frame.sampleRate
+		offset += frame.size
+	}
+	samples := 0
+	for offset+4 <= len(data) {
+		frame, ok := parseMP3Frame(data[offset:])
+		if !ok {
+			break
+		}
+		if probe.SampleRate == 0 {
+			probe.SampleRate = frame.sampleRate
+		}
+		samples += frame.samples
+		offset += frame.size
+	}
+	if probe.SampleRate == 0 {
+		return SoundProbe{}, errors.New("no mp3 frames found")
+	}
+	probe.Format = "mp3"
+	probe.Duration = time.Duration(samples) * time.Second / time.Duration(probe.SampleRate)
+	return probe, nil
+}
+
+// probeStoredSounds probes everything in storedSoundMap, keyed the same way.
+// Sounds that can't be probed are left out.
+func probeStoredSounds(storedSoundMap map[string][]byte) map[string]SoundProbe {
+	probes := make(map[string]SoundProbe, len(storedSoundMap))
+	for name, data := range storedSoundMap {
+		if probe, err := probeSound(data); err == nil {
+			probes[name] = probe
+		}
+	}
+	return probes
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// testMP3Frame is a frame with header and size bytes in all, with tag (a Xing
+// header, say) at offset.
+func testMP3Frame(header string, size int, offset int, tag string) []byte {
+	frame := make([]byte, size)
+	copy(frame, header)
+	copy(frame[offset:], tag)
+	return frame
+}
+
+// MPEG-1 layer 3 at 44.1kHz, 1152 samples a frame.
+const (
+	mp3Header128k = "\xFF\xFB\x90\x00" // 417 bytes
+	mp3Header320k = "\xFF\xFB\xE0\x00" // 1044 bytes
+	mp3HeaderMono = "\xFF\xFB\x90\xC0"
+	mp3HeaderFree = "\xFF\xFB\x00\x00" // bitrate index 0, free format
+)
+
+func mp3FramesLasting(count int) time.Duration {
+	return time.Duration(count*1152) * time.Second / 44100
+}
+
+func testMP3Frames(header string, size, count int) []byte {
+	var data []byte
+	for i := 0; i < count; i++ {
+		data = append(data, testMP3Frame(header, size, 0, "")...)
+	}
+	return data
+}
+
+func TestProbeSound(t *testing.T) {
+	vorbis := testVorbis()
+	opusHead := make([]byte, 19)
+	copy(opusHead, "OpusHead")
+	binary.LittleEndian.PutUint16(opusHead[10:12], 312)
+	vorbisIdent := vorbis[28 : 28+30]
+	cbr := testMP3Frames(mp3Header128k, 417, 10)
+
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		format   string
+		duration time.Duration
+		ok       bool
+	}{
+		{"vorbis", vorbis, "vorbis", time.Second, true},
+		{"opus pre-skip", append(oggPage(1, 0, opusHead), oggPage(1, 48000+312, []byte("audio"))...), "opus", time.Second, true},
+		// the header of the last page is all that's needed.
+		{"truncated last page", vorbis[:len(vorbis)-3], "vorbis", time.Second, true},
+		{"truncated page header", vorbis[:len(vorbis)-20], "vorbis", 0, true},
+		{"truncated first page", vorbis[:20], "", 0, false},
+		{"garbage between pages", append(append(oggPage(1, 0, vorbisIdent), "junk"...), oggPage(1, 44100, []byte("audio"))...), "", 0, false},
+		{"no granule on the last page", append(vorbis, oggPage(1, -1, []byte("more"))...), "vorbis", time.Second, true},
+		{"another stream's granule", append(vorbis, oggPage(2, 10*44100, []byte("other"))...), "vorbis", time.Second, true},
+		{"granule before the pre-skip", append(oggPage(1, 0, opusHead), oggPage(1, 100, []byte("audio"))...), "opus", 0, true},
+		{"negative granule", append(oggPage(1, 0, vorbisIdent), oggPage(1, -2, []byte("audio"))...), "", 0, false},
+		{"granule too big to be a duration", append(oggPage(1, 0, vorbisIdent), oggPage(1, math.MaxInt64, []byte("audio"))...), "", 0, false},
+		{"ogg that isn't vorbis or opus", append(oggPage(1, 0, []byte("\x80theora")), oggPage(1, 100, nil)...), "", 0, false},
+
+		{"cbr mp3", cbr, "mp3", mp3FramesLasting(10), true},
+		{"id3 tag and padding", append(append([]byte("ID3\x04\x00\x00\x00\x00\x00\x04tag!"), 0, 0, 0), cbr...), "mp3", mp3FramesLasting(10), true},
+		{"vbr mp3", append(testMP3Frames(mp3Header320k, 1044, 3), cbr...), "mp3", mp3FramesLasting(13), true},
+		// the Xing frame describes the rest, it isn't audio itself.
+		{"vbr mp3 with a xing header", append(testMP3Frame(mp3Header128k, 417, 36, "Xing"), cbr...), "mp3", mp3FramesLasting(10), true},
+		{"cbr mp3 with an info header", append(testMP3Frame(mp3HeaderMono, 417, 21, "Info"), cbr...), "mp3", mp3FramesLasting(10), true},
+		{"zero bitrate frame", append(cbr, testMP3Frame(mp3HeaderFree, 417, 0, "")...), "mp3", mp3FramesLasting(10), true},
+		{"only zero bitrate frames", append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), testMP3Frames(mp3HeaderFree, 417, 3)...), "", 0, false},
+		{"truncated mp3 frame", cbr[:417+2], "mp3", mp3FramesLasting(1), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := probeSound(tt.data)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", probe)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if probe.Format != tt.format || probe.Duration != tt.duration || probe.Size != len(tt.data) {
+				t.Errorf("expected %s lasting %v, got %+v", tt.format, tt.duration, probe)
+			}
+		})
+	}
+}
+
+func TestProbeMP3Bitrate(t *testing.T) {
+	probe, err := probeSound(testMP3Frames(mp3Header128k, 417, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the frames round down, so it's just under 128kbps.
+	if probe.Bitrate < 127000 || probe.Bitrate > 128000 || probe.SampleRate != 44100 {
+		t.Errorf("expected about 128kbps at 44.1kHz, got %+v", probe)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fragmentCache keeps rendered, minified fragments so an update only
+// renders what changed and a new connection mostly gets bytes that are
+// already there.
+//
+//   - a sound card is keyed by everything that goes into it, so it's never
+//     stale and a slot that didn't change isn't rendered again.
+//   - the library list is kept until the library changes or a sound goes on
+//     or comes off the board, since those are hidden from it. Its cards are
+//     kept until the library changes, so putting a sound on the board only
+//     renders that sound's card again.
+//   - a snapshot is kept for the state version and inputs it was rendered
+//     from, every client joining with those gets the same frames.
+type fragmentCache struct {
+	mu          sync.Mutex
+	cards       map[cardKey][]byte
+	library     libraryKey
+	libraryOK   bool
+	libraryHTML []byte
+	// libraryCards are for libraryCardsGeneration of the library.
+	libraryCards           map[libraryCardKey][]byte
+	libraryCardsGeneration int
+	snapshots              map[string]cachedSnapshot
+}
+
+// cardKey is what a sound card is rendered from. Which library sound it
+// matches goes by the inputs to matching rather than the match itself, so
+// the match is only worked out when the card is rendered.
+type cardKey struct {
+	ordinal  int
+	sound    SoundboardSound
+	canSend  bool
+	matches  matchInputs
+	username string
+}
+
+// libraryKey is what the library list is rendered from. generation goes up
+// every time the library is reread from disk.
+type libraryKey struct {
+	generation int
+	onBoard    string // names on the board, sorted and joined
+}
+
+// libraryCardKey is what a library card is rendered from, besides the
+// library itself.
+type libraryCardKey struct {
+	location string
+	onBoard  bool
+}
+
+// snapshotKey is what a snapshot is rendered from. The state version isn't
+// enough by itself, which library sound a board sound matches and who
+// uploaded it are learned without anything being broadcast. The cards cover
+// both, for the JSON snapshot too.
+type snapshotKey struct {
+	version          uint64
+	cards            [soundboardSoundCount]cardKey
+	library          libraryKey
+	gatewayConnected bool
+}
+
+type cachedSnapshot struct {
+	key    snapshotKey
+	frames []hubFrame
+}
+
+// fragmentCacheMaxCards bounds the cards kept, there are only ever
+// soundboardSoundCount current ones and the rest are old.
+const fragmentCacheMaxCards = 8 * soundboardSoundCount
+
+func newFragmentCache() *fragmentCache {
+	return &fragmentCache{
+		cards:     make(map[cardKey][]byte),
+		snapshots: make(map[string]cachedSnapshot),
+	}
+}
+
+// card returns the card for key, rendering it if it isn't kept.
+func (c *fragmentCache) card(key cardKey, render func() []byte) []byte {
+	c.mu.Lock()
+	html, ok := c.cards[key]
+	c.mu.Unlock()
+	if ok {
+		return html
+	}
+	html = render()
+	c.mu.Lock()
+	if len(c.cards) >= fragmentCacheMaxCards {
+		c.cards = make(map[cardKey][]byte)
+	}
+	c.cards[key] = html
+	c.mu.Unlock()
+	return html
+}
+
+// libraryList returns the library list for key, rendering it if the kept one
+// is for something else.
+func (c *fragmentCache) libraryList(key libraryKey, render func() []byte) []byte {
+	c.mu.Lock()
+	if c.libraryOK && c.library == key {
+		html := c.libraryHTML
+		c.mu.Unlock()
+		return html
+	}
+	c.mu.Unlock()
+	html := render()
+	c.mu.Lock()
+	c.library, c.libraryHTML, c.libraryOK = key, html, true
+	c.mu.Unlock()
+	return html
+}
+
+// libraryCard returns the card for key in generation of the library,
+// rendering it if it isn't kept.
+func (c *fragmentCache) libraryCard(generation int, key libraryCardKey, render func() []byte) []byte {
+	c.mu.Lock()
+	if c.libraryCards == nil || c.libraryCardsGeneration != generation {
+		c.libraryCards, c.libraryCardsGeneration = make(map[libraryCardKey][]byte), generation
+	}
+	html, ok := c.libraryCards[key]
+	c.mu.Unlock()
+	if ok {
+		return html
+	}
+	html = render()
+	c.mu.Lock()
+	if c.libraryCardsGeneration == generation {
+		c.libraryCards[key] = html
+	}
+	c.mu.Unlock()
+	return html
+}
+
+// snapshot returns the snapshot for protocol and key, rendering it if the
+// kept one is for something else. Callers mustn't change the frames.
+func (c *fragmentCache) snapshot(protocol string, key snapshotKey, render func() []hubFrame) []hubFrame {
+	c.mu.Lock()
+	kept, ok := c.snapshots[protocol]
+	c.mu.Unlock()
+	if ok && kept.key == key {
+		return kept.frames
+	}
+	frames := render()
+	c.mu.Lock()
+	c.snapshots[protocol] = cachedSnapshot{key: key, frames: frames}
+	c.mu.Unlock()
+	return frames
+}
+
+// boardNames is the onBoard part of a libraryKey.
+func boardNames(sounds []SoundboardSound) string {
+	names := make([]string, 0, len(sounds))
+	for _, sound := range sounds {
+		if sound != (SoundboardSound{}) {
+			names = append(names, sound.Name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\x00")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/minify"
+	"github.com/tdewolff/minify/html"
+)
+
+func TestFragmentCacheSnapshot(t *testing.T) {
+	cache := newFragmentCache()
+	renders := 0
+	render := func() []hubFrame {
+		renders++
+		return []hubFrame{{wsFrame: wsFrame{data: []byte(strconv.Itoa(renders))}}}
+	}
+
+	key := snapshotKey{version: 1}
+	cache.snapshot(wsProtocolHTMX, key, render)
+	cache.snapshot(wsProtocolHTMX, key, render)
+	if renders != 1 {
+		t.Fatalf("expected one render for the same key, got %d", renders)
+	}
+	cache.snapshot(wsProtocolJSON, key, render)
+	if renders != 2 {
+		t.Fatalf("expected each protocol to be rendered, got %d renders", renders)
+	}
+
+	// a board sound fingerprinted after it was broadcast may match the library now.
+	key.cards[3].matches.boardPrints++
+	frames := cache.snapshot(wsProtocolHTMX, key, render)
+	if renders != 3 || string(frames[0].data) != "3" {
+		t.Fatalf("expected new match inputs to render again, got %d renders", renders)
+	}
+	key.cards[0].username = "someone"
+	cache.snapshot(wsProtocolHTMX, key, render)
+	if renders != 4 {
+		t.Fatalf("expected a new uploader name to render again, got %d renders", renders)
+	}
+}
+
+// renderBenchmark is a made up board and library to compare rendering
+// everything for every new connection and update, as we used to, with going
+// through a fragmentCache.
+type renderBenchmark struct {
+	m       *minify.M
+	board   [soundboardSoundCount]SoundboardSound
+	library []string
+	cache   *fragmentCache
+}
+
+func newRenderBenchmark(librarySize int) *renderBenchmark {
+	r := &renderBenchmark{m: minify.New(), library: make([]string, librarySize), cache: newFragmentCache()}
+	r.m.AddFunc("text/html", html.Minify)
+	for i := range r.board {
+		r.board[i] = SoundboardSound{Name: fmt.Sprintf("sound%d", i), ID: strconv.Itoa(1000000 + i), UserID: "1"}
+	}
+	for i := range r.library {
+		r.library[i] = fmt.Sprintf("folder%d/library sound %d", i%20, i)
+	}
+	return r
+}
+
+func (r *renderBenchmark) minifyHTML(fragment string) []byte {
+	var minified bytes.Buffer
+	r.m.Minify("text/html", &minified, strings.NewReader(fragment))
+	return minified.Bytes()
+}
+
+func (r *renderBenchmark) onBoard(location string) bool {
+	for _, sound := range r.board {
+		if sound.Name == path.Base(location) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *renderBenchmark) renderCard(i int) []byte {
+	sound := r.board[i]
+	return r.minifyHTML(soundCardComponent(i, sound.ID, sound.Name, true, sound.Name, true, deleteButton(sound.ID, guildID, "someone", avatarURL(sound.UserID), false)))
+}
+
+func (r *renderBenchmark) cachedCard(i int) []byte {
+	key := cardKey{ordinal: i, sound: r.board[i], canSend: true, username: "someone"}
+	return r.cache.card(key, func() []byte { return r.renderCard(i) })
+}
+
+func (r *renderBenchmark) renderLibrary() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<div id="storedsounds" class="flex flex-1 flex-wrap justify-center items-center max-w-7xl">`)
+	for _, location := range r.library {
+		buf.WriteString(addSoundCardComponent(location, ".ogg", guildID, r.onBoard(location), "", ""))
+	}
+	buf.WriteString("</div>")
+	buf.WriteString(trashComponent(nil, trashRetention))
+	return r.minifyHTML(buf.String())
+}
+
+func (r *renderBenchmark) cachedLibrary() []byte {
+	return r.cache.libraryList(libraryKey{generation: 1, onBoard: boardNames(r.board[:])}, func() []byte {
+		var buf bytes.Buffer
+		buf.WriteString(`<div id="storedsounds" class="flex flex-1 flex-wrap justify-center items-center max-w-7xl">`)
+		for _, location := range r.library {
+			ok := r.onBoard(location)
+			buf.Write(r.cache.libraryCard(1, libraryCardKey{location: location, onBoard: ok}, func() []byte {
+				return r.minifyHTML(addSoundCardComponent(location, ".ogg", guildID, ok, "", ""))
+			}))
+		}
+		buf.WriteString("</div>")
+		buf.Write(r.minifyHTML(trashComponent(nil, trashRetention)))
+		return buf.Bytes()
+	})
+}
+
+func (r *renderBenchmark) snapshot(cards func(i int) []byte, libraryList func() []byte) []hubFrame {
+	var buf bytes.Buffer
+	for i := range r.board {
+		buf.Write(cards(i))
+	}
+	buf.Write(libraryList())
+	return []hubFrame{{wsFrame: wsFrame{data: buf.Bytes()}}}
+}
+
+func (r *renderBenchmark) snapshotKey(version uint64) snapshotKey {
+	key := snapshotKey{version: version, library: libraryKey{generation: 1, onBoard: boardNames(r.board[:])}}
+	for i, sound := range r.board {
+		key.cards[i] = cardKey{ordinal: i, sound: sound, canSend: true, username: "someone"}
+	}
+	return key
+}
+
+var benchmarkLibrarySizes = []int{100, 1000, 5000}
+
+// BenchmarkConnect is a client joining, which needs the whole board and
+// library.
+func BenchmarkConnect(b *testing.B) {
+	for _, size := range benchmarkLibrarySizes {
+		r := newRenderBenchmark(size)
+		b.Run(fmt.Sprintf("library=%d/rendered", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.snapshot(r.renderCard, r.renderLibrary)
+			}
+		})
+		b.Run(fmt.Sprintf("library=%d/cached", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.cache.snapshot(wsProtocolHTMX, r.snapshotKey(1), func() []hubFrame { return r.snapshot(r.cachedCard, r.cachedLibrary) })
+			}
+		})
+		b.Run(fmt.Sprintf("library=%d/cached after a swap", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// every connection at a new version, with a library sound
+				// swapped on or off the board.
+				r.board[0].Name = path.Base(r.library[i%2])
+				r.cache.snapshot(wsProtocolHTMX, r.snapshotKey(uint64(i+2)), func() []hubFrame { return r.snapshot(r.cachedCard, r.cachedLibrary) })
+			}
+			r.board[0].Name = "sound0"
+		})
+	}
+}
+
+// BenchmarkSlotUpdate is a sound going on or coming off the board, which
+// every client gets.
+func BenchmarkSlotUpdate(b *testing.B) {
+	r := newRenderBenchmark(0)
+	b.Run("rendered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.renderCard(i % soundboardSoundCount)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.cachedCard(i % soundboardSoundCount)
+		}
+	})
+}
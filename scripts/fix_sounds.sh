@@ -1,3 +1,4 @@
 #!/bin/bash
 
-find -name '*.ogg' | sed s/.ogg$/.mp3/ | xargs -I {} make -j4 "{}"
\ No newline at end of file
+# Superseded by the server's own migration, which also keeps the originals.
+TRANSCODE_FORMAT=${TRANSCODE_FORMAT:-mp3} go run . migrate-library "$@"
\ No newline at end of file
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// testUserID is who the fake Discord says we are, testOtherUserID someone
+// else in the guild.
+const (
+	testUserID      = "1000"
+	testOtherUserID = "1001"
+)
+
+// fakeDiscord stands in for Discord: its REST API, its gateway, which tells
+// the server about the board after every change the way the real one does,
+// and its CDN, which serves every sound it's ever had.
+type fakeDiscord struct {
+	mu      sync.Mutex
+	gateway gatewayHandler
+	sounds  []SoundData
+	audio   map[string][]byte
+	nextID  int
+	played  []string
+	// down fails every request with it, the CDN's too, as if Discord was
+	// down.
+	down error
+	cdn  *httptest.Server
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	d := &fakeDiscord{audio: make(map[string][]byte), nextID: 2000}
+	d.cdn = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		data, ok := d.audio[strings.TrimPrefix(r.URL.Path, "/soundboard-sounds/")]
+		down := d.down
+		d.mu.Unlock()
+		if down != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(d.cdn.Close)
+	return d
+}
+
+func (d *fakeDiscord) GetUserId() string {
+	return testUserID
+}
+
+func (d *fakeDiscord) GetUser(userID string) (UserInfo, error) {
+	return UserInfo{UserID: userID, Username: "user" + userID}, nil
+}
+
+func (d *fakeDiscord) SendSoundboardSound(guildId, channelId, soundId string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down != nil {
+		return d.down
+	}
+	if d.find(soundId) < 0 {
+		return errors.New("HTTP 404 Not Found, Unknown Sound")
+	}
+	d.played = append(d.played, soundId)
+	return nil
+}
+
+func (d *fakeDiscord) DeleteSoundboardSound(guildId, soundId string) error {
+	d.mu.Lock()
+	if d.down != nil {
+		d.mu.Unlock()
+		return d.down
+	}
+	i := d.find(soundId)
+	if i < 0 {
+		d.mu.Unlock()
+		return errors.New("HTTP 404 Not Found, Unknown Sound")
+	}
+	d.sounds = append(d.sounds[:i], d.sounds[i+1:]...)
+	d.mu.Unlock()
+	d.sendSounds()
+	return nil
+}
+
+func (d *fakeDiscord) CreateSoundboardSound(guildId, name, mimeType string, volume float64, data []byte) (CreateSoundboardSoundResponse, error) {
+	d.mu.Lock()
+	if d.down != nil {
+		d.mu.Unlock()
+		return CreateSoundboardSoundResponse{}, d.down
+	}
+	id := d.add(name, testUserID, data)
+	d.mu.Unlock()
+	d.sendSounds()
+	return CreateSoundboardSoundResponse{Name: name, SoundID: id, ID: id, Volume: float32(volume)}, nil
+}
+
+// add puts a sound on the board and returns its ID. d.mu must be held.
+func (d *fakeDiscord) add(name, userID string, data []byte) string {
+	d.nextID++
+	id := strconv.Itoa(d.nextID)
+	d.sounds = append(d.sounds, SoundData{SoundID: id, Name: name, UserID: userID, User: UserData{ID: userID, Username: "user" + userID}})
+	d.audio[id] = data
+	return id
+}
+
+// find expects d.mu to be held.
+func (d *fakeDiscord) find(soundID string) int {
+	for i, sound := range d.sounds {
+		if sound.SoundID == soundID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *fakeDiscord) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = err
+}
+
+// sendSounds tells the server what's on the board, like the gateway does
+// after a sound is created or deleted.
+func (d *fakeDiscord) sendSounds() {
+	d.mu.Lock()
+	sounds := append([]SoundData{}, d.sounds...)
+	d.mu.Unlock()
+	d.send("SOUNDBOARD_SOUNDS", &DiscordMessageData{GuildID: guildID, SoundboardSounds: sounds})
+}
+
+func (d *fakeDiscord) send(messageType string, data *DiscordMessageData) {
+	d.gateway.message(DiscordMessage{Type: &messageType, Data: data}, d.sendSounds)
+}
+
+// testServer is the whole server in front of a fake Discord. The library has
+// memes/NoOneHeard.ogg, airhorn.ogg and bruh.ogg, and the board has
+// NoOneHeard, uploaded by us, and bruh, uploaded by someone else.
+type testServer struct {
+	*httptest.Server
+	discord *fakeDiscord
+}
+
+var testLibrary = map[string][]byte{
+	"memes/NoOneHeard.ogg": testVorbis(),
+	"airhorn.ogg":          testVorbisLasting(2 * time.Second),
+	"bruh.ogg":             testVorbisLasting(3 * time.Second),
+}
+
+func newTestServer(t *testing.T) *testServer {
+	oldSoundsDir, oldCDNBaseURL, oldPCMDecoder, oldLoudnessMeter := soundsDir, cdnBaseURL, pcmDecoder, loudnessMeter
+	t.Cleanup(func() {
+		soundsDir, cdnBaseURL, pcmDecoder, loudnessMeter = oldSoundsDir, oldCDNBaseURL, oldPCMDecoder, oldLoudnessMeter
+	})
+	dir, err := os.MkdirTemp("", "soundboard-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not t.TempDir, the server may still be caching a sound from the CDN
+	// when it's removed.
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	soundsDir = dir
+	// nothing is fingerprinted or measured in the background, to keep what's
+	// in soundsDir down to what the test does.
+	pcmDecoder, loudnessMeter = nil, nil
+	for location, data := range testLibrary {
+		p := filepath.Join(soundsDir, filepath.FromSlash(location))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := newFakeDiscord(t)
+	cdnBaseURL = d.cdn.URL
+	handler, gateway := newServer(d)
+	d.gateway = gateway
+	s := &testServer{Server: httptest.NewServer(handler), discord: d}
+	t.Cleanup(s.Close)
+
+	d.send("READY", &DiscordMessageData{Users: []UserData{
+		{ID: testUserID, Username: "user" + testUserID},
+		{ID: testOtherUserID, Username: "user" + testOtherUserID},
+	}})
+	d.mu.Lock()
+	d.add("NoOneHeard", testUserID, testLibrary["memes/NoOneHeard.ogg"])
+	d.add("bruh", testOtherUserID, testLibrary["bruh.ogg"])
+	d.mu.Unlock()
+	d.sendSounds()
+	s.settle(t)
+	t.Cleanup(func() { s.settle(t) })
+	return s
+}
+
+// settle waits for the server to fetch every board sound and find it in the
+// library, saving it first if it has to. It does that in the background as
+// sounds come on the board.
+func (s *testServer) settle(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var board apiBoard
+		s.getJSON(t, "/api/v1/board", &board)
+		settled := true
+		for _, slot := range board.Slots {
+			if slot.Sound != nil && slot.Sound.LibraryName == "" {
+				settled = false
+			}
+		}
+		if settled {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the board's sounds never matched the library: %+v", board)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *testServer) getJSON(t *testing.T, p string, v any) {
+	t.Helper()
+	resp, err := s.Client().Get(s.URL + p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", p, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", p, err)
+	}
+}
+
+// boardSound returns the ID of the board sound called name.
+func (s *testServer) boardSound(t *testing.T, name string) string {
+	t.Helper()
+	s.discord.mu.Lock()
+	defer s.discord.mu.Unlock()
+	for _, sound := range s.discord.sounds {
+		if sound.Name == name {
+			return sound.SoundID
+		}
+	}
+	t.Fatalf("%s isn't on the board", name)
+	return ""
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -11,7 +12,7 @@ type deleteSoundInput struct {
 	SoundID string `json:"soundID"`
 }
 
-func deleteSound(discordClient *DiscordRestClient, guildID string, input deleteSoundInput) error {
+func deleteSound(discordClient soundboardAPI, guildID string, input deleteSoundInput) error {
 	err := discordClient.DeleteSoundboardSound(guildID, input.SoundID)
 	if err != nil {
 		return fmt.Errorf("[error] deleting file %v", err)
@@ -23,25 +24,85 @@ type addSoundInput struct {
 	SoundLocation string `json:"soundLocation"`
 }
 
-func addSound(discordClient *DiscordRestClient, storedSoundMap map[string][]byte, input addSoundInput) error {
+// errSoundRejected means a sound can't go on the board as it is, it's too
+// long, too large or not audio Discord knows.
+var errSoundRejected = errors.New("Discord won't take this sound")
+
+// preparedSound is a library sound that's ready to upload to the board.
+type preparedSound struct {
+	location string
+	name     string
+	mimeType string
+	volume   float64
+	data     []byte
+}
+
+func addSound(discordClient soundboardAPI, storedSoundMap map[string][]byte, metadata *soundMetadataStore, input addSoundInput) (CreateSoundboardSoundResponse, error) {
+	sound, err := prepareSound(storedSoundMap, metadata, input)
+	if err != nil {
+		return CreateSoundboardSoundResponse{}, err
+	}
+	return uploadSound(discordClient, sound)
+}
+
+// prepareSound reads, normalizes and checks the sound at input.SoundLocation
+// without touching the board, so whatever's wrong with it comes up before
+// anything is taken off the board for it.
+func prepareSound(storedSoundMap map[string][]byte, metadata *soundMetadataStore, input addSoundInput) (preparedSound, error) {
 	soundLocation := input.SoundLocation
 	ext := path.Ext(soundLocation)
-	nameWithoutExt := strings.TrimSuffix(soundLocation, ext)
+	// sounds can live in folders, but discord only gets the name.
+	nameWithoutExt := path.Base(strings.TrimSuffix(soundLocation, ext))
 	var data []byte
 	if soundData, ok := storedSoundMap[nameWithoutExt]; ok {
 		data = soundData
 	} else {
-		p := path.Join(soundsDir, soundLocation)
+		p, err := libraryPath(soundLocation)
+		if err != nil {
+			return preparedSound{}, err
+		}
 		fileData, err := os.ReadFile(p)
 		if err != nil {
-			return fmt.Errorf("[error] trouble reading file %v", p)
+			return preparedSound{}, fmt.Errorf("[error] trouble reading file %v", p)
 		}
 		data = fileData
 	}
 
-	_, err := discordClient.CreateSoundboardSound(guildID, nameWithoutExt, "audio/"+ext, data)
+	data, ext, volume := normalizeSoundboardSound(nameWithoutExt, data, ext, metadata)
+	data, ext, err := prepareSoundboardSound(nameWithoutExt, data, ext)
 	if err != nil {
-		return fmt.Errorf("[error] creating soundboard sound for %s %v", soundLocation, err)
+		return preparedSound{}, err
 	}
-	return nil
+
+	mimeType, err := soundMIMEType(data, ext)
+	if err != nil {
+		return preparedSound{}, fmt.Errorf("[error] %w: can't tell what kind of audio %s is", errSoundRejected, soundLocation)
+	}
+	return preparedSound{location: soundLocation, name: nameWithoutExt, mimeType: mimeType, volume: volume, data: data}, nil
+}
+
+func uploadSound(discordClient soundboardAPI, sound preparedSound) (CreateSoundboardSoundResponse, error) {
+	created, err := discordClient.CreateSoundboardSound(guildID, sound.name, sound.mimeType, sound.volume, sound.data)
+	if err != nil {
+		return CreateSoundboardSoundResponse{}, fmt.Errorf("[error] creating soundboard sound for %s %v", sound.location, err)
+	}
+	return created, nil
+}
+
+// prepareSoundboardSound checks data against Discord's limits before it's
+// uploaded so we don't have to wait for Discord to refuse it. Sounds we can't
+// probe are passed through and left for Discord to decide on.
+func prepareSoundboardSound(name string, data []byte, ext string) ([]byte, string, error) {
+	probe, err := probeSound(data)
+	if err != nil || (!probe.TooLong() && !probe.TooLarge()) {
+		return data, ext, nil
+	}
+	if soundboardFitter == nil {
+		return nil, "", fmt.Errorf("[error] %w: %s is %s", errSoundRejected, name, probe.LimitWarning())
+	}
+	fitted, fittedExt, err := soundboardFitter.Fit(data, ext, maxSoundboardDuration, maxSoundboardSize)
+	if err != nil {
+		return nil, "", fmt.Errorf("[error] fitting %s: %w", name, err)
+	}
+	return fitted, fittedExt, nil
 }
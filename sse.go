@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /events sends the same updates as /ws as server-sent events, for browsers
+// behind proxies that won't upgrade websockets. Broadcasts get IDs so a
+// reconnecting client can send Last-Event-ID and be replayed what it missed
+// instead of the whole board.
+
+// sseReplaySize is how many broadcasts are kept for replay, and sseReplayBytes
+// how much of them, since an update to the library list can be most of a
+// megabyte. A client that's been gone for longer gets the whole board again.
+const (
+	sseReplaySize  = 256
+	sseReplayBytes = 8 << 20
+)
+
+const sseKeepAlive = 15 * time.Second
+
+type broadcastEntry struct {
+	id      string
+	version uint64
+	frames  map[string][]hubFrame
+}
+
+// broadcastHistory remembers recent broadcasts. It isn't safe for concurrent
+// use, it's kept under the same lock as the clients. Its sequence number is
+// the state version, an event ID is the version with the server's boot.
+type broadcastHistory struct {
+	// boot tells IDs from before a restart apart from ours, their sequence
+	// numbers mean nothing now.
+	boot    string
+	seq     uint64
+	entries []broadcastEntry
+	size    int // bytes in entries' frames
+}
+
+func newBroadcastHistory() *broadcastHistory {
+	return &broadcastHistory{boot: strconv.FormatInt(time.Now().UnixNano(), 36)}
+}
+
+// add records a broadcast and returns its ID.
+func (h *broadcastHistory) add(frames map[string][]hubFrame) string {
+	h.seq++
+	id := h.boot + "-" + strconv.FormatUint(h.seq, 10)
+	h.entries = append(h.entries, broadcastEntry{id: id, version: h.seq, frames: frames})
+	h.size += framesSize(frames)
+	for len(h.entries) > sseReplaySize || (h.size > sseReplayBytes && len(h.entries) > 1) {
+		h.size -= framesSize(h.entries[0].frames)
+		h.entries[0] = broadcastEntry{}
+		h.entries = h.entries[1:]
+	}
+	return id
+}
+
+func framesSize(frames map[string][]hubFrame) int {
+	size := 0
+	for _, protocolFrames := range frames {
+		for _, frame := range protocolFrames {
+			size += len(frame.data)
+		}
+	}
+	return size
+}
+
+// lastID is the ID of the latest broadcast, empty before the first.
+func (h *broadcastHistory) lastID() string {
+	if h.seq == 0 {
+		return ""
+	}
+	return h.boot + "-" + strconv.FormatUint(h.seq, 10)
+}
+
+// since returns the broadcasts after id and the version id was at, or false
+// when they aren't all still kept and the client has to start over.
+func (h *broadcastHistory) since(id string) ([]broadcastEntry, uint64, bool) {
+	boot, seqString, ok := strings.Cut(id, "-")
+	if !ok || boot != h.boot {
+		return nil, 0, false
+	}
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	if err != nil || seq > h.seq {
+		return nil, 0, false
+	}
+	missed := int(h.seq - seq)
+	if missed > len(h.entries) {
+		return nil, 0, false
+	}
+	return h.entries[len(h.entries)-missed:], seq, true
+}
+
+// framesFor flattens broadcasts into the frames a client speaking protocol
+// gets, with each broadcast's ID on its last frame.
+func framesFor(entries []broadcastEntry, protocol string) []hubFrame {
+	var frames []hubFrame
+	for _, entry := range entries {
+		for i, frame := range entry.frames[protocol] {
+			frame.version = entry.version
+			if i == len(entry.frames[protocol])-1 {
+				frame.id = entry.id
+			}
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// writeSSE writes one event. Every line of data gets its own data field, the
+// browser joins them back up with newlines.
+func writeSSE(w io.Writer, frame wsFrame) error {
+	var buf bytes.Buffer
+	if frame.id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", frame.id)
+	}
+	for _, line := range bytes.Split(frame.data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBroadcastHistory(t *testing.T) {
+	h := newBroadcastHistory()
+	frame := func(size int) map[string][]hubFrame {
+		return map[string][]hubFrame{wsProtocolHTMX: {{wsFrame: wsFrame{data: make([]byte, size)}}}}
+	}
+
+	first := h.add(frame(10))
+	for i := 0; i <= sseReplaySize; i++ {
+		h.add(frame(10))
+	}
+	if len(h.entries) != sseReplaySize {
+		t.Fatalf("expected %d entries kept, got %d", sseReplaySize, len(h.entries))
+	}
+	if _, _, ok := h.since(first); ok {
+		t.Error("expected a broadcast past sseReplaySize to be forgotten")
+	}
+	last := h.lastID()
+	if missed, _, ok := h.since(last); !ok || len(missed) != 0 {
+		t.Errorf("expected nothing missed since the latest broadcast, got %d, %v", len(missed), ok)
+	}
+
+	// big library updates push the rest out by size.
+	big := sseReplayBytes / 4
+	for i := 0; i < 5; i++ {
+		h.add(frame(big))
+	}
+	if h.size > sseReplayBytes {
+		t.Errorf("expected at most %d bytes kept, got %d", sseReplayBytes, h.size)
+	}
+	if _, _, ok := h.since(last); ok {
+		t.Error("expected broadcasts pushed out by size to be forgotten")
+	}
+	if missed, _, ok := h.since(h.entries[0].id); !ok || len(missed) != len(h.entries)-1 {
+		t.Errorf("expected the oldest kept broadcast to resume, got %d, %v", len(missed), ok)
+	}
+
+	// one broadcast bigger than the cap is still kept, or nobody could
+	// resume past it.
+	h.add(frame(2 * sseReplayBytes))
+	if len(h.entries) != 1 {
+		t.Errorf("expected only the oversized broadcast kept, got %d", len(h.entries))
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	h := newHub()
+	slot := func(n int) wsMessage {
+		return wsMessage{html: []byte("slot " + strconv.Itoa(n)), keys: []string{slotKey(n)}}
+	}
+	h.broadcast(slot(0), true)
+	seen := h.history.lastID()
+	h.broadcast(slot(1), true)
+	h.broadcast(slot(2), true)
+
+	// a client that saw the first broadcast gets the other two, in order,
+	// each carrying on from the version before and ending on the latest ID.
+	c, ok := h.resume(wsProtocolHTMX, "events", seen)
+	if !ok {
+		t.Fatal("expected to resume from a kept broadcast")
+	}
+	frames := c.take()
+	if len(frames) != 2 {
+		t.Fatalf("expected the 2 missed broadcasts, got %d frames", len(frames))
+	}
+	for i, want := range []string{"slot 1", "slot 2"} {
+		stamp := `data-version="` + strconv.Itoa(i+2) + `" data-prev="` + strconv.Itoa(i+1) + `"`
+		if !bytes.HasPrefix(frames[i].data, []byte(want)) || !bytes.Contains(frames[i].data, []byte(stamp)) {
+			t.Errorf("expected %s stamped %s, got %s", want, stamp, frames[i].data)
+		}
+	}
+	if frames[1].id != h.history.lastID() {
+		t.Errorf("expected the last frame to carry %s, got %q", h.history.lastID(), frames[1].id)
+	}
+
+	// and then it's live like any other client.
+	h.broadcast(slot(3), true)
+	if frames := c.take(); len(frames) != 1 || !bytes.HasPrefix(frames[0].data, []byte("slot 3")) {
+		t.Errorf("expected the next broadcast after the replay, got %v", frames)
+	}
+	h.leave(c)
+
+	// once it's been pushed out, or it's from before a restart or made up,
+	// the client has to start over from a snapshot.
+	for i := 0; i < sseReplaySize; i++ {
+		h.broadcast(slot(i%soundboardSoundCount), true)
+	}
+	for _, id := range []string{seen, "", "garbage", "0-1", h.history.boot + "-999999"} {
+		if _, ok := h.resume(wsProtocolHTMX, "events", id); ok {
+			t.Errorf("expected resuming from %q to fall back to a snapshot", id)
+		}
+	}
+	if h.count() != 0 {
+		t.Errorf("expected a refused resume not to join, got %d clients", h.count())
+	}
+}
+
+func TestWriteSSE(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		frame wsFrame
+		want  string
+	}{
+		{"one line", wsFrame{data: []byte(`{"type":"play"}`)}, "data: {\"type\":\"play\"}\n\n"},
+		{"with an id", wsFrame{id: "abc-3", data: []byte("hi")}, "id: abc-3\ndata: hi\n\n"},
+		// a blank line would end the event early, so every line is data.
+		{"multiline", wsFrame{data: []byte("<div>\r\n\n</div>")}, "data: <div>\ndata: \ndata: </div>\n\n"},
+		{"empty", wsFrame{}, "data: \n\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			if err := writeSSE(&buf, tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Transcoder converts sounds into the format the library is kept in. ext is the
+// extension of data including the dot, and the returned extension is the one
+// the result should be saved with.
+type Transcoder interface {
+	Transcode(data []byte, ext string) ([]byte, string, error)
+}
+
+// transcoder is what saves and uploads go through. It's a nopTranscoder unless
+// TRANSCODE_FORMAT is set.
+var transcoder Transcoder = nopTranscoder{}
+
+// nopTranscoder keeps sounds exactly as they came in.
+type nopTranscoder struct{}
+
+func (nopTranscoder) Transcode(data []byte, ext string) ([]byte, string, error) {
+	return data, ext, nil
+}
+
+// soundFitter is implemented by transcoders that can trim and re-encode a
+// sound until Discord will take it.
+type soundFitter interface {
+	Fit(data []byte, ext string, maxDuration time.Duration, maxSize int) ([]byte, string, error)
+}
+
+// soundboardFitter is nil unless FIT_SOUNDS is set, in which case sounds over
+// the soundboard limits are fit instead of refused.
+var soundboardFitter soundFitter
+
+type transcodeFormat struct {
+	name  string // as probeSound reports it
+	codec string
+	muxer string
+	ext   string
+}
+
+var transcodeFormats = map[string]transcodeFormat{
+	"mp3":    {name: "mp3", codec: "libmp3lame", muxer: "mp3", ext: ".mp3"},
+	"vorbis": {name: "vorbis", codec: "libvorbis", muxer: "ogg", ext: ".ogg"},
+	"opus":   {name: "opus", codec: "libopus", muxer: "ogg", ext: ".ogg"},
+}
+
+// ffmpegTranscoder pipes sounds through an ffmpeg binary.
+type ffmpegTranscoder struct {
+	ffmpegPath string
+	format     transcodeFormat
+	bitrate    string
+	timeout    time.Duration
+}
+
+func newFFmpegTranscoder(ffmpegPath, format, bitrate string) (*ffmpegTranscoder, error) {
+	f, ok := transcodeFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("[error] unknown transcode format %q", format)
+	}
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if bitrate == "" {
+		bitrate = "128k"
+	}
+	return &ffmpegTranscoder{
+		ffmpegPath: ffmpegPath,
+		format:     f,
+		bitrate:    bitrate,
+		timeout:    time.Minute,
+	}, nil
+}
+
+// available reports whether t's ffmpeg can be found, so what only works
+// with it can be left off rather than fail for every sound.
+func (t *ffmpegTranscoder) available() bool {
+	_, err := exec.LookPath(t.ffmpegPath)
+	return err == nil
+}
+
+func (t *ffmpegTranscoder) Transcode(data []byte, ext string) ([]byte, string, error) {
+	// don't generation-loss sounds that are already in the right codec. The
+	// extension can't tell us, vorbis and opus are both .ogg.
+	if probe, err := probeSound(data); err == nil && probe.Format == t.format.name {
+		return data, t.format.ext, nil
+	}
+	return t.run(data, "-c:a", t.format.codec, "-b:a", t.bitrate)
+}
+
+// Fit cuts data down to maxDuration and lowers the bitrate until it should come
+// in under maxSize. The bitrate is only a guess at the size, so the result is
+// probed again and refused if it's still over.
+func (t *ffmpegTranscoder) Fit(data []byte, ext string, maxDuration time.Duration, maxSize int) ([]byte, string, error) {
+	probe, err := probeSound(data)
+	if err != nil {
+		return nil, "", err
+	}
+	duration := min(probe.Duration, maxDuration)
+	kbps := 128
+	fmt.Sscanf(t.bitrate, "%dk", &kbps)
+	if duration > 0 {
+		// leave some room for container overhead.
+		kbps = min(kbps, int(float64(maxSize*8)*0.9/duration.Seconds()/1000))
+	}
+	if kbps < 8 {
+		return nil, "", fmt.Errorf("[error] %w: can't fit %s into %d bytes", errSoundRejected, probe.Duration, maxSize)
+	}
+	fitted, fittedExt, err := t.run(data, "-t", fmt.Sprintf("%.3f", maxDuration.Seconds()), "-c:a", t.format.codec, "-b:a", fmt.Sprintf("%dk", kbps))
+	if err != nil {
+		return nil, "", err
+	}
+	probe, err = probeSound(fitted)
+	if err != nil {
+		return nil, "", fmt.Errorf("[error] probing fitted sound: %v", err)
+	}
+	if probe.Duration > maxDuration || probe.Size > maxSize {
+		return nil, "", fmt.Errorf("[error] %w: still %.2fs and %d bytes after fitting", errSoundRejected, probe.Duration.Seconds(), probe.Size)
+	}
+	return fitted, fittedExt, nil
+}
+
+// run feeds data to ffmpeg on stdin and returns what it writes to stdout in
+// the target container. args go between the input and output options.
+func (t *ffmpegTranscoder) run(data []byte, args ...string) ([]byte, string, error) {
+	args = append(args, "-f", t.format.muxer, "pipe:1")
+	stdout, _, err := t.exec(data, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(stdout) == 0 {
+		return nil, "", errors.New("[error] ffmpeg produced no output")
+	}
+	return stdout, t.format.ext, nil
+}
+
+func (t *ffmpegTranscoder) exec(data []byte, args ...string) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	cmdArgs := []string{"-hide_banner", "-nostats", "-i", "pipe:0", "-vn", "-map_metadata", "-1"}
+	cmdArgs = append(cmdArgs, args...)
+	cmd := exec.CommandContext(ctx, t.ffmpegPath, cmdArgs...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("[error] ffmpeg: %v: %s", err, lastLine(stderr.String()))
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
+
+// migrateLibrary runs every stored sound through t. Converted sounds are
+// written next to the originals (or over them when the extension doesn't
+// change, e.g. vorbis to opus), and the originals are moved into
+// soundsDir/.originals once the new file reads back as the right format, so
+// nothing is lost if a conversion goes wrong. Pass purgeOriginals once you've
+// listened to the results to delete them.
+func migrateLibrary(t Transcoder, purgeOriginals bool) error {
+	originalsDir := filepath.Join(soundsDir, ".originals")
+	if purgeOriginals {
+		fmt.Printf("removing %s\n", originalsDir)
+		return os.RemoveAll(originalsDir)
+	}
+	if _, ok := t.(nopTranscoder); ok {
+		return fmt.Errorf("[error] there's nothing to migrate to, set TRANSCODE_FORMAT")
+	}
+
+	storedSounds, _, err := fetchStoredSounds()
+	if err != nil {
+		return err
+	}
+	converted := 0
+	for _, storedSound := range storedSounds {
+		ext := path.Ext(storedSound)
+		p, err := libraryPath(storedSound)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		newData, newExt, err := t.Transcode(data, ext)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warn] skipping %s: %v\n", storedSound, err)
+			continue
+		}
+		if newExt == ext && bytes.Equal(newData, data) {
+			continue
+		}
+
+		newPath := strings.TrimSuffix(p, ext) + newExt
+		if _, err := os.Stat(newPath); err == nil && newPath != p {
+			fmt.Fprintf(os.Stderr, "[warn] skipping %s: %s already exists\n", storedSound, filepath.Base(newPath))
+			continue
+		}
+		// written under a name fetchStoredSounds ignores until it's verified,
+		// since newPath may be where the original still is.
+		tmpPath := newPath + ".tmp"
+		if err := os.WriteFile(tmpPath, newData, 0644); err != nil {
+			return err
+		}
+
+		written, err := os.ReadFile(tmpPath)
+		if err != nil || !bytes.Equal(written, newData) {
+			os.Remove(tmpPath)
+			fmt.Fprintf(os.Stderr, "[warn] skipping %s: couldn't verify converted file\n", storedSound)
+			continue
+		}
+		if format, err := detectSoundFormat(written); err != nil || format.Ext != newExt {
+			os.Remove(tmpPath)
+			fmt.Fprintf(os.Stderr, "[warn] skipping %s: converted file isn't %s\n", storedSound, newExt)
+			continue
+		}
+
+		original := filepath.Join(originalsDir, filepath.FromSlash(storedSound))
+		if err := os.MkdirAll(filepath.Dir(original), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(p, original); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, newPath); err != nil {
+			return err
+		}
+		converted++
+		fmt.Printf("converted %s -> %s\n", storedSound, strings.TrimSuffix(storedSound, ext)+newExt)
+	}
+	fmt.Printf("converted %d sounds, originals are in %s\n", converted, originalsDir)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// oggPage builds a single-segment Ogg page. probeOgg doesn't check CRCs, so
+// they're left zero.
+func oggPage(serial uint32, granule int64, packet []byte) []byte {
+	page := make([]byte, 27, 28+len(packet))
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:14], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:18], serial)
+	page[26] = 1
+	page = append(page, byte(len(packet)))
+	return append(page, packet...)
+}
+
+// testVorbis is a second of 44.1kHz vorbis as far as probeSound can tell.
+func testVorbis() []byte {
+	return testVorbisLasting(time.Second)
+}
+
+func testVorbisLasting(d time.Duration) []byte {
+	ident := make([]byte, 30)
+	copy(ident, "\x01vorbis")
+	binary.LittleEndian.PutUint32(ident[12:16], 44100)
+	return append(oggPage(1, 0, ident), oggPage(1, int64(d.Seconds()*44100), []byte("audio"))...)
+}
+
+// testOpus is a second of opus as far as probeSound can tell.
+func testOpus() []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	return append(oggPage(1, 0, head), oggPage(1, 48000, []byte("audio"))...)
+}
+
+// stubTranscoder "converts" anything that isn't opus into testOpus.
+type stubTranscoder struct {
+	calls int
+}
+
+func (s *stubTranscoder) Transcode(data []byte, ext string) ([]byte, string, error) {
+	s.calls++
+	if probe, err := probeSound(data); err == nil && probe.Format == "opus" {
+		return data, ".ogg", nil
+	}
+	return testOpus(), ".ogg", nil
+}
+
+func TestFFmpegTranscoderSkipsSameCodec(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		data   []byte
+		skip   bool
+	}{
+		{"vorbis", testVorbis(), true},
+		{"opus", testOpus(), true},
+		{"opus", testVorbis(), false},
+		{"vorbis", testOpus(), false},
+		{"mp3", testVorbis(), false},
+	} {
+		// a missing ffmpeg fails anything that isn't skipped.
+		tr, err := newFFmpegTranscoder(filepath.Join(t.TempDir(), "ffmpeg"), tt.format, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ext, err := tr.Transcode(tt.data, ".ogg")
+		if !tt.skip {
+			if err == nil {
+				t.Errorf("%s: expected an ogg it isn't already to be converted", tt.format)
+			}
+			continue
+		}
+		if err != nil || ext != ".ogg" || !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: expected it to be kept as is, got %q, %v", tt.format, ext, err)
+		}
+	}
+}
+
+func TestMigrateLibrary(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = t.TempDir()
+	defer func() { soundsDir = oldSoundsDir }()
+
+	vorbis, opus := testVorbis(), testOpus()
+	if err := os.MkdirAll(filepath.Join(soundsDir, "memes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"memes/vorbis.ogg": vorbis, "opus.ogg": opus} {
+		if err := os.WriteFile(filepath.Join(soundsDir, filepath.FromSlash(name)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateLibrary(nopTranscoder{}, false); err == nil {
+		t.Errorf("expected migrating without TRANSCODE_FORMAT to fail")
+	}
+
+	stub := &stubTranscoder{}
+	if err := migrateLibrary(stub, false); err != nil {
+		t.Fatal(err)
+	}
+	if stub.calls != 2 {
+		t.Errorf("expected both sounds to go through the transcoder, got %d", stub.calls)
+	}
+
+	read := func(name string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(soundsDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if !bytes.Equal(read("memes/vorbis.ogg"), opus) {
+		t.Error("expected the vorbis sound to be replaced with opus")
+	}
+	if !bytes.Equal(read(".originals/memes/vorbis.ogg"), vorbis) {
+		t.Error("expected the vorbis original to be kept")
+	}
+	if !bytes.Equal(read("opus.ogg"), opus) {
+		t.Error("expected the opus sound to be left alone")
+	}
+	if _, err := os.Stat(filepath.Join(soundsDir, ".originals", "opus.ogg")); err == nil {
+		t.Error("expected no original for a sound that wasn't converted")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(soundsDir, "*", "*.tmp")); len(matches) > 0 {
+		t.Errorf("expected no temporary files left, got %v", matches)
+	}
+
+	if err := migrateLibrary(stub, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(soundsDir, ".originals")); !os.IsNotExist(err) {
+		t.Error("expected the originals to be purged")
+	}
+}
+
+// padOgg adds empty pages to an ogg stream until it's at least size bytes.
+func padOgg(data []byte, size int) []byte {
+	for len(data) < size {
+		data = append(data, oggPage(1, -1, make([]byte, 255))...)
+	}
+	return data
+}
+
+// fakeFFmpeg is an ffmpeg that ignores its input and writes output.
+func fakeFFmpeg(t *testing.T, output []byte) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script to stand in for ffmpeg")
+	}
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "output")
+	if err := os.WriteFile(outputPath, output, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat '"+outputPath+"'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestFFmpegTranscoderFit(t *testing.T) {
+	long := testVorbisLasting(10 * time.Second)
+	for _, tt := range []struct {
+		name     string
+		output   []byte
+		rejected bool
+	}{
+		{"fits", testVorbisLasting(5 * time.Second), false},
+		{"still too long", testVorbisLasting(6 * time.Second), true},
+		{"still too large", padOgg(testVorbisLasting(5*time.Second), maxSoundboardSize+1), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newFFmpegTranscoder(fakeFFmpeg(t, tt.output), "vorbis", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fitted, ext, err := tr.Fit(long, ".ogg", maxSoundboardDuration, maxSoundboardSize)
+			if tt.rejected {
+				if !errors.Is(err, errSoundRejected) {
+					t.Errorf("expected errSoundRejected, got %v", err)
+				}
+				return
+			}
+			if err != nil || ext != ".ogg" || !bytes.Equal(fitted, tt.output) {
+				t.Errorf("expected the fitted sound, got %d bytes as %q, %v", len(fitted), ext, err)
+			}
+		})
+	}
+
+	t.Run("unreadable output", func(t *testing.T) {
+		tr, err := newFFmpegTranscoder(fakeFFmpeg(t, []byte("garbage")), "vorbis", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tr.Fit(long, ".ogg", maxSoundboardDuration, maxSoundboardSize); err == nil || errors.Is(err, errSoundRejected) {
+			t.Errorf("expected an error that isn't errSoundRejected, got %v", err)
+		}
+	})
+}
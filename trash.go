@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Deleted sounds are moved to soundsDir/.trash/<unix nanos>/<location> so they
+// can be put back where they came from until the retention period runs out.
+const trashDirName = ".trash"
+
+var trashRetention = 30 * 24 * time.Hour
+
+type TrashedSound struct {
+	TrashID   string
+	Location  string
+	DeletedAt time.Time
+}
+
+func trashStoredSound(location string) (TrashedSound, error) {
+	from, err := libraryPath(location)
+	if err != nil {
+		return TrashedSound{}, err
+	}
+	if _, err := os.Stat(from); err != nil {
+		return TrashedSound{}, fmt.Errorf("[error] sound %s does not exist", location)
+	}
+
+	deletedAt := time.Now()
+	trashID := strconv.FormatInt(deletedAt.UnixNano(), 10)
+	to := filepath.Join(soundsDir, trashDirName, trashID, filepath.FromSlash(location))
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return TrashedSound{}, err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return TrashedSound{}, err
+	}
+	return TrashedSound{TrashID: trashID, Location: location, DeletedAt: deletedAt}, nil
+}
+
+func restoreTrashedSound(trashID, location string) error {
+	if _, err := strconv.ParseInt(trashID, 10, 64); err != nil {
+		return fmt.Errorf("[error] invalid trash id %q", trashID)
+	}
+	to, err := libraryPath(location)
+	if err != nil {
+		return err
+	}
+	from := filepath.Join(soundsDir, trashDirName, trashID, filepath.FromSlash(path.Clean("/"+location)))
+	if _, err := os.Stat(from); err != nil {
+		return fmt.Errorf("[error] %s is not in the trash", location)
+	}
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("[error] sound %s already exists", location)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	os.RemoveAll(filepath.Join(soundsDir, trashDirName, trashID))
+	return nil
+}
+
+// fetchTrashedSounds lists the trash, most recently deleted first.
+func fetchTrashedSounds() ([]TrashedSound, error) {
+	trashDir := filepath.Join(soundsDir, trashDirName)
+	entries, err := os.ReadDir(trashDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	trashed := []TrashedSound{}
+	for _, entry := range entries {
+		nanos, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		root := filepath.Join(trashDir, entry.Name())
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return nil
+			}
+			trashed = append(trashed, TrashedSound{
+				TrashID:   entry.Name(),
+				Location:  filepath.ToSlash(rel),
+				DeletedAt: time.Unix(0, nanos),
+			})
+			return nil
+		})
+	}
+	sort.Slice(trashed, func(i, j int) bool { return trashed[i].DeletedAt.After(trashed[j].DeletedAt) })
+	return trashed, nil
+}
+
+// purgeTrash permanently removes anything deleted more than retention ago and
+// returns what was removed.
+func purgeTrash(retention time.Duration) ([]TrashedSound, error) {
+	trashed, err := fetchTrashedSounds()
+	if err != nil {
+		return nil, err
+	}
+	purged := []TrashedSound{}
+	for _, t := range trashed {
+		if time.Since(t.DeletedAt) < retention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(soundsDir, trashDirName, t.TrashID)); err != nil {
+			return purged, err
+		}
+		purged = append(purged, t)
+	}
+	return purged, nil
+}
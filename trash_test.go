@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = t.TempDir()
+	defer func() { soundsDir = oldSoundsDir }()
+
+	vorbis := testVorbis()
+	for _, location := range []string{"memes/NoOneHeard.ogg", "airhorn.ogg"} {
+		p := filepath.Join(soundsDir, filepath.FromSlash(location))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, vorbis, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(location string) bool {
+		_, err := os.Stat(filepath.Join(soundsDir, filepath.FromSlash(location)))
+		return err == nil
+	}
+
+	for _, location := range []string{"../airhorn.ogg", "/airhorn.ogg", "missing.ogg"} {
+		if _, err := trashStoredSound(location); err == nil {
+			t.Errorf("expected trashing %q to fail", location)
+		}
+	}
+
+	trashed, err := trashStoredSound("memes/NoOneHeard.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists("memes/NoOneHeard.ogg") {
+		t.Errorf("expected the sound to be out of the library")
+	}
+	storedSounds, _, err := fetchStoredSounds()
+	if err != nil || len(storedSounds) != 1 {
+		t.Errorf("expected the trash not to be listed as sounds, got %v, %v", storedSounds, err)
+	}
+	listed, err := fetchTrashedSounds()
+	if err != nil || len(listed) != 1 || listed[0].Location != "memes/NoOneHeard.ogg" || listed[0].TrashID != trashed.TrashID {
+		t.Fatalf("expected the sound in the trash, got %+v, %v", listed, err)
+	}
+
+	if err := restoreTrashedSound(trashed.TrashID, "../NoOneHeard.ogg"); err == nil {
+		t.Errorf("expected restoring outside the library to fail")
+	}
+	if err := restoreTrashedSound("not-an-id", "memes/NoOneHeard.ogg"); err == nil {
+		t.Errorf("expected an invalid trash id to fail")
+	}
+	if err := restoreTrashedSound(trashed.TrashID, "memes/NoOneHeard.ogg"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(soundsDir, "memes", "NoOneHeard.ogg")); err != nil || string(data) != string(vorbis) {
+		t.Errorf("expected the sound back as it was, %v", err)
+	}
+	if listed, _ := fetchTrashedSounds(); len(listed) != 0 {
+		t.Errorf("expected the trash to be empty, got %+v", listed)
+	}
+	if err := restoreTrashedSound(trashed.TrashID, "memes/NoOneHeard.ogg"); err == nil {
+		t.Errorf("expected restoring twice to fail")
+	}
+
+	// a restore doesn't overwrite a sound saved in its place since.
+	trashed, err = trashStoredSound("airhorn.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(soundsDir, "airhorn.ogg"), []byte("newer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTrashedSound(trashed.TrashID, "airhorn.ogg"); err == nil {
+		t.Errorf("expected restoring over a newer sound to fail")
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = t.TempDir()
+	defer func() { soundsDir = oldSoundsDir }()
+
+	// trash IDs are when the sound was deleted.
+	trash := func(location string, deletedAt time.Time) {
+		t.Helper()
+		p := filepath.Join(soundsDir, trashDirName, strconv.FormatInt(deletedAt.UnixNano(), 10), location)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, testVorbis(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trash("old.ogg", time.Now().Add(-48*time.Hour))
+	trash("recent.ogg", time.Now().Add(-time.Hour))
+
+	purged, err := purgeTrash(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0].Location != "old.ogg" {
+		t.Errorf("expected only the old sound to be purged, got %+v", purged)
+	}
+	listed, err := fetchTrashedSounds()
+	if err != nil || len(listed) != 1 || listed[0].Location != "recent.ogg" {
+		t.Errorf("expected the recent sound to be kept, got %+v, %v", listed, err)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lgordon2/discord-soundboard/client"
+)
+
+// The tui is a full-screen version of the board for the terminal. It only
+// uses the server's API and websocket, like the page does, and drives the
+// terminal with stty and ANSI escapes so it needs nothing beyond the standard
+// library.
+
+const tuiHelp = "1-8 play  / search  j/k move  a add  s<1-8> swap in  r refresh  q quit"
+
+type tuiKey struct {
+	r    rune
+	name string // "up", "down", "enter", "esc", "backspace"; empty for plain runes
+}
+
+type tuiModel struct {
+	board     client.Board
+	library   []client.LibrarySound
+	query     string
+	searching bool
+	cursor    int
+	swapping  bool // waiting for the slot to swap the selected sound into
+	clients   int
+	connected bool // to the server's websocket
+	status    string
+	width     int
+	height    int
+}
+
+func (m *tuiModel) selected() (client.LibrarySound, bool) {
+	if m.cursor < 0 || m.cursor >= len(m.library) {
+		return client.LibrarySound{}, false
+	}
+	return m.library[m.cursor], true
+}
+
+// render draws the whole screen. Lines end in \r\n since the terminal is in
+// raw mode.
+func (m *tuiModel) render() string {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	line := func(s string) {
+		b.WriteString(tuiTruncate(s, m.width))
+		b.WriteString("\x1b[K\r\n")
+	}
+
+	line("\x1b[1mdiscord-soundboard\x1b[0m")
+	line("")
+	// the board, four slots to a row like the page on a narrow screen.
+	cell := max(12, (m.width-2)/4)
+	for row := 0; row*4 < len(m.board.Slots); row++ {
+		var cells strings.Builder
+		for _, slot := range m.board.Slots[row*4 : min(row*4+4, len(m.board.Slots))] {
+			name := "\x1b[2mfree\x1b[0m"
+			if slot.Sound != nil {
+				name = slot.Sound.Name
+				if slot.Sound.LibraryName == "" {
+					name += "*"
+				}
+			}
+			text := fmt.Sprintf("[%d] %s", slot.Slot+1, name)
+			cells.WriteString(tuiPad(text, cell))
+		}
+		line(cells.String())
+	}
+	line("\x1b[2m* not in the library\x1b[0m")
+	line("")
+
+	search := m.query
+	if m.searching {
+		search += "\x1b[7m \x1b[0m"
+	}
+	line("search: " + search)
+	// leave room for the header, board, search line and status.
+	listHeight := max(1, m.height-len(m.board.Slots)/4-9)
+	start := 0
+	if m.cursor >= listHeight {
+		start = m.cursor - listHeight + 1
+	}
+	for i := start; i < min(len(m.library), start+listHeight); i++ {
+		sound := m.library[i]
+		text := sound.Location
+		if sound.OnBoard {
+			text += " \x1b[2m(on board)\x1b[0m"
+		}
+		if sound.Warning != "" {
+			text += " \x1b[33m!\x1b[0m"
+		}
+		if i == m.cursor {
+			text = "\x1b[7m> " + text + "\x1b[0m"
+		} else {
+			text = "  " + text
+		}
+		line(text)
+	}
+	for i := len(m.library) - start; i < listHeight; i++ {
+		line("")
+	}
+
+	gateway, voice, ws := "down", "not in channel", "disconnected"
+	if m.board.GatewayConnected {
+		gateway = "up"
+	}
+	if m.board.UserInChannel {
+		voice = "in channel"
+	}
+	if m.connected {
+		ws = fmt.Sprintf("%d watching", m.clients)
+	}
+	line(fmt.Sprintf("\x1b[7m gateway %s | voice %s | %s | %s \x1b[0m", gateway, voice, ws, m.status))
+	if m.swapping {
+		b.WriteString(tuiTruncate("swap into which slot? (1-8, esc to cancel)", m.width))
+	} else {
+		b.WriteString(tuiTruncate(tuiHelp, m.width))
+	}
+	b.WriteString("\x1b[K")
+	return b.String()
+}
+
+// tuiTruncate cuts s to width visible runes, not counting escape sequences.
+func tuiTruncate(s string, width int) string {
+	var b strings.Builder
+	visible := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' {
+			end := strings.IndexAny(s[i:], "mHJK")
+			if end < 0 {
+				break
+			}
+			b.WriteString(s[i : i+end+1])
+			i += end + 1
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if visible >= width {
+			i += size
+			continue
+		}
+		b.WriteRune(r)
+		visible++
+		i += size
+	}
+	return b.String()
+}
+
+func tuiPad(s string, width int) string {
+	visible := utf8.RuneCountInString(tuiTruncate(stripANSI(s), width))
+	return tuiTruncate(s, width-1) + strings.Repeat(" ", max(1, width-visible))
+}
+
+func stripANSI(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\x1b' {
+			if end := strings.IndexAny(s[i:], "mHJK"); end >= 0 {
+				i += end
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readTUIKeys turns raw terminal input into keys.
+func readTUIKeys(r io.Reader, keys chan<- tuiKey) {
+	defer close(keys)
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return
+		}
+		switch c {
+		case '\x1b':
+			// arrows come as ESC [ A, a lone ESC has nothing buffered after it.
+			if br.Buffered() >= 2 {
+				br.ReadByte()
+				switch code, _ := br.ReadByte(); code {
+				case 'A':
+					keys <- tuiKey{name: "up"}
+				case 'B':
+					keys <- tuiKey{name: "down"}
+				}
+				continue
+			}
+			keys <- tuiKey{name: "esc"}
+		case '\r', '\n':
+			keys <- tuiKey{name: "enter"}
+		case 127, '\b':
+			keys <- tuiKey{name: "backspace"}
+		case 3:
+			keys <- tuiKey{name: "ctrl-c"}
+		default:
+			keys <- tuiKey{r: c}
+		}
+	}
+}
+
+// terminalSize asks stty, falling back to 80x24.
+func terminalSize(tty *os.File) (int, int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(string(out), &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return cols, rows
+		}
+	}
+	return 80, 24
+}
+
+// rawTerminal puts tty in raw mode and returns how to put it back.
+func rawTerminal(tty *os.File) (func(), error) {
+	save := exec.Command("stty", "-g")
+	save.Stdin = tty
+	saved, err := save.Output()
+	if err != nil {
+		return nil, fmt.Errorf("[error] the tui needs a terminal: %v", err)
+	}
+	raw := exec.Command("stty", "raw", "-echo")
+	raw.Stdin = tty
+	if err := raw.Run(); err != nil {
+		return nil, fmt.Errorf("[error] couldn't put the terminal in raw mode: %v", err)
+	}
+	return func() {
+		restore := exec.Command("stty", strings.TrimSpace(string(saved)))
+		restore.Stdin = tty
+		restore.Run()
+	}, nil
+}
+
+// runTUI runs the tui against c until the user quits.
+func runTUI(c *client.Client) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("[error] the tui needs a terminal: %v", err)
+	}
+	defer tty.Close()
+	restore, err := rawTerminal(tty)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(tty, "\x1b[?25h\x1b[?1049l")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := &tuiModel{status: "connecting..."}
+	m.width, m.height = terminalSize(tty)
+
+	keys := make(chan tuiKey)
+	go readTUIKeys(tty, keys)
+	// results of API calls come back as updates to apply to the model, so
+	// only this goroutine ever touches it.
+	updates := make(chan func(*tuiModel), 16)
+	run := func(f func() func(*tuiModel)) {
+		go func() {
+			update := f()
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	refreshBoard := func() {
+		run(func() func(*tuiModel) {
+			board, err := c.Board(ctx)
+			return func(m *tuiModel) {
+				if err != nil {
+					m.status = err.Error()
+					return
+				}
+				m.board = board
+			}
+		})
+	}
+	refreshLibrary := func(query string) {
+		run(func() func(*tuiModel) {
+			library, err := c.Library(ctx, query)
+			return func(m *tuiModel) {
+				if err != nil {
+					m.status = err.Error()
+					return
+				}
+				if query != m.query {
+					return // the search moved on while we waited
+				}
+				m.library = library
+				m.cursor = min(m.cursor, max(0, len(library)-1))
+			}
+		})
+	}
+	action := func(done string, f func() error) {
+		run(func() func(*tuiModel) {
+			err := f()
+			return func(m *tuiModel) {
+				if err != nil {
+					m.status = err.Error()
+				} else {
+					m.status = done
+				}
+			}
+		})
+	}
+
+	// the websocket keeps the board live, reconnecting if it drops.
+	send := func(update func(*tuiModel)) bool {
+		select {
+		case updates <- update:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		for ctx.Err() == nil {
+			events, err := c.Subscribe(ctx)
+			if err == nil {
+				send(func(m *tuiModel) { m.connected, m.status = true, "connected" })
+				for event := range events {
+					event := event
+					send(func(m *tuiModel) {
+						switch event.Type {
+						case client.EventBoard:
+							m.board = *event.Board
+							refreshLibrary(m.query)
+						case client.EventLibrary:
+							refreshLibrary(m.query)
+						case client.EventGateway:
+							m.board.GatewayConnected = event.GatewayConnected
+							m.board.UserInChannel = event.UserInChannel
+						case client.EventClients:
+							m.clients = event.Clients
+						case client.EventPlay:
+							if sound, ok := tuiBoardSoundByID(m.board, event.SoundID); ok {
+								m.status = "played " + sound.Name
+							}
+						}
+					})
+				}
+			}
+			if !send(func(m *tuiModel) { m.connected, m.status = false, "reconnecting..." }) {
+				return
+			}
+			select {
+			case <-time.After(2 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	refreshBoard()
+	refreshLibrary("")
+	resize := time.NewTicker(time.Second)
+	defer resize.Stop()
+	fmt.Fprint(tty, m.render())
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || m.handleKey(key, c, ctx, action, refreshBoard, refreshLibrary) {
+				return nil
+			}
+		case update := <-updates:
+			update(m)
+		case <-resize.C:
+			width, height := terminalSize(tty)
+			if width == m.width && height == m.height {
+				continue
+			}
+			m.width, m.height = width, height
+		}
+		fmt.Fprint(tty, m.render())
+	}
+}
+
+func tuiBoardSoundByID(board client.Board, soundID string) (client.BoardSound, bool) {
+	for _, slot := range board.Slots {
+		if slot.Sound != nil && slot.Sound.ID == soundID {
+			return *slot.Sound, true
+		}
+	}
+	return client.BoardSound{}, false
+}
+
+// handleKey applies a key press, returning true to quit.
+func (m *tuiModel) handleKey(key tuiKey, c *client.Client, ctx context.Context, action func(string, func() error), refreshBoard func(), refreshLibrary func(string)) bool {
+	// raw mode turns off the terminal's own ctrl-c, it has to quit from
+	// anywhere, even the search box.
+	if key.name == "ctrl-c" {
+		return true
+	}
+	if m.searching {
+		switch {
+		case key.name == "enter" || key.name == "esc":
+			m.searching = false
+		case key.name == "backspace":
+			if m.query != "" {
+				_, size := utf8.DecodeLastRuneInString(m.query)
+				m.query = m.query[:len(m.query)-size]
+				refreshLibrary(m.query)
+			}
+		case key.name == "" && key.r >= ' ':
+			m.query += string(key.r)
+			m.cursor = 0
+			refreshLibrary(m.query)
+		}
+		return false
+	}
+
+	slot := -1
+	if n, err := strconv.Atoi(string(key.r)); err == nil && n >= 1 && n <= len(m.board.Slots) {
+		slot = n - 1
+	}
+	if m.swapping {
+		m.swapping = false
+		sound, ok := m.selected()
+		if slot < 0 || !ok {
+			m.status = "swap cancelled"
+			return false
+		}
+		old := m.board.Slots[slot].Sound
+		if old == nil {
+			action("added "+sound.Name, func() error {
+				_, err := c.Add(ctx, sound.Location)
+				return err
+			})
+		} else {
+			removeID := old.ID
+			action("swapped in "+sound.Name, func() error {
+				_, err := c.Swap(ctx, removeID, sound.Location)
+				return err
+			})
+		}
+		return false
+	}
+
+	switch {
+	case slot >= 0:
+		if sound := m.board.Slots[slot].Sound; sound != nil {
+			id := sound.ID
+			action("played "+sound.Name, func() error { return c.Play(ctx, id) })
+		}
+	case key.r == 'q':
+		return true
+	case key.r == '/':
+		m.searching = true
+	case key.r == 'j' || key.name == "down":
+		m.cursor = min(m.cursor+1, max(0, len(m.library)-1))
+	case key.r == 'k' || key.name == "up":
+		m.cursor = max(m.cursor-1, 0)
+	case key.r == 'a':
+		if sound, ok := m.selected(); ok {
+			action("added "+sound.Name, func() error {
+				_, err := c.Add(ctx, sound.Location)
+				return err
+			})
+		}
+	case key.r == 's':
+		if _, ok := m.selected(); ok {
+			m.swapping = true
+		}
+	case key.r == 'r':
+		refreshBoard()
+		refreshLibrary(m.query)
+	}
+	return false
+}
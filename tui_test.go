@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReadTUIKeys(t *testing.T) {
+	keys := make(chan tuiKey)
+	go readTUIKeys(strings.NewReader("a\x03\r\x7f"), keys)
+	var got []tuiKey
+	for key := range keys {
+		got = append(got, key)
+	}
+	want := []tuiKey{{r: 'a'}, {name: "ctrl-c"}, {name: "enter"}, {name: "backspace"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("key %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestTUIHandleKeyCtrlC(t *testing.T) {
+	action := func(string, func() error) {}
+	refreshLibrary := func(string) {}
+	for _, m := range []*tuiModel{
+		{},
+		{searching: true, query: "bru"},
+		{swapping: true},
+	} {
+		searching, query := m.searching, m.query
+		if !m.handleKey(tuiKey{name: "ctrl-c"}, nil, context.Background(), action, func() {}, refreshLibrary) {
+			t.Errorf("expected ctrl-c to quit (searching %v, swapping %v)", searching, m.swapping)
+		}
+		if m.query != query {
+			t.Errorf("expected ctrl-c to leave the search alone, got %q", m.query)
+		}
+	}
+
+	// q is only quit outside the search box.
+	m := &tuiModel{searching: true}
+	if m.handleKey(tuiKey{r: 'q'}, nil, context.Background(), action, func() {}, refreshLibrary) || m.query != "q" {
+		t.Errorf("expected q to be searched for, got %q", m.query)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxUploadSize caps what we'll accept into the library. Discord's own limit
+// for soundboard sounds is much lower, but the library can hold longer clips.
+const maxUploadSize = 10 << 20
+
+var errSoundExists = errors.New("sound already exists")
+
+type uploadInput struct {
+	Name       string
+	Folder     string
+	Slot       int // -1 when the sound should only go into the library
+	Ext        string
+	Data       []byte
+	SourceHash string // hash of the sound before it was transcoded, if it was
+}
+
+func parseUpload(w http.ResponseWriter, r *http.Request) (uploadInput, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1024*1024)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		return uploadInput{}, fmt.Errorf("[error] parsing upload: %v", err)
+	}
+	file, header, err := r.FormFile("sound")
+	if err != nil {
+		return uploadInput{}, fmt.Errorf("[error] upload is missing the sound file: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		return uploadInput{}, fmt.Errorf("[error] reading upload: %v", err)
+	}
+	if len(data) > maxUploadSize {
+		return uploadInput{}, fmt.Errorf("[error] %s is bigger than %d bytes", header.Filename, maxUploadSize)
+	}
+
+	format, err := detectSoundFormat(data)
+	if err != nil {
+		return uploadInput{}, fmt.Errorf("[error] %s: %v", header.Filename, err)
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename))
+	}
+	if err := validateSoundName(name); err != nil {
+		return uploadInput{}, err
+	}
+
+	slot := -1
+	if s := r.FormValue("slot"); s != "" {
+		slot, err = strconv.Atoi(s)
+		if err != nil || slot < 0 || slot >= soundboardSoundCount {
+			return uploadInput{}, fmt.Errorf("[error] invalid slot %q", s)
+		}
+	}
+
+	return uploadInput{
+		Name:   name,
+		Folder: strings.Trim(r.FormValue("folder"), "/"),
+		Slot:   slot,
+		Ext:    format.Ext,
+		Data:   data,
+	}, nil
+}
+
+// saveUploadedSound writes input into the library and returns its location. It
+// refuses sounds whose audio is already stored, and formats the library doesn't
+// keep (e.g. a wav that wasn't transcoded). A name that's taken by different
+// audio gets a number added instead, e.g. "NoOneHeard (2)".
+func saveUploadedSound(input uploadInput, storedSoundMap map[string][]byte, storedSoundHashes map[string][]string) (string, error) {
+	if f, ok := soundFormatForExt(input.Ext); !ok || !isLibraryFormat(f) {
+		return "", fmt.Errorf("[error] %s files can't be saved as they are, set TRANSCODE_FORMAT to convert them", input.Ext)
+	}
+	for _, hash := range []string{soundHash(input.Data), input.SourceHash} {
+		if names := storedSoundHashes[hash]; hash != "" && len(names) > 0 {
+			return "", fmt.Errorf("[error] %w: this sound is already in the library as %s", errSoundExists, names[0])
+		}
+	}
+	if _, ok := storedSoundMap[input.Name]; ok {
+		input.Name = nextVersionName(input.Name, storedSoundMap)
+	}
+
+	location := input.Name + input.Ext
+	if input.Folder != "" {
+		location = path.Join(input.Folder, location)
+	}
+	p, err := libraryPath(location)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("[error] %w: %s", errSoundExists, location)
+		}
+		return "", err
+	}
+	if _, err := f.Write(input.Data); err != nil {
+		f.Close()
+		return "", err
+	}
+	return location, f.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveUploadedSound(t *testing.T) {
+	oldSoundsDir := soundsDir
+	soundsDir = t.TempDir()
+	defer func() { soundsDir = oldSoundsDir }()
+
+	airhorn := testVorbisLasting(time.Second)
+	if err := os.WriteFile(filepath.Join(soundsDir, "airhorn.ogg"), airhorn, 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := loadSoundMetadata(soundsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// airhorn was saved from a wav that was transcoded.
+	if err := metadata.Set("airhorn", SoundMetadata{SourceHash: soundHash([]byte("the original wav"))}); err != nil {
+		t.Fatal(err)
+	}
+	save := func(input uploadInput) (string, error) {
+		t.Helper()
+		_, storedSoundMap, err := fetchStoredSounds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.Slot, input.Ext = -1, ".ogg"
+		return saveUploadedSound(input, storedSoundMap, hashStoredSounds(storedSoundMap, metadata))
+	}
+
+	// the same audio under another name is turned away...
+	if _, err := save(uploadInput{Name: "horn", Data: airhorn}); !errors.Is(err, errSoundExists) {
+		t.Errorf("expected an identical upload to be refused, got %v", err)
+	}
+	// ...as is the same original transcoded again.
+	if _, err := save(uploadInput{Name: "horn", Data: testOpus(), SourceHash: soundHash([]byte("the original wav"))}); !errors.Is(err, errSoundExists) {
+		t.Errorf("expected an upload of the same original to be refused, got %v", err)
+	}
+
+	// different audio under a taken name gets the next free one.
+	for i, want := range []string{"airhorn (2).ogg", "airhorn (3).ogg"} {
+		location, err := save(uploadInput{Name: "airhorn", Data: testVorbisLasting(time.Duration(i+2) * time.Second)})
+		if err != nil || location != want {
+			t.Errorf("expected %s, got %s, %v", want, location, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(soundsDir, "airhorn.ogg")); err != nil || string(data) != string(airhorn) {
+		t.Errorf("expected the original to be left alone, %v", err)
+	}
+}
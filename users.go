@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+const (
+	userCacheFile   = ".users.json"
+	avatarCacheDir  = ".avatar-cache"
+	userCacheMaxAge = 24 * time.Hour
+)
+
+type UserInfo struct {
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Avatar    string    `json:"avatar,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// userFetcher looks a user up by ID, normally through the REST API.
+type userFetcher interface {
+	GetUser(userID string) (UserInfo, error)
+}
+
+// userCache holds the users we've seen, e.g. who uploaded a board sound. It's
+// filled from the gateway where possible, and anyone missing or stale is
+// fetched in the background so rendering never waits on Discord. Users are
+// saved to SOUNDS_DIR/.users.json so they survive restarts.
+type userCache struct {
+	mu       sync.RWMutex
+	users    map[string]UserInfo
+	fetching map[string]bool
+	path     string
+	fetcher  userFetcher
+	maxAge   time.Duration
+
+	// onFetch is called after a user is fetched, so whatever showed them
+	// incomplete can be redrawn.
+	onFetch func(UserInfo)
+}
+
+func loadUserCache(dir string, fetcher userFetcher) (*userCache, error) {
+	c := &userCache{
+		users:    make(map[string]UserInfo),
+		fetching: make(map[string]bool),
+		path:     filepath.Join(dir, userCacheFile),
+		fetcher:  fetcher,
+		maxAge:   userCacheMaxAge,
+	}
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[error] reading user cache: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.users); err != nil {
+		return nil, fmt.Errorf("[error] parsing user cache %s: %v", c.path, err)
+	}
+	return c, nil
+}
+
+// Get returns what we know about userID, which may be nothing yet. Missing or
+// stale users are fetched in the background.
+func (c *userCache) Get(userID string) UserInfo {
+	c.mu.RLock()
+	user, ok := c.users[userID]
+	c.mu.RUnlock()
+	if userID != "" && (!ok || time.Since(user.FetchedAt) > c.maxAge) {
+		go c.fetch(userID)
+	}
+	return user
+}
+
+// Set records users we've heard about, e.g. from the gateway, saving them all
+// at once.
+func (c *userCache) Set(users ...UserInfo) {
+	now := time.Now()
+	c.mu.Lock()
+	for _, user := range users {
+		user.FetchedAt = now
+		c.users[user.UserID] = user
+	}
+	err := c.save()
+	c.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] could not save user cache: %v\n", err)
+	}
+}
+
+// SetAvatar updates just the avatar, e.g. from a soundboard sound's user.
+func (c *userCache) SetAvatar(userID, avatar string) {
+	c.mu.Lock()
+	user := c.users[userID]
+	if user.Avatar == avatar {
+		c.mu.Unlock()
+		return
+	}
+	user.UserID = userID
+	user.Avatar = avatar
+	c.users[userID] = user
+	err := c.save()
+	c.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] could not save user cache: %v\n", err)
+	}
+}
+
+func (c *userCache) fetch(userID string) {
+	c.mu.Lock()
+	if c.fetching[userID] || c.fetcher == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.fetching[userID] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.fetching, userID)
+		c.mu.Unlock()
+	}()
+
+	user, err := c.fetcher.GetUser(userID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] fetching user %s: %v\n", userID, err)
+		// don't retry on every render, wait for it to go stale again.
+		c.mu.Lock()
+		stale := c.users[userID]
+		stale.UserID = userID
+		stale.FetchedAt = time.Now()
+		c.users[userID] = stale
+		c.mu.Unlock()
+		return
+	}
+	c.Set(user)
+	if c.onFetch != nil {
+		c.onFetch(user)
+	}
+}
+
+// save writes the cache out. c.mu must be held.
+func (c *userCache) save() error {
+	data, err := json.Marshal(c.users)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// avatarURL is where the browser loads userID's avatar from, see avatarProxy.
+func avatarURL(userID string) string {
+	return "/avatars/" + userID
+}
+
+// defaultAvatarIndex picks which of Discord's default avatars a user without
+// one gets, the same way the client does.
+func defaultAvatarIndex(userID string) int {
+	id, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return int((id >> 22) % 6)
+}
+
+// avatarProxy serves avatars from the CDN, caching them on disk. An avatar
+// hash changes whenever the picture does, so cached files never go stale,
+// they're just replaced.
+type avatarProxy struct {
+	dir     string
+	baseURL string
+	client  *http.Client
+	mu      sync.Mutex
+}
+
+func newAvatarProxy(dir, baseURL string, client *http.Client) (*avatarProxy, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("[error] creating avatar cache: %v", err)
+	}
+	return &avatarProxy{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/"), client: client}, nil
+}
+
+// Avatar returns the picture for user and its content type, falling back to
+// the default avatar when they don't have one or it can't be fetched.
+func (p *avatarProxy) Avatar(user UserInfo) ([]byte, string, error) {
+	if validSnowflake(user.UserID) && user.Avatar != "" && !strings.ContainsAny(user.Avatar, "/.") {
+		data, err := p.cached(user.UserID+"-"+user.Avatar+".webp", fmt.Sprintf("/avatars/%s/%s.webp?size=64", user.UserID, user.Avatar), user.UserID+"-")
+		if err == nil {
+			return data, "image/webp", nil
+		}
+		fmt.Fprintf(os.Stderr, "[warn] fetching avatar for %s: %v\n", user.UserID, err)
+	}
+	index := defaultAvatarIndex(user.UserID)
+	data, err := p.cached(fmt.Sprintf("default-%d.png", index), fmt.Sprintf("/embed/avatars/%d.png", index), "")
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "image/png", nil
+}
+
+// cached reads name from the cache dir, fetching it from upstreamPath if it
+// isn't there. Files starting with replaces are older versions and get
+// removed.
+func (p *avatarProxy) cached(name, upstreamPath, replaces string) ([]byte, error) {
+	file := filepath.Join(p.dir, name)
+	if data, err := os.ReadFile(file); err == nil {
+		return data, nil
+	}
+
+	resp, err := p.client.Get(p.baseURL + upstreamPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[error] invalid status code %v", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if replaces != "" {
+		old, _ := filepath.Glob(filepath.Join(p.dir, replaces+"*"))
+		for _, f := range old {
+			os.Remove(f)
+		}
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "[warn] couldn't cache avatar %s: %v\n", name, err)
+	}
+	return data, nil
+}
+
+// placeholderAvatar is served when even the default avatar can't be fetched.
+var placeholderAvatar = []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 32 32"><circle cx="16" cy="16" r="16" fill="#5865f2"/><circle cx="16" cy="13" r="6" fill="#fff"/><path d="M6 27a10 8 0 0 1 20 0z" fill="#fff"/></svg>`)
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// PCMDecoder decodes a sound to mono signed 16-bit samples at sampleRate.
+type PCMDecoder interface {
+	DecodePCM(data []byte, sampleRate int) ([]int16, error)
+}
+
+var pcmDecoder PCMDecoder
+
+func (t *ffmpegTranscoder) DecodePCM(data []byte, sampleRate int) ([]int16, error) {
+	stdout, _, err := t.exec(data, "-ac", "1", "-ar", fmt.Sprint(sampleRate), "-f", "s16le", "pipe:1")
+	if err != nil {
+		return nil, err
+	}
+	// samples are two bytes each, a stray one means the output was cut off.
+	if len(stdout)%2 != 0 {
+		return nil, fmt.Errorf("[error] decoded audio ends partway through a sample")
+	}
+	samples := make([]int16, len(stdout)/2)
+	if err := binary.Read(bytes.NewReader(stdout), binary.LittleEndian, samples); err != nil {
+		return nil, fmt.Errorf("[error] reading decoded audio: %w", err)
+	}
+	return samples, nil
+}
+
+const (
+	waveformPeakCount  = 64
+	waveformSampleRate = 8000 // plenty for a picture
+)
+
+// computePeaks splits samples into count buckets and returns the loudest
+// sample in each, scaled to 0-1.
+func computePeaks(samples []int16, count int) []float64 {
+	peaks := make([]float64, count)
+	if len(samples) == 0 {
+		return peaks
+	}
+	for i := range peaks {
+		start := i * len(samples) / count
+		end := (i + 1) * len(samples) / count
+		peak := 0
+		for _, s := range samples[start:end] {
+			v := int(s)
+			if v < 0 {
+				v = -v
+			}
+			peak = max(peak, v)
+		}
+		peaks[i] = math.Round(float64(peak)/32768*1000) / 1000
+	}
+	return peaks
+}
+
+type waveformEntry struct {
+	key     string
+	version string // whatever identifies the bytes the peaks came from
+	peaks   []float64
+}
+
+// waveformCacheSize is how many sounds' peaks are kept. Every entry is the
+// same size, so it's counted in entries rather than bytes.
+const waveformCacheSize = 4096
+
+// waveformCache holds peaks by key, e.g. a library location or a board sound
+// ID, dropping the least recently used once it has more than maxEntries.
+// Entries are only used while their version matches, so a file that's been
+// replaced gets recomputed.
+type waveformCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+func newWaveformCache(maxEntries int) *waveformCache {
+	return &waveformCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Peaks returns the cached peaks for key at version, calling load and
+// computing them if they're missing or stale.
+func (c *waveformCache) Peaks(key, version string, load func() ([]byte, error)) ([]float64, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok && el.Value.(*waveformEntry).version == version {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*waveformEntry).peaks, nil
+	}
+	c.mu.Unlock()
+
+	if pcmDecoder == nil {
+		return nil, errors.New("[error] no audio decoder configured")
+	}
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+	samples, err := pcmDecoder.DecodePCM(data, waveformSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	peaks := computePeaks(samples, waveformPeakCount)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&waveformEntry{key: key, version: version, peaks: peaks})
+	for c.order.Len() > c.maxEntries {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*waveformEntry).key)
+	}
+	return peaks, nil
+}
+
+// Invalidate drops key, e.g. after a library sound is renamed or deleted.
+func (c *waveformCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func fileVersion(modTime time.Time, size int64) string {
+	return fmt.Sprintf("%d-%d", modTime.UnixNano(), size)
+}
+
+// waveformSVG draws peaks as mirrored bars, sized to be stretched across a
+// card.
+func waveformSVG(peaks []float64) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d 20" preserveAspectRatio="none"><g fill="#9ca3af">`, len(peaks)*2)
+	for i, peak := range peaks {
+		h := math.Max(peak*20, 0.5)
+		fmt.Fprintf(&buf, `<rect x="%d" y="%.2f" width="1.4" height="%.2f"/>`, i*2, (20-h)/2, h)
+	}
+	buf.WriteString(`</g></svg>`)
+	return buf.Bytes()
+}
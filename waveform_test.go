@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// stubDecoder "decodes" a sound to its bytes as samples.
+type stubDecoder struct {
+	calls int
+}
+
+func (d *stubDecoder) DecodePCM(data []byte, sampleRate int) ([]int16, error) {
+	d.calls++
+	samples := make([]int16, len(data))
+	for i, b := range data {
+		samples[i] = int16(b) << 7
+	}
+	return samples, nil
+}
+
+func TestWaveformCache(t *testing.T) {
+	decoder := &stubDecoder{}
+	oldDecoder := pcmDecoder
+	pcmDecoder = decoder
+	defer func() { pcmDecoder = oldDecoder }()
+
+	c := newWaveformCache(2)
+	load := func() ([]byte, error) { return []byte{1, 2, 3, 4}, nil }
+	peaks := func(key, version string) {
+		t.Helper()
+		if _, err := c.Peaks(key, version, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectDecodes := func(want int) {
+		t.Helper()
+		if decoder.calls != want {
+			t.Errorf("expected %d decodes, got %d", want, decoder.calls)
+		}
+	}
+
+	peaks("a", "1")
+	peaks("a", "1")
+	expectDecodes(1)
+	peaks("a", "2") // the file changed
+	expectDecodes(2)
+
+	peaks("b", "1")
+	peaks("a", "2") // a is now the most recently used
+	peaks("c", "1") // so b is dropped
+	expectDecodes(4)
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("expected 2 entries kept, got %d", len(c.entries))
+	}
+	peaks("a", "2")
+	expectDecodes(4)
+	peaks("b", "1")
+	expectDecodes(5)
+
+	c.Invalidate("b")
+	peaks("b", "1")
+	expectDecodes(6)
+}
+
+func TestFFmpegDecodePCM(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		output  []byte
+		samples []int16
+	}{
+		{"whole samples", []byte{0x01, 0x00, 0xFF, 0xFF}, []int16{1, -1}},
+		{"cut off partway through a sample", []byte{0x01, 0x00, 0xFF}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newFFmpegTranscoder(fakeFFmpeg(t, tt.output), "vorbis", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples, err := tr.DecodePCM([]byte("anything"), waveformSampleRate)
+			if tt.samples == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %v", samples)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(samples, tt.samples) {
+				t.Errorf("expected %v, got %v, %v", tt.samples, samples, err)
+			}
+		})
+	}
+}
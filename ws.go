@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// /ws speaks two subprotocols. The page connects without asking for one and
+// gets HTML fragments for HTMX to swap in. Anything else can ask for
+// wsProtocolJSON and get typed events instead, with the slots in the same
+// shape as /api/v1.
+//
+// Every message is stamped with the state version it brings the client to
+// and prev, the version the client has to be at for it to apply. A client
+// starts from a snapshot (prev 0) and if a message's prev isn't the version
+// it's at it missed something, and sends wsSnapshotRequest to start over.
+// Updates the hub drops because newer ones replace them don't count as
+// missed, prev is worked out from what each client was actually sent.
+const (
+	wsProtocolHTMX = "soundboard.htmx"
+	wsProtocolJSON = "soundboard.json.v1"
+	// wsEventVersion goes out with every JSON event, bump it when an
+	// event's shape changes.
+	wsEventVersion = 1
+)
+
+const (
+	wsEventSnapshot       = "snapshot"        // data: apiBoard, the whole board
+	wsEventBoardUpdated   = "board_updated"   // data: wsBoardUpdated, only the slots that changed
+	wsEventSoundPlayed    = "sound_played"    // data: wsSoundPlayed
+	wsEventLibraryChanged = "library_changed" // no data, refetch /api/v1/library
+	wsEventUserCount      = "user_count"      // data: wsUserCount
+	wsEventGatewayStatus  = "gateway_status"  // data: wsGatewayStatus
+)
+
+type wsEvent struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Data    any    `json:"data,omitempty"`
+}
+
+type wsBoardUpdated struct {
+	Slots []apiBoardSlot `json:"slots"`
+}
+
+type wsSoundPlayed struct {
+	SoundID string `json:"soundID"`
+}
+
+type wsUserCount struct {
+	Count int `json:"count"`
+}
+
+type wsGatewayStatus struct {
+	GatewayConnected bool `json:"gatewayConnected"`
+	UserInChannel    bool `json:"userInChannel"`
+}
+
+// wsSnapshotRequest is what a client sends to get the whole board again.
+type wsSnapshotRequest struct {
+	Type string `json:"type"` // "snapshot_request"
+}
+
+func isSnapshotRequest(msg []byte) bool {
+	var request wsSnapshotRequest
+	return json.Unmarshal(msg, &request) == nil && request.Type == "snapshot_request"
+}
+
+// stampVersion adds the state versions to a frame for one client, as
+// top-level fields of a JSON event or an element the page swaps in.
+func stampVersion(protocol string, data []byte, version, prev uint64) []byte {
+	v, p := strconv.FormatUint(version, 10), strconv.FormatUint(prev, 10)
+	if protocol == wsProtocolJSON {
+		if !bytes.HasPrefix(data, []byte("{")) {
+			return data
+		}
+		stamped := make([]byte, 0, len(data)+len(v)+len(p)+27)
+		stamped = append(stamped, `{"stateVersion":`+v+`,"prev":`+p+`,`...)
+		return append(stamped, data[1:]...)
+	}
+	return append(append([]byte{}, data...), `<div id="state-version" hidden data-version="`+v+`" data-prev="`+p+`"></div>`...)
+}
+
+func newWSEvent(eventType string, data any) wsEvent {
+	return wsEvent{Version: wsEventVersion, Type: eventType, Data: data}
+}
+
+// keys are what the event updates, for the hub to drop older events it
+// replaces. Plays replace nothing.
+func (e wsEvent) keys() []string {
+	switch e.Type {
+	case wsEventBoardUpdated:
+		board, _ := e.Data.(wsBoardUpdated)
+		keys := make([]string, 0, len(board.Slots))
+		for _, slot := range board.Slots {
+			keys = append(keys, slotKey(slot.Slot))
+		}
+		return keys
+	case wsEventUserCount, wsEventGatewayStatus, wsEventLibraryChanged:
+		return []string{e.Type}
+	}
+	return nil
+}
+
+// wsMessage is one update for every websocket client, as fragments for the
+// page and as events for JSON clients. Either can be empty when the update
+// doesn't mean anything to that kind of client. keys are the ids of the
+// elements html replaces.
+type wsMessage struct {
+	html   []byte
+	keys   []string
+	events []wsEvent
+}
+
+// frames renders the message once for each protocol.
+func (m wsMessage) frames() map[string][]hubFrame {
+	frames := make(map[string][]hubFrame, 2)
+	if len(m.html) > 0 {
+		frames[wsProtocolHTMX] = []hubFrame{{wsFrame: wsFrame{data: m.html}, keys: m.keys}}
+	}
+	for _, event := range m.events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[error] encoding %s event: %v\n", event.Type, err)
+			continue
+		}
+		frames[wsProtocolJSON] = append(frames[wsProtocolJSON], hubFrame{wsFrame: wsFrame{data: data}, keys: event.keys()})
+	}
+	return frames
+}
+
+// wsFrame is one message for a client. id is only set on the last frame of a
+// broadcast, it's what /events clients resume from.
+type wsFrame struct {
+	id   string
+	data []byte
+}
+
+// wsProtocol is the protocol negotiated for a connection, the page's when the
+// client didn't ask for one we know.
+func wsProtocol(negotiated string) string {
+	if negotiated == wsProtocolJSON {
+		return wsProtocolJSON
+	}
+	return wsProtocolHTMX
+}